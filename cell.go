@@ -10,8 +10,16 @@ type Cell struct {
 	Fireflies map[int]*Firefly // Fireflies in this cell.
 
 	w                        *World  // World this cell is in.
-	Cx, Cy                   int     // Coordinates of the cell in the world.
+	Cx, Cy, Cz               int     // Coordinates of the cell in the world, Cz is 0 in a flat world.
 	top, bottom, left, right float32 // Borders of the cell.
+	back, front              float32 // Borders of the cell along the depth.
+
+	parent   *Cell         // Cell this one is a quadrant of, nil for a cell of the grid.
+	children []*Cell       // Quadrants of the cell if it is split, nil for a leaf.
+	quit     chan struct{} // Closed to stop the goroutine when the quadrant is merged.
+
+	inbox   []*Firefly // Blinks to process in this round, in deterministic mode.
+	blinked []*Firefly // Fireflies that blinked in this round, in deterministic mode.
 
 	chMove  chan byte // Channel to request a move of all the fireflies in the cell.
 	chBlink chan byte // Channel to request a blink  of all the fireflies in the cell.
@@ -25,6 +33,11 @@ type Cell struct {
 
 // Create a new cell and start listening on the channels.
 func NewCell(w *World, cx, cy int) *Cell {
+	return newCell(w, cx, cy, 0)
+}
+
+// Create a new cell in the layer cz and start listening on the channels.
+func newCell(w *World, cx, cy, cz int) *Cell {
 	c := &Cell{}
 
 	// fireflies in this cell
@@ -32,12 +45,13 @@ func NewCell(w *World, cx, cy int) *Cell {
 
 	// general info
 	c.w = w
-	c.Cx, c.Cy = cx, cy
+	c.Cx, c.Cy, c.Cz = cx, cy, cz
 
 	// channels
 	c.chMove = make(chan byte)
 	c.chBlink = make(chan byte)
 	c.blinkDone = make(chan bool)
+	c.quit = make(chan struct{})
 	// TODO proper size for this buffer
 	c.blinkQueue = make(chan *Firefly, 100000)
 
@@ -48,6 +62,8 @@ func NewCell(w *World, cx, cy int) *Cell {
 	c.right = c.left + c.w.CellSize
 	c.bottom = c.w.CellSize * fcy
 	c.top = c.bottom + c.w.CellSize
+	c.back = c.w.CellSize * float32(c.Cz)
+	c.front = c.back + c.w.CellSize
 
 	// start listening on the channels
 	go c.Listen()
@@ -55,6 +71,15 @@ func NewCell(w *World, cx, cy int) *Cell {
 	return c
 }
 
+// Create a cell covering a quadrant of the parent, and start listening on the channels.
+func newSubCell(p *Cell, left, right, bottom, top float32) *Cell {
+	c := newCell(p.w, p.Cx, p.Cy, p.Cz)
+	c.parent = p
+	c.left, c.right = left, right
+	c.bottom, c.top = bottom, top
+	return c
+}
+
 // Listen waits on all the channels to react to move or blink requests.
 func (c *Cell) Listen() {
 	for {
@@ -66,6 +91,11 @@ func (c *Cell) Listen() {
 		case <-c.chBlink:
 			c.Blink()
 
+		case <-c.w.quit:
+			return
+
+		case <-c.quit:
+			return
 		}
 	}
 }
@@ -112,12 +142,9 @@ func (c *Cell) Blink() {
 	// check if some fireflies are blinking with the current w.Clock
 	// and put them on the correct queues
 	for _, f := range c.Fireflies {
-		f.ResetNudgeable()
-		if f.nudgeable {
-			if f.CheckBlink() {
-				c.blinkQueue <- f
-				c.blinkNeighbors(f)
-			}
+		if f.blinkOnOwn() {
+			c.blinkQueue <- f
+			c.blinkNeighbors(f)
 		}
 	}
 
@@ -177,22 +204,79 @@ func (c *Cell) Blink() {
 
 // Send the Firefly to the neighboring cells' blink queue.
 func (c *Cell) blinkNeighbors(f *Firefly) {
-	// left
-	if f.X-c.left < c.w.borderDist {
-		c.w.SendBlinkTo(f, c, 'L')
-	} else
-	// right
-	if c.right-f.X < c.w.borderDist {
-		c.w.SendBlinkTo(f, c, 'R')
+	c.forNeighbors(f, func(nc *Cell) {
+		c.w.sendBlink(f, nc)
+	})
+}
+
+// Call fn on each neighboring cell that receives the blink of the Firefly.
+//
+// A firefly close to a corner reaches also the diagonal neighbors:
+// up to 8 cells in a flat world and 26 in a 3D one.
+// With the adaptive decomposition the neighbors are found in the grid,
+// then the blink reaches their leaves close to the firefly.
+func (c *Cell) forNeighbors(f *Firefly, fn func(nc *Cell)) {
+	adaptive := c.w.Adaptive != nil
+	g := c
+	if adaptive {
+		g = c.root()
+		c.nearLeaves(f, g, fn)
+	}
+
+	// side of the cell the firefly is close to, along each axis
+	dx := g.borderSide(f.X, g.left, g.right)
+	dy := g.borderSide(f.Y, g.bottom, g.top)
+	dz := 0
+	if c.w.CellDNum > 0 {
+		dz = g.borderSide(f.Z, g.back, g.front)
+	}
+
+	// each axis contributes no offset, or also the side if close to it
+	// in a thin world different offsets can wrap to the same cell, send only once
+	sent := [8]*Cell{g}
+	nSent := 1
+	for i := 0; i <= dx*dx; i++ {
+		for ii := 0; ii <= dy*dy; ii++ {
+			for iii := 0; iii <= dz*dz; iii++ {
+				// skip the cell itself
+				if i+ii+iii == 0 {
+					continue
+				}
+				nc := c.w.neighborCell(g, i*dx, ii*dy, iii*dz)
+				if nc == nil || cellIn(nc, sent[:nSent]) {
+					continue
+				}
+				if adaptive {
+					c.nearLeaves(f, nc, fn)
+				} else {
+					fn(nc)
+				}
+				sent[nSent] = nc
+				nSent++
+			}
+		}
+	}
+}
+
+// Check if the cell is in the list.
+func cellIn(c *Cell, cells []*Cell) bool {
+	for _, cc := range cells {
+		if cc == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Side of the cell the coordinate is close to: -1 for lo, 1 for hi, 0 if far from both.
+func (c *Cell) borderSide(v, lo, hi float32) int {
+	if v-lo < c.w.borderDist {
+		return -1
 	}
-	// bottom
-	if f.Y-c.bottom < c.w.borderDist {
-		c.w.SendBlinkTo(f, c, 'B')
-	} else
-	// top
-	if c.top-f.Y < c.w.borderDist {
-		c.w.SendBlinkTo(f, c, 'T')
+	if hi-v < c.w.borderDist {
+		return 1
 	}
+	return 0
 }
 
 // Enter adds a firefly to the cell.
@@ -98,9 +98,69 @@ func TestBlinkNeighbor(t *testing.T) {
 		"Firefly 2 should have blinked.")
 }
 
+// A blinking firefly nudges a neighbor in the diagonal cell, across the corner.
+func TestBlinkNeighborCorner(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+
+	// f1 will blink immediately
+	f1 := NewFirefly(199, 199, 0, 0, 1000000, w)
+	f1.SetNextBlink(w.Clock - 1)
+	// f2 will blink when nudged by f1
+	f2 := NewFirefly(201, 201, 0, 1, 1000000, w)
+	f2.SetNextBlink(w.Clock + 1)
+	assert.NotSame(t, f1.c, f2.c)
+
+	w.wgClockTick.Add(2)
+	go f2.c.Blink() // start f2 first, so that it will pause with empty blinkQueue
+	go f1.c.Blink()
+	w.wgClockTick.Wait()
+
+	assert.Equal(t, false, f1.nudgeable,
+		"Firefly 1 should have blinked.")
+	assert.Equal(t, false, f2.nudgeable,
+		"Firefly 2 should have blinked.")
+
+	// the blink reaches the diagonal cell, and only once
+	w = NewWorld(10, 10, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	f := NewFirefly(99.5, 99.5, 0, 0, 1000000, w)
+	f.c.blinkNeighbors(f)
+	assert.Equal(t, 1, len(w.Cells[1][1].blinkQueue),
+		"The cell to the top right should have received the Firefly on the blinkQueue.")
+}
+
 // Check that the fields/verbs used when printing are valid.
 func TestStringCell(t *testing.T) {
 	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
 	f := NewFirefly(0, 0, 0, 0, 1000000, w)
-	f.c.String()
+	_ = f.c.String()
+}
+
+// Close to a corner of a 3D cell the blink reaches the diagonal neighbors too.
+func TestBlinkNeighborsDiagonal(t *testing.T) {
+	// a corner has 7 neighbors, 26 cells surround each cell
+	w3 := NewWorld3D(4, 4, 4, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	g := NewFirefly3D(1, 1, 99, 0, 1, 1000000, w3)
+	g.c.blinkNeighbors(g)
+	reached := 0
+	for _, c := range w3.allCells {
+		reached += len(c.blinkQueue)
+	}
+	assert.Equal(t, 7, reached)
+	assert.Equal(t, 1, len(w3.Layers[1][3][3].blinkQueue))
+	assert.Equal(t, 0, len(g.c.blinkQueue))
+
+	// the walls of a bounded world stop the blinks
+	w3.Bounded = true
+	for _, c := range w3.allCells {
+		for len(c.blinkQueue) > 0 {
+			<-c.blinkQueue
+		}
+	}
+	g.c.blinkNeighbors(g)
+	reached = 0
+	for _, c := range w3.allCells {
+		reached += len(c.blinkQueue)
+	}
+	assert.Equal(t, 1, reached)
+	assert.Equal(t, 1, len(w3.Layers[1][0][0].blinkQueue))
 }
@@ -0,0 +1,217 @@
+package firefly
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint is the full state of a World, to resume a long simulation.
+//
+// The parameter fields are not saved, as they are loaded from their spec:
+// set them again after restoring the World.
+type Checkpoint struct {
+	Config    Config              // Parameters of the World.
+	Rand      uint64              // State of the random source of the world.
+	NextID    int                 // Id of the next firefly created by the world.
+	EmergeAcc float64             // Fraction of a firefly still waiting to emerge.
+	Fireflies []FireflyCheckpoint // State of the fireflies, sorted by id.
+	Graph     *Graph              `json:",omitempty"` // Interaction topology in graph mode.
+
+	Step         int // Steps done by the front end, to resume the frame count.
+	ScenarioNext int // Index of the next action of the ScenarioRunner.
+}
+
+// FireflyCheckpoint is the full state of a firefly.
+type FireflyCheckpoint struct {
+	FireflyState
+
+	BasePeriod int  // Period before the modulation of the PeriodField (us).
+	NextBlink  int  // Virtual time of the next scheduled blink (us).
+	Nudgeable  bool // True if the firefly timer can be nudged.
+	Born       int  // Virtual time of birth (us).
+	Death      int  // Virtual time of death (us), 0 if the firefly never dies.
+
+	Pacemaker     *Pacemaker `json:",omitempty"` // Schedule of the pacemaker, nil for a firefly.
+	PacemakerNext int        `json:",omitempty"` // Index of the next flash in the schedule.
+}
+
+// Checkpoint returns the full state of the World.
+//
+// Must be called between steps.
+func (w *World) Checkpoint() *Checkpoint {
+	cp := &Checkpoint{}
+	cp.Config = w.Config()
+	cp.Rand = w.rng.State
+	cp.NextID = w.nextID
+	if w.Lifecycle != nil {
+		cp.EmergeAcc = w.Lifecycle.emergeAcc
+	}
+	cp.Graph = w.Graph
+
+	fireflies := map[int]*Firefly{}
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			fireflies[f.Id] = f
+		}
+	}
+	for _, s := range w.Frame().Fireflies {
+		cp.Fireflies = append(cp.Fireflies, fireflies[s.Id].checkpoint())
+	}
+	return cp
+}
+
+// Full state of the firefly.
+func (f *Firefly) checkpoint() FireflyCheckpoint {
+	fc := FireflyCheckpoint{
+		FireflyState: f.State(),
+		BasePeriod:   f.BasePeriod,
+		NextBlink:    f.NextBlink,
+		Nudgeable:    f.nudgeable,
+		Born:         f.Born,
+		Death:        f.Death,
+	}
+	if f.Pacemaker != nil {
+		fc.Pacemaker = &Pacemaker{Schedule: f.Pacemaker.Schedule}
+		fc.PacemakerNext = f.Pacemaker.next
+	}
+	return fc
+}
+
+// RestoreWorld creates a World in the state saved in the Checkpoint.
+//
+// A checkpoint in graph mode needs a firefly on each node of the graph.
+func RestoreWorld(cp *Checkpoint) (*World, error) {
+	if err := cp.checkGraph(); err != nil {
+		return nil, err
+	}
+	w := NewWorldFromConfig(cp.Config)
+	w.rng.State = cp.Rand
+	w.nextID = cp.NextID
+	if w.Lifecycle != nil {
+		w.Lifecycle.emergeAcc = cp.EmergeAcc
+	}
+
+	// in graph mode the nodes are the ids of the fireflies
+	if cp.Graph != nil {
+		w.Graph = cp.Graph
+		w.nodes = make([]*Firefly, cp.Graph.N)
+	}
+
+	// the pacemakers are sorted by id, as they were created
+	for _, fc := range cp.Fireflies {
+		if w.Graph == nil {
+			w.restoreFirefly(fc)
+			continue
+		}
+		// a firefly without a node, or a second one for the same node, is skipped
+		if fc.Id < 0 || fc.Id >= len(w.nodes) || w.nodes[fc.Id] != nil {
+			continue
+		}
+		w.nodes[fc.Id] = w.restoreFirefly(fc)
+	}
+	if w.Adaptive != nil {
+		w.Rebalance()
+	}
+	return w, nil
+}
+
+// Check that the graph of the Checkpoint joins its own nodes, and that each node has a firefly.
+func (cp *Checkpoint) checkGraph() error {
+	g := cp.Graph
+	if g == nil {
+		return nil
+	}
+	if g.N < 0 || len(g.Adj) != g.N {
+		return fmt.Errorf("checkpoint: the graph of %d nodes has %d lists of neighbours", g.N, len(g.Adj))
+	}
+	for i, adj := range g.Adj {
+		for _, n := range adj {
+			if n < 0 || n >= g.N {
+				return fmt.Errorf("checkpoint: node %d has the neighbour %d out of the graph", i, n)
+			}
+		}
+	}
+	found := make([]bool, g.N)
+	for _, fc := range cp.Fireflies {
+		if fc.Id >= 0 && fc.Id < g.N {
+			found[fc.Id] = true
+		}
+	}
+	for i, ok := range found {
+		if !ok {
+			return fmt.Errorf("checkpoint: node %d of the graph has no firefly", i)
+		}
+	}
+	return nil
+}
+
+// Create a firefly in the state saved, and put it in its cell.
+func (w *World) restoreFirefly(fc FireflyCheckpoint) *Firefly {
+	f := &Firefly{}
+	f.w = w
+	f.X, f.Y, f.Z = w.validatePos(fc.X, fc.Y, fc.Z)
+	f.O = ValidateOri(fc.O)
+	f.P = fc.P
+	f.Id = fc.Id
+	f.c = w.cellAt(f.X, f.Y, f.Z)
+	f.Period = fc.Period
+	f.BasePeriod = fc.BasePeriod
+	f.LastBlink = fc.LastBlink
+	f.NextBlink = fc.NextBlink
+	f.nudgeable = fc.Nudgeable
+	f.Born = fc.Born
+	f.Death = fc.Death
+	if fc.Pacemaker != nil {
+		f.Pacemaker = &Pacemaker{Schedule: fc.Pacemaker.Schedule, next: fc.PacemakerNext}
+		w.pacemakers = append(w.pacemakers, f)
+	}
+	w.ChangeCell(&ChangeCellReq{f, nil, f.c})
+	return f
+}
+
+// SaveCheckpoint writes the Checkpoint as JSON.
+//
+// The file is replaced only once the new one is complete,
+// so that a crash while saving keeps the previous checkpoint.
+func SaveCheckpoint(path string, cp *Checkpoint) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := WriteCheckpoint(tmp, cp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WriteCheckpoint encodes the Checkpoint as JSON.
+func WriteCheckpoint(w io.Writer, cp *Checkpoint) error {
+	return json.NewEncoder(w).Encode(cp)
+}
+
+// LoadCheckpoint reads a Checkpoint from a JSON file.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCheckpoint(f)
+}
+
+// ReadCheckpoint decodes a Checkpoint in JSON.
+func ReadCheckpoint(r io.Reader) (*Checkpoint, error) {
+	cp := &Checkpoint{}
+	if err := json.NewDecoder(r).Decode(cp); err != nil {
+		return nil, fmt.Errorf("checkpoint: %v", err)
+	}
+	return cp, nil
+}
@@ -0,0 +1,105 @@
+package firefly
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A restored World has the same fireflies, pacemakers and random source.
+func TestCheckpointRestore(t *testing.T) {
+	w := NewWorld(4, 3, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	w.SetSeed(7)
+	w.Lifecycle = NewLifecycle(30, 2_000_000, 4_000_000)
+	w.HatchFireflies(60)
+	w.AddPacemaker(20, 20, 800_000, 1_500_000)
+	w.AddStimulus(120, 80, []int{1_200_000, 1_900_000})
+	for i := 0; i < 40; i++ {
+		w.Step()
+	}
+
+	cp := w.Checkpoint()
+	cp.Step = 40
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	assert.NoError(t, SaveCheckpoint(path, cp))
+	loaded, err := LoadCheckpoint(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, loaded.Step)
+
+	v, err := RestoreWorld(loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, w.Frame(), v.Frame())
+	assert.Equal(t, w.Population(), v.Population())
+	assert.Equal(t, w.rng.State, v.rng.State)
+	assert.Equal(t, w.Lifecycle.emergeAcc, v.Lifecycle.emergeAcc)
+	vcp := v.Checkpoint()
+	vcp.Step = 40
+	assert.Equal(t, cp, vcp)
+
+	// the restored world does not share the mutable state
+	assert.NotSame(t, w.Lifecycle, v.Lifecycle)
+	v.Lifecycle.emergeAcc = 0.25
+	assert.NotEqual(t, 0.25, w.Lifecycle.emergeAcc)
+	assert.NotSame(t, w.Lifecycle, w.Config().Lifecycle)
+
+	// the pacemakers keep their schedule
+	assert.Len(t, v.Pacemakers(), 2)
+	assert.Equal(t, 2, v.Pacemakers()[1].Pacemaker.next)
+
+	// and the restored world runs
+	v.Step()
+	assert.Equal(t, w.Clock+w.ClockTickLen, v.Clock)
+}
+
+// A World in graph mode is restored with its topology.
+func TestCheckpointGraph(t *testing.T) {
+	w := NewWorld(4, 3, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	w.SetGraph(NewRingGraph(12, 2))
+	w.Step()
+
+	v, err := RestoreWorld(w.Checkpoint())
+	assert.NoError(t, err)
+	assert.Equal(t, w.Graph, v.Graph)
+	assert.Len(t, v.nodes, 12)
+	assert.Equal(t, 7, v.nodes[7].Id)
+	assert.Equal(t, w.Frame(), v.Frame())
+
+	// no firefly is added without a node
+	w.AddFireflies(5)
+	assert.Equal(t, 12, w.Population())
+	assert.Error(t, w.ApplyAction(Action{Type: "pacemaker", X: 10, Y: 10, Value: 1_000_000}))
+
+	// the fireflies without a node are skipped
+	w.AddPacemaker(10, 10, 1_000_000, w.Clock)
+	v, err = RestoreWorld(w.Checkpoint())
+	assert.NoError(t, err)
+	assert.Equal(t, 12, len(v.Frame().Fireflies))
+	assert.Empty(t, v.Pacemakers())
+	v.Step()
+}
+
+// The fireflies of a graph cannot be removed, and a checkpoint with an empty node is refused.
+func TestCheckpointGraphRemove(t *testing.T) {
+	w := NewWorld(4, 3, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	w.SetGraph(NewRingGraph(20, 2))
+	assert.Error(t, w.ApplyAction(Action{Type: "remove", Count: 5}))
+	w.RemoveFireflies(5)
+	assert.Equal(t, 20, w.Population())
+
+	cp := w.Checkpoint()
+	v, err := RestoreWorld(cp)
+	assert.NoError(t, err)
+	v.Step()
+	assert.Equal(t, w.Clock+w.ClockTickLen, v.Clock)
+
+	cp.Fireflies = append(cp.Fireflies[:3], cp.Fireflies[8:]...)
+	_, err = RestoreWorld(cp)
+	assert.Error(t, err)
+
+	cp = w.Checkpoint()
+	cp.Graph = &Graph{N: 20, Adj: make([][]int, 20)}
+	cp.Graph.Adj[4] = []int{25}
+	_, err = RestoreWorld(cp)
+	assert.Error(t, err)
+}
@@ -0,0 +1,123 @@
+package firefly
+
+import "fmt"
+
+// MinPeriod is the shortest period of a firefly (us): the first blink is drawn between 1 ms and the period.
+const MinPeriod = 1000
+
+// Config holds the parameters of a World.
+type Config struct {
+	CellWNum        int        // Width of the world in cells.
+	CellHNum        int        // Height of the world in cells.
+	CellDNum        int        `json:",omitempty"` // Depth of the world in cells, 0 for a flat world.
+	Bounded         bool       `json:",omitempty"` // The borders are walls, instead of wrapping around.
+	CellSize        float32    // Size of the cells in pixels.
+	Clock           int        // Internal time of the simulation, in us.
+	ClockTickLen    int        // Update per tick.
+	NudgeAmount     int        // How much to nudge the firefly deadlines.
+	NudgeRadius     float32    // Max distance between communicating fireflies.
+	BlinkCooldown   int        // Cooldown after blinking while the Firefly is not nudgeable.
+	PeriodMin       int        // Minimum length of the fireflies' period.
+	PeriodMax       int        // Maximum length of the fireflies' period.
+	Perception      Perception // How the nudge strength falls with the distance.
+	PerceptionScale float32    // Distance scale of the falloff, half the NudgeRadius if 0.
+	DetectionProb   float64    // Probability that a firefly sees each flash.
+	Coupling        Coupling   // How a seen flash changes the deadlines.
+	Seed            int64      // Seed of the random source of the world.
+	Lifecycle       *Lifecycle `json:",omitempty"` // Birth and death dynamics.
+	Adaptive        *Adaptive  `json:",omitempty"` // Adaptive decomposition of the cells.
+	Deterministic   bool       `json:",omitempty"` // Blink in synchronous rounds.
+}
+
+// Config returns the current parameters of the World.
+func (w *World) Config() Config {
+	return Config{
+		CellWNum:        w.CellWNum,
+		CellHNum:        w.CellHNum,
+		CellDNum:        w.CellDNum,
+		Bounded:         w.Bounded,
+		CellSize:        w.CellSize,
+		Clock:           w.Clock,
+		ClockTickLen:    w.ClockTickLen,
+		NudgeAmount:     w.NudgeAmount,
+		NudgeRadius:     w.NudgeRadius,
+		BlinkCooldown:   w.BlinkCooldown,
+		PeriodMin:       w.PeriodMin,
+		PeriodMax:       w.PeriodMax,
+		Perception:      w.Perception,
+		PerceptionScale: w.PerceptionScale,
+		DetectionProb:   w.DetectionProb,
+		Coupling:        w.Coupling,
+		Seed:            w.Seed,
+		Lifecycle:       w.Lifecycle.Copy(),
+		Adaptive:        w.Adaptive.Copy(),
+		Deterministic:   w.Deterministic,
+	}
+}
+
+// NewWorldFromConfig creates a new World with the parameters in the Config.
+func NewWorldFromConfig(c Config) *World {
+	w := NewWorld3D(
+		c.CellWNum, c.CellHNum, c.CellDNum, c.CellSize,
+		c.Clock, c.ClockTickLen,
+		c.NudgeAmount, c.NudgeRadius,
+		c.BlinkCooldown,
+		c.PeriodMin, c.PeriodMax,
+	)
+	w.Bounded = c.Bounded
+	w.Perception = c.Perception
+	w.PerceptionScale = c.PerceptionScale
+	w.DetectionProb = c.DetectionProb
+	w.Coupling = c.Coupling
+	w.SetSeed(c.Seed)
+	w.Lifecycle = c.Lifecycle.Copy()
+	w.Adaptive = c.Adaptive.Copy()
+	w.Deterministic = c.Deterministic
+	return w
+}
+
+// Validate checks that the Config makes a World that can run.
+func (c Config) Validate() error {
+	err := error(nil)
+	switch {
+	case c.CellWNum < 1 || c.CellHNum < 1 || c.CellDNum < 0:
+		err = fmt.Errorf("invalid grid of %dx%dx%d cells", c.CellWNum, c.CellHNum, c.CellDNum)
+	case c.CellSize <= 0:
+		err = fmt.Errorf("the cell size must be positive, got %v", c.CellSize)
+	case c.ClockTickLen <= 0:
+		err = fmt.Errorf("the tick length must be positive, got %d", c.ClockTickLen)
+	case c.NudgeAmount < 0 || c.NudgeRadius < 0 || c.BlinkCooldown < 0:
+		err = fmt.Errorf("the nudge amount, nudge radius and blink cooldown cannot be negative")
+	case c.PeriodMin < MinPeriod || c.PeriodMax < c.PeriodMin:
+		err = fmt.Errorf("invalid period range [%d, %d], the shortest period is %d", c.PeriodMin, c.PeriodMax, MinPeriod)
+	case c.PerceptionScale < 0:
+		err = fmt.Errorf("the perception scale cannot be negative, got %v", c.PerceptionScale)
+	case c.DetectionProb < 0 || c.DetectionProb > 1:
+		err = fmt.Errorf("the detection probability must be in [0, 1], got %v", c.DetectionProb)
+	case perceptionNames[c.Perception] == "":
+		err = fmt.Errorf("unknown perception model %v", c.Perception)
+	case couplingNames[c.Coupling] == "":
+		err = fmt.Errorf("unknown coupling mode %v", c.Coupling)
+	}
+	if err == nil && c.Lifecycle != nil {
+		l := c.Lifecycle
+		if l.LifespanMin < 0 || l.LifespanMax < l.LifespanMin {
+			err = fmt.Errorf("invalid lifespan range [%d, %d]", l.LifespanMin, l.LifespanMax)
+		}
+		for _, e := range l.Emergence {
+			if e.Rate < 0 {
+				err = fmt.Errorf("the emergence rate cannot be negative, got %v", e.Rate)
+			}
+		}
+	}
+	if err == nil && c.Adaptive != nil {
+		a := c.Adaptive
+		if a.MaxLoad < 1 || a.MinLoad >= a.MaxLoad || a.MinSize <= 0 {
+			err = fmt.Errorf("invalid adaptive cells %+v", *a)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	return nil
+}
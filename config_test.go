@@ -0,0 +1,58 @@
+package firefly
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A World can be rebuilt from its Config, also after a JSON round trip.
+func TestConfigRoundTrip(t *testing.T) {
+	w := NewWorld(5, 4, 60, 2_000_000, 20_000, 30_000, 25, 400_000, 800_000, 1_200_000)
+	w.SetSeed(99)
+	w.Perception = PerceptionGaussian
+	w.Coupling = CouplingReset
+	w.DetectionProb = 0.7
+	w.Lifecycle = NewLifecycle(5, 1_000_000, 2_000_000)
+
+	data, err := json.Marshal(w.Config())
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"Perception":"gauss"`)
+
+	c := Config{}
+	assert.NoError(t, json.Unmarshal(data, &c))
+	assert.Equal(t, w.Config().Lifecycle.Emergence, c.Lifecycle.Emergence)
+	c.Lifecycle = w.Lifecycle
+	assert.Equal(t, w.Config(), c)
+
+	v := NewWorldFromConfig(c)
+	assert.Equal(t, w.Config(), v.Config())
+	assert.InDelta(t, 12.5, v.borderDist, 1e-6)
+}
+
+// The invalid configs are rejected with an error.
+func TestConfigValidate(t *testing.T) {
+	w := NewWorld(5, 4, 60, 2_000_000, 20_000, 30_000, 25, 400_000, 800_000, 1_200_000)
+	defer w.Close()
+	assert.NoError(t, w.Config().Validate())
+
+	for _, change := range []func(c *Config){
+		func(c *Config) { c.CellWNum = 0 },
+		func(c *Config) { c.CellDNum = -1 },
+		func(c *Config) { c.CellSize = 0 },
+		func(c *Config) { c.ClockTickLen = 0 },
+		func(c *Config) { c.NudgeRadius = -1 },
+		func(c *Config) { c.PeriodMax = c.PeriodMin - 1 },
+		func(c *Config) { c.PeriodMin, c.PeriodMax = MinPeriod-1, MinPeriod-1 },
+		func(c *Config) { c.DetectionProb = 1.5 },
+		func(c *Config) { c.Coupling = Coupling(9) },
+		func(c *Config) { c.Lifecycle = NewLifecycle(-1, 0, 0) },
+		func(c *Config) { c.Lifecycle = NewLifecycle(1, 20, 10) },
+		func(c *Config) { c.Adaptive = NewAdaptive(10, 0) },
+	} {
+		c := w.Config()
+		change(&c)
+		assert.Error(t, c.Validate(), "%+v", c)
+	}
+}
@@ -0,0 +1,75 @@
+package firefly
+
+import "fmt"
+
+// Coupling is the way a seen flash changes the deadline of a firefly.
+type Coupling int
+
+const (
+	CouplingExcitatory Coupling = iota // A flash makes the firefly blink sooner.
+	CouplingInhibitory                 // A flash makes the firefly blink later.
+	CouplingReset                      // A flash pushes the cycle back towards a restart.
+)
+
+// Names of the coupling modes, as used by ParseCoupling.
+var couplingNames = map[Coupling]string{
+	CouplingExcitatory: "exc",
+	CouplingInhibitory: "inh",
+	CouplingReset:      "reset",
+}
+
+// ParseCoupling returns the Coupling with the requested name.
+func ParseCoupling(name string) (Coupling, error) {
+	for c, n := range couplingNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return CouplingExcitatory, fmt.Errorf("unknown coupling mode %q", name)
+}
+
+// String implements fmt.Stringer.
+func (c Coupling) String() string {
+	if n, ok := couplingNames[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("Coupling(%d)", int(c))
+}
+
+// Apply a nudge of strength s in [0, 1] to the deadline, according to the Coupling of the World.
+//
+// A deadline pushed later is never moved more than a Period away from the clock,
+// so that a firefly surrounded by many others still blinks.
+func (f *Firefly) applyNudge(s float64) {
+	switch f.w.Coupling {
+	case CouplingExcitatory:
+		f.NextBlink -= int(s * float64(f.w.NudgeAmount))
+		return
+	case CouplingInhibitory:
+		f.NextBlink += int(s * float64(f.w.NudgeAmount))
+	case CouplingReset:
+		// move towards the deadline of a cycle starting now
+		restart := f.w.Clock + f.Period
+		if restart > f.NextBlink {
+			f.NextBlink += int(s * float64(restart-f.NextBlink))
+		}
+	}
+	if f.NextBlink > f.w.Clock+f.Period {
+		f.NextBlink = f.w.Clock + f.Period
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (c Coupling) MarshalText() ([]byte, error) {
+	if _, ok := couplingNames[c]; !ok {
+		return nil, fmt.Errorf("unknown coupling mode %d", int(c))
+	}
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *Coupling) UnmarshalText(text []byte) error {
+	cc, err := ParseCoupling(string(text))
+	*c = cc
+	return err
+}
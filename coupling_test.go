@@ -0,0 +1,65 @@
+package firefly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Each coupling mode moves the deadline in the right direction.
+func TestApplyNudge(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	f := NewFirefly(150, 150, 0, 0, 1_000_000, w)
+
+	w.Coupling = CouplingExcitatory
+	f.SetNextBlink(w.Clock + 500_000)
+	f.applyNudge(1)
+	assert.Equal(t, w.Clock+450_000, f.NextBlink, "Excitatory should blink sooner.")
+
+	w.Coupling = CouplingInhibitory
+	f.SetNextBlink(w.Clock + 500_000)
+	f.applyNudge(1)
+	assert.Equal(t, w.Clock+550_000, f.NextBlink, "Inhibitory should blink later.")
+
+	// the delay is capped at a full period from the clock
+	f.SetNextBlink(w.Clock + 990_000)
+	f.applyNudge(1)
+	assert.Equal(t, w.Clock+f.Period, f.NextBlink, "The delay should be capped.")
+
+	w.Coupling = CouplingReset
+	f.SetNextBlink(w.Clock + 200_000)
+	f.applyNudge(0.5)
+	assert.Equal(t, w.Clock+600_000, f.NextBlink, "Reset should move halfway to a restart.")
+}
+
+// A dense swarm with delaying coupling keeps stepping and blinking.
+func TestStepInhibitory(t *testing.T) {
+	for _, c := range []Coupling{CouplingInhibitory, CouplingReset} {
+		w := NewWorld(3, 3, 50, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+		w.SetSeed(3)
+		w.Coupling = c
+		w.HatchFireflies(500)
+
+		blinks := 0
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 100; i++ {
+				w.DoStep <- 'S'
+				<-w.DoneStep
+				for _, f := range w.Cells[1][1].Fireflies {
+					if f.LastBlink > w.Clock-w.ClockTickLen {
+						blinks++
+					}
+				}
+			}
+			done <- true
+		}()
+		select {
+		case <-done:
+		case <-time.After(20 * time.Second):
+			t.Fatalf("The world with %v coupling is stuck.", c)
+		}
+		assert.Greater(t, blinks, 0, "Some fireflies should keep blinking.")
+	}
+}
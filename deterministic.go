@@ -0,0 +1,91 @@
+package firefly
+
+import (
+	"sort"
+	"sync"
+)
+
+// Blink the fireflies in synchronous rounds, so that the result does not depend
+// on the order in which the cells run.
+//
+// In each round every cell processes all the blinks of the previous round,
+// sorted by id, then sends the fireflies that blinked to itself and to the neighbors.
+// The first round has the fireflies that blink on their own.
+//
+// The optional exchange is called after each delivery with true if any blink is pending,
+// and returns true if another round is needed: the distributed nodes use it
+// to swap the blinks sent to the cells of the other tiles.
+func (w *World) syncBlink(exchange func(pending bool) bool) {
+	w.eachCell((*Cell).syncStart)
+	for {
+		pending := w.deliverBlinks()
+		if exchange != nil {
+			pending = exchange(pending)
+		}
+		if !pending {
+			return
+		}
+		w.eachCell((*Cell).syncRound)
+	}
+}
+
+// Run fn on all the cells in parallel, and wait for them.
+func (w *World) eachCell(fn func(c *Cell)) {
+	var wg sync.WaitGroup
+	for _, c := range w.allCells {
+		wg.Add(1)
+		go func(c *Cell) {
+			defer wg.Done()
+			fn(c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// Move the fireflies that blinked in the round to the inbox of their cell and of the neighbors.
+//
+// Return true if any inbox is not empty.
+func (w *World) deliverBlinks() bool {
+	pending := false
+	for _, c := range w.allCells {
+		for _, f := range c.blinked {
+			c.inbox = append(c.inbox, f)
+			c.forNeighbors(f, func(nc *Cell) {
+				nc.inbox = append(nc.inbox, f)
+			})
+		}
+		c.blinked = c.blinked[:0]
+	}
+	for _, c := range w.allCells {
+		if len(c.inbox) > 0 {
+			pending = true
+		}
+	}
+	return pending
+}
+
+// Find the fireflies of the cell that blink on their own.
+func (c *Cell) syncStart() {
+	for _, f := range c.Fireflies {
+		if f.blinkOnOwn() {
+			c.blinked = append(c.blinked, f)
+		}
+	}
+}
+
+// Nudge the fireflies of the cell with the blinks in the inbox.
+func (c *Cell) syncRound() {
+	sort.Slice(c.inbox, func(i, j int) bool { return c.inbox[i].Id < c.inbox[j].Id })
+	for _, fOther := range c.Fireflies {
+		for _, fBlink := range c.inbox {
+			// the firefly already blinked in this tick
+			if !fOther.nudgeable {
+				break
+			}
+			if fOther.Nudge(fBlink) {
+				c.blinked = append(c.blinked, fOther)
+			}
+		}
+	}
+	c.inbox = c.inbox[:0]
+}
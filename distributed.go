@@ -0,0 +1,412 @@
+package firefly
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+)
+
+// Hub coordinates a distributed simulation, with the cell grid split in tiles
+// owned by separate node processes.
+//
+// At each step the nodes move their fireflies, and send the ones entering a cell
+// of another tile to its owner. Then the blinks are processed in deterministic rounds:
+// after each round the nodes send the blinks reaching the cells of the other tiles,
+// and the hub tells them if another round is needed. Every exchange goes through the hub,
+// and is a barrier that keeps the Clock of the nodes in step.
+//
+// Each node hatches the whole swarm from the seed and keeps the fireflies of its tile,
+// so the run matches a single World in deterministic mode.
+type Hub struct {
+	Config    Config // Parameters of the world, always in deterministic mode.
+	TilesW    int    // Tiles along the width of the grid.
+	TilesH    int    // Tiles along the height of the grid.
+	Fireflies int    // Fireflies hatched in the world.
+	Steps     int    // Steps to run.
+	Every     int    // Sample the metrics every this many steps.
+
+	// Optional callback with the metrics of the whole world.
+	Sample func(clock, population, blinking int, order float64)
+
+	ln    net.Listener
+	nodes []*peer
+}
+
+// Setup sent by the hub to each node when it joins.
+type nodeSetup struct {
+	Tile      int
+	TilesW    int
+	TilesH    int
+	Config    Config
+	Fireflies int
+	Steps     int
+	Every     int
+}
+
+// A firefly sent to another tile: moving there, or as a ghost carrying a blink to a cell.
+type haloItem struct {
+	Tile       int  // Tile receiving the firefly.
+	Ghost      bool // The firefly only carries a blink.
+	Cx, Cy, Cz int  // Cell receiving the blink of a ghost.
+	Firefly    FireflyCheckpoint
+}
+
+// Message from a node to the hub at each barrier.
+type nodeMsg struct {
+	Clock   int            // Clock of the node, must match the other nodes.
+	Pending bool           // The node has blinks to process or to send.
+	Out     []haloItem     `json:",omitempty"` // Fireflies for the other tiles.
+	Sums    *nodeSums      `json:",omitempty"` // Metrics of the tile, when sampling.
+	Frame   []FireflyState `json:",omitempty"` // State of the fireflies of the tile, at the end.
+}
+
+// Reply of the hub to a node at each barrier.
+type hubMsg struct {
+	Pending bool       // Another round of blinks is needed.
+	In      []haloItem `json:",omitempty"` // Fireflies from the other tiles.
+}
+
+// Partial sums of the metrics of a tile.
+type nodeSums struct {
+	Population int
+	Blinking   int
+	Re, Im     float64
+}
+
+// A connection exchanging JSON messages.
+type peer struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func newPeer(conn net.Conn) *peer {
+	return &peer{conn, json.NewEncoder(conn), json.NewDecoder(conn)}
+}
+
+// ListenHub creates a Hub for a world split in tw x th tiles, listening for the nodes on addr.
+func ListenHub(addr string, c Config, tw, th, fireflies, steps int) (*Hub, error) {
+	if tw < 1 || th < 1 || tw > c.CellWNum || th > c.CellHNum {
+		return nil, fmt.Errorf("distributed: cannot split %dx%d cells in %dx%d tiles",
+			c.CellWNum, c.CellHNum, tw, th)
+	}
+	if c.Lifecycle != nil {
+		return nil, errors.New("distributed: the lifecycle is not supported")
+	}
+	if c.Adaptive != nil {
+		return nil, errors.New("distributed: the adaptive cells are not supported")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	h := &Hub{}
+	h.Config = c
+	h.Config.Deterministic = true
+	h.TilesW = tw
+	h.TilesH = th
+	h.Fireflies = fireflies
+	h.Steps = steps
+	h.Every = 1
+	h.ln = ln
+	return h, nil
+}
+
+// Addr returns the address the hub is listening on.
+func (h *Hub) Addr() net.Addr {
+	return h.ln.Addr()
+}
+
+// Run waits for a node per tile, runs the simulation and returns the final state of the world.
+func (h *Hub) Run() (*Frame, error) {
+	defer h.close()
+	if h.Every <= 0 {
+		return nil, fmt.Errorf("distributed: sampling every %d steps", h.Every)
+	}
+
+	// assign a tile to each node as it joins
+	for i := 0; i < h.TilesW*h.TilesH; i++ {
+		conn, err := h.ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		p := newPeer(conn)
+		h.nodes = append(h.nodes, p)
+		setup := nodeSetup{
+			Tile:      i,
+			TilesW:    h.TilesW,
+			TilesH:    h.TilesH,
+			Config:    h.Config,
+			Fireflies: h.Fireflies,
+			Steps:     h.Steps,
+			Every:     h.Every,
+		}
+		if err := p.enc.Encode(setup); err != nil {
+			return nil, err
+		}
+	}
+
+	for step := 0; step < h.Steps; step++ {
+		// fireflies changing tile
+		if _, err := h.exchange(); err != nil {
+			return nil, err
+		}
+		// rounds of blinks, until no tile has any left
+		for {
+			pending, err := h.exchange()
+			if err != nil {
+				return nil, err
+			}
+			if !pending {
+				break
+			}
+		}
+		if step%h.Every == 0 {
+			msgs, err := h.gather()
+			if err != nil {
+				return nil, err
+			}
+			h.sample(msgs)
+		}
+	}
+
+	// collect the fireflies of all the tiles
+	msgs, err := h.gather()
+	if err != nil {
+		return nil, err
+	}
+	fr := &Frame{Clock: msgs[0].Clock}
+	for _, m := range msgs {
+		fr.Fireflies = append(fr.Fireflies, m.Frame...)
+	}
+	sort.Slice(fr.Fireflies, func(i, j int) bool {
+		return fr.Fireflies[i].Id < fr.Fireflies[j].Id
+	})
+	return fr, nil
+}
+
+// Read a message from each node, and check that they are in step.
+func (h *Hub) gather() ([]nodeMsg, error) {
+	msgs := make([]nodeMsg, len(h.nodes))
+	for i, p := range h.nodes {
+		if err := p.dec.Decode(&msgs[i]); err != nil {
+			return nil, fmt.Errorf("distributed: node %d: %v", i, err)
+		}
+		if msgs[i].Clock != msgs[0].Clock {
+			return nil, fmt.Errorf("distributed: node %d at clock %d, node 0 at clock %d",
+				i, msgs[i].Clock, msgs[0].Clock)
+		}
+	}
+	return msgs, nil
+}
+
+// Route the fireflies sent by the nodes to the owners of their tiles.
+//
+// Return true if any node has blinks pending.
+func (h *Hub) exchange() (bool, error) {
+	msgs, err := h.gather()
+	if err != nil {
+		return false, err
+	}
+	pending := false
+	in := make([][]haloItem, len(h.nodes))
+	for _, m := range msgs {
+		pending = pending || m.Pending
+		for _, it := range m.Out {
+			if it.Tile < 0 || it.Tile >= len(h.nodes) {
+				return false, fmt.Errorf("distributed: firefly %d sent to tile %d", it.Firefly.Id, it.Tile)
+			}
+			in[it.Tile] = append(in[it.Tile], it)
+		}
+	}
+	for i, p := range h.nodes {
+		if err := p.enc.Encode(hubMsg{Pending: pending, In: in[i]}); err != nil {
+			return false, fmt.Errorf("distributed: node %d: %v", i, err)
+		}
+	}
+	return pending, nil
+}
+
+// Combine the metrics of the tiles.
+func (h *Hub) sample(msgs []nodeMsg) {
+	if h.Sample == nil {
+		return
+	}
+	s := nodeSums{}
+	for _, m := range msgs {
+		if m.Sums == nil {
+			continue
+		}
+		s.Population += m.Sums.Population
+		s.Blinking += m.Sums.Blinking
+		s.Re += m.Sums.Re
+		s.Im += m.Sums.Im
+	}
+	order := 0.0
+	if s.Population > 0 {
+		order = math.Hypot(s.Re, s.Im) / float64(s.Population)
+	}
+	h.Sample(msgs[0].Clock, s.Population, s.Blinking, order)
+}
+
+// Stop listening and drop the nodes: if the run failed, they fail reading.
+func (h *Hub) close() {
+	h.ln.Close()
+	for _, p := range h.nodes {
+		p.conn.Close()
+	}
+}
+
+// Node runs the tile of a distributed simulation.
+type Node struct {
+	W     *World // World of the node, with only the fireflies of its tile.
+	Tile  int    // Tile owned by the node.
+	setup nodeSetup
+	hub   *peer
+}
+
+// DialNode joins the Hub at addr, and creates the World of the tile assigned.
+func DialNode(addr string) (*Node, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{}
+	n.hub = newPeer(conn)
+	if err := n.hub.dec.Decode(&n.setup); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("distributed: setup: %v", err)
+	}
+	n.Tile = n.setup.Tile
+
+	// the whole swarm is hatched, to draw the same random values as a single World
+	n.W = NewWorldFromConfig(n.setup.Config)
+	n.W.HatchFireflies(n.setup.Fireflies)
+	for _, c := range n.W.allCells {
+		if !n.owns(c) {
+			for _, f := range c.Fireflies {
+				c.Leave(f)
+			}
+		}
+	}
+	return n, nil
+}
+
+// Run simulates the tile in step with the other nodes, until the end of the run.
+func (n *Node) Run() error {
+	defer n.hub.conn.Close()
+	defer n.W.Close()
+	w := n.W
+
+	for step := 0; step < n.setup.Steps; step++ {
+		// move, and send away the fireflies that left the tile
+		w.Move()
+		if _, err := n.exchange(n.migrants(), false); err != nil {
+			return err
+		}
+
+		// blink in rounds, swapping the blinks that reach the other tiles
+		w.Clock += w.ClockTickLen
+		var err error
+		w.syncBlink(func(pending bool) bool {
+			if err != nil {
+				return false
+			}
+			pending, err = n.exchange(n.ghosts(), pending)
+			return pending
+		})
+		if err != nil {
+			return err
+		}
+		w.Age()
+
+		if step%n.setup.Every == 0 {
+			re, im, pop := w.phaseSums()
+			sums := &nodeSums{Population: pop, Blinking: w.Blinking(), Re: re, Im: im}
+			if err := n.hub.enc.Encode(nodeMsg{Clock: w.Clock, Sums: sums}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return n.hub.enc.Encode(nodeMsg{Clock: w.Clock, Frame: w.Frame().Fireflies})
+}
+
+// Check if the cell is in the tile of the node.
+func (n *Node) owns(c *Cell) bool {
+	return n.owner(c) == n.Tile
+}
+
+// Tile owning the cell, the grid is split evenly in TilesW x TilesH tiles.
+func (n *Node) owner(c *Cell) int {
+	w := n.W
+	tx := c.Cx * n.setup.TilesW / w.CellWNum
+	ty := c.Cy * n.setup.TilesH / w.CellHNum
+	return ty*n.setup.TilesW + tx
+}
+
+// Remove the fireflies that moved to the cells of other tiles.
+func (n *Node) migrants() []haloItem {
+	out := []haloItem{}
+	for _, c := range n.W.allCells {
+		if n.owns(c) {
+			continue
+		}
+		for _, f := range c.Fireflies {
+			out = append(out, haloItem{Tile: n.owner(c), Firefly: f.checkpoint()})
+			c.Leave(f)
+		}
+	}
+	return out
+}
+
+// Take the blinks delivered to the cells of other tiles.
+func (n *Node) ghosts() []haloItem {
+	out := []haloItem{}
+	for _, c := range n.W.allCells {
+		if n.owns(c) {
+			continue
+		}
+		for _, f := range c.inbox {
+			out = append(out, haloItem{
+				Tile: n.owner(c), Ghost: true,
+				Cx: c.Cx, Cy: c.Cy, Cz: c.Cz,
+				Firefly: f.checkpoint(),
+			})
+		}
+		c.inbox = c.inbox[:0]
+	}
+	return out
+}
+
+// Send the fireflies to the hub, and receive the ones for this tile.
+//
+// Return true if any node has blinks pending.
+func (n *Node) exchange(out []haloItem, pending bool) (bool, error) {
+	w := n.W
+	if err := n.hub.enc.Encode(nodeMsg{Clock: w.Clock, Pending: pending, Out: out}); err != nil {
+		return false, err
+	}
+	msg := hubMsg{}
+	if err := n.hub.dec.Decode(&msg); err != nil {
+		return false, fmt.Errorf("distributed: hub: %v", err)
+	}
+
+	for _, it := range msg.In {
+		if !it.Ghost {
+			w.restoreFirefly(it.Firefly)
+			continue
+		}
+		// a ghost only carries the blink, it is not in any cell
+		g := &Firefly{w: w, Id: it.Firefly.Id}
+		g.X, g.Y, g.Z = it.Firefly.X, it.Firefly.Y, it.Firefly.Z
+		g.Period = it.Firefly.Period
+		g.LastBlink = it.Firefly.LastBlink
+		c := w.Layers[it.Cz][it.Cx][it.Cy]
+		c.inbox = append(c.inbox, g)
+	}
+	return msg.Pending, nil
+}
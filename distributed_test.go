@@ -0,0 +1,114 @@
+package firefly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Config of a small world for the deterministic runs.
+func deterministicConfig() Config {
+	w := NewWorld(6, 4, 50, 1_000_000, 25_000, 40_000, 20, 500_000, 900_000, 1_100_000)
+	defer w.Close()
+	w.SetSeed(11)
+	w.Perception = PerceptionLinear
+	w.Deterministic = true
+	return w.Config()
+}
+
+// Run a single deterministic World, sampling the metrics at each step.
+func runSingle(c Config, fireflies, steps int) (*Frame, [][]float64) {
+	w := NewWorldFromConfig(c)
+	defer w.Close()
+	w.HatchFireflies(fireflies)
+	samples := [][]float64{}
+	for i := 0; i < steps; i++ {
+		w.Step()
+		samples = append(samples, []float64{
+			float64(w.Clock), float64(w.Population()), float64(w.Blinking()), w.OrderParameter(),
+		})
+	}
+	return w.Frame(), samples
+}
+
+// In deterministic mode a seed always gives the same run.
+func TestDeterministic(t *testing.T) {
+	c := deterministicConfig()
+	fr1, _ := runSingle(c, 400, 150)
+	fr2, _ := runSingle(c, 400, 150)
+	assert.Equal(t, fr1, fr2)
+
+	// the swarm did interact
+	blinked := 0
+	for _, s := range fr1.Fireflies {
+		if s.LastBlink > c.Clock {
+			blinked++
+		}
+	}
+	assert.Equal(t, 400, blinked)
+}
+
+// A distributed run on localhost matches the single World.
+func TestDistributedMatchesSingle(t *testing.T) {
+	c := deterministicConfig()
+	fireflies, steps := 400, 150
+	want, wantSamples := runSingle(c, fireflies, steps)
+
+	for _, tiles := range [][2]int{{1, 1}, {2, 1}, {3, 2}} {
+		h, err := ListenHub("127.0.0.1:0", c, tiles[0], tiles[1], fireflies, steps)
+		assert.NoError(t, err)
+		samples := [][]float64{}
+		h.Sample = func(clock, population, blinking int, order float64) {
+			samples = append(samples, []float64{
+				float64(clock), float64(population), float64(blinking), order,
+			})
+		}
+
+		// each node runs in its own goroutine, talking to the hub over TCP
+		errs := make(chan error, tiles[0]*tiles[1])
+		for i := 0; i < tiles[0]*tiles[1]; i++ {
+			go func() {
+				n, err := DialNode(h.Addr().String())
+				if err == nil {
+					err = n.Run()
+				}
+				errs <- err
+			}()
+		}
+		got, err := h.Run()
+		assert.NoError(t, err)
+		for i := 0; i < tiles[0]*tiles[1]; i++ {
+			assert.NoError(t, <-errs)
+		}
+
+		assert.Equal(t, want, got, "Tiles %v", tiles)
+		assert.Len(t, samples, steps)
+		for i := range samples {
+			assert.Equal(t, wantSamples[i][:3], samples[i][:3])
+			assert.InDelta(t, wantSamples[i][3], samples[i][3], 1e-9)
+		}
+	}
+}
+
+// The hub refuses the worlds it cannot split, and the nodes fail if the hub goes away.
+func TestDistributedErrors(t *testing.T) {
+	c := deterministicConfig()
+	_, err := ListenHub("127.0.0.1:0", c, 7, 1, 10, 10)
+	assert.Error(t, err)
+	lc := c
+	lc.Lifecycle = NewLifecycle(1, 0, 0)
+	_, err = ListenHub("127.0.0.1:0", lc, 2, 2, 10, 10)
+	assert.Error(t, err)
+
+	h, err := ListenHub("127.0.0.1:0", c, 2, 1, 10, 10)
+	assert.NoError(t, err)
+	h.Every = 0
+	done := make(chan error)
+	go func() {
+		_, err := h.Run()
+		done <- err
+	}()
+	assert.Error(t, <-done)
+	_, err = DialNode(h.Addr().String())
+	assert.Error(t, err)
+}
@@ -0,0 +1,258 @@
+package firefly
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// EnsembleMetrics are the names of the metrics sampled from each World.
+var EnsembleMetrics = []string{"population", "blinking", "order"}
+
+// Ensemble runs many independent Worlds from the same Config, with different seeds.
+//
+// Each World runs a goroutine per cell, so at most Workers worlds run at the same time,
+// sharing the CPU budget instead of oversubscribing the machine.
+type Ensemble struct {
+	Config    Config           // Parameters of the worlds, the Seed is replaced by each of Seeds.
+	Seeds     []int64          // Seeds of the worlds, one per replica.
+	Fireflies int              // Fireflies hatched in each world.
+	Steps     int              // Steps to run each world.
+	Every     int              // Sample the metrics every this many steps.
+	Workers   int              // Worlds running at the same time, GOMAXPROCS if <= 0.
+	Quantiles []float64        // Quantiles of the metrics to compute, in [0, 1].
+	Setup     func(w *World)   // Optional setup of each world, after hatching.
+	Scenario  *Scenario        // Optional timeline of changes, applied to each world.
+	Progress  func(seed int64) // Optional callback when a world is done, called concurrently.
+}
+
+// NewEnsemble creates an Ensemble of n replicas, with consecutive seeds starting from seed.
+func NewEnsemble(c Config, n int, seed int64, fireflies, steps int) *Ensemble {
+	e := &Ensemble{}
+	e.Config = c
+	e.Seeds = make([]int64, n)
+	for i := range e.Seeds {
+		e.Seeds[i] = seed + int64(i)
+	}
+	e.Fireflies = fireflies
+	e.Steps = steps
+	e.Every = 1
+	e.Quantiles = []float64{0.05, 0.5, 0.95}
+	return e
+}
+
+// EnsembleResult holds the metrics of all the replicas of an Ensemble.
+type EnsembleResult struct {
+	Seeds     []int64        // Seeds of the worlds, in the order of the values.
+	Metrics   []string       // Names of the metrics.
+	Quantiles []float64      // Quantiles computed for each metric.
+	Ticks     []EnsembleTick // Aggregated metrics, one per sample.
+}
+
+// EnsembleTick holds the metrics of all the replicas at a virtual time.
+type EnsembleTick struct {
+	Clock  int         // Virtual time of the sample (us).
+	Stats  []Stats     // Statistics of each metric across the replicas.
+	Values [][]float64 // Value of each metric for each replica, in the order of the Seeds.
+}
+
+// Stats summarizes the values of a metric across the replicas.
+type Stats struct {
+	Mean      float64   // Mean of the values.
+	Std       float64   // Standard deviation of the values.
+	Quantiles []float64 // Quantiles of the values, as requested in the Ensemble.
+}
+
+// Run executes all the replicas, and aggregates their metrics.
+func (e *Ensemble) Run() (*EnsembleResult, error) {
+	if e.Every <= 0 {
+		return nil, fmt.Errorf("ensemble: sampling every %d steps", e.Every)
+	}
+	for _, q := range e.Quantiles {
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("ensemble: quantile %v not in [0, 1]", q)
+		}
+	}
+	workers := e.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// samples[replica][tick][metric]
+	samples := make([][][]float64, len(e.Seeds))
+	clocks := make([][]int, len(e.Seeds))
+	errs := make([]error, len(e.Seeds))
+
+	// each worker runs a world at a time
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				clocks[r], samples[r], errs[r] = e.runReplica(e.Seeds[r])
+				if e.Progress != nil {
+					e.Progress(e.Seeds[r])
+				}
+			}
+		}()
+	}
+	for r := range e.Seeds {
+		jobs <- r
+	}
+	close(jobs)
+	wg.Wait()
+
+	for r, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("ensemble: seed %d: %v", e.Seeds[r], err)
+		}
+	}
+	return e.aggregate(clocks, samples), nil
+}
+
+// Run a single world, and sample its metrics.
+func (e *Ensemble) runReplica(seed int64) ([]int, [][]float64, error) {
+	c := e.Config
+	c.Seed = seed
+	// each world gets its own copy of the Lifecycle, with its emergence accumulator
+	w := NewWorldFromConfig(c)
+	defer w.Close()
+	w.HatchFireflies(e.Fireflies)
+	if e.Setup != nil {
+		e.Setup(w)
+	}
+	var runner *ScenarioRunner
+	if e.Scenario != nil {
+		runner = NewScenarioRunner(e.Scenario)
+	}
+
+	clocks := []int{}
+	samples := [][]float64{}
+	for step := 0; step < e.Steps; step++ {
+		if runner != nil {
+			if _, err := runner.Apply(w); err != nil {
+				return nil, nil, err
+			}
+		}
+		w.Step()
+		if step%e.Every == 0 {
+			clocks = append(clocks, w.Clock)
+			samples = append(samples, []float64{
+				float64(w.Population()),
+				float64(w.Blinking()),
+				w.OrderParameter(),
+			})
+		}
+	}
+	return clocks, samples, nil
+}
+
+// Compute the statistics of each metric at each tick.
+func (e *Ensemble) aggregate(clocks [][]int, samples [][][]float64) *EnsembleResult {
+	res := &EnsembleResult{}
+	res.Seeds = append([]int64(nil), e.Seeds...)
+	res.Metrics = EnsembleMetrics
+	res.Quantiles = append([]float64(nil), e.Quantiles...)
+	if len(samples) == 0 {
+		return res
+	}
+
+	for t := range samples[0] {
+		tick := EnsembleTick{Clock: clocks[0][t]}
+		for m := range EnsembleMetrics {
+			values := make([]float64, len(samples))
+			for r := range samples {
+				values[r] = samples[r][t][m]
+			}
+			tick.Values = append(tick.Values, values)
+			tick.Stats = append(tick.Stats, NewStats(values, e.Quantiles))
+		}
+		res.Ticks = append(res.Ticks, tick)
+	}
+	return res
+}
+
+// NewStats computes mean, standard deviation and quantiles of the values.
+//
+// The quantiles are interpolated linearly between the sorted values.
+func NewStats(values []float64, quantiles []float64) Stats {
+	s := Stats{}
+	n := float64(len(values))
+	if n == 0 {
+		return s
+	}
+	for _, v := range values {
+		s.Mean += v
+	}
+	s.Mean /= n
+	for _, v := range values {
+		s.Std += (v - s.Mean) * (v - s.Mean)
+	}
+	s.Std = math.Sqrt(s.Std / n)
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	for _, q := range quantiles {
+		pos := q * (n - 1)
+		lo := int(math.Floor(pos))
+		hi := int(math.Ceil(pos))
+		s.Quantiles = append(s.Quantiles, sorted[lo]+(pos-float64(lo))*(sorted[hi]-sorted[lo]))
+	}
+	return s
+}
+
+// WriteCSV writes the statistics of each tick as CSV,
+// with the columns clock, then mean, std and quantiles of each metric.
+func (res *EnsembleResult) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	head := []string{"clock"}
+	for _, m := range res.Metrics {
+		head = append(head, m+"_mean", m+"_std")
+		for _, q := range res.Quantiles {
+			head = append(head, fmt.Sprintf("%s_q%g", m, q*100))
+		}
+	}
+	cw.Write(head)
+	for _, t := range res.Ticks {
+		row := []string{strconv.Itoa(t.Clock)}
+		for _, s := range t.Stats {
+			row = append(row, formatFloat(s.Mean), formatFloat(s.Std))
+			for _, q := range s.Quantiles {
+				row = append(row, formatFloat(q))
+			}
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteSeedsCSV writes the final value of each metric for each seed as CSV,
+// so that any outlier can be run again with its seed.
+func (res *EnsembleResult) WriteSeedsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(append([]string{"seed"}, res.Metrics...))
+	if len(res.Ticks) > 0 {
+		last := res.Ticks[len(res.Ticks)-1]
+		for r, seed := range res.Seeds {
+			row := []string{strconv.FormatInt(seed, 10)}
+			for m := range res.Metrics {
+				row = append(row, formatFloat(last.Values[m][r]))
+			}
+			cw.Write(row)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
@@ -0,0 +1,58 @@
+package firefly
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Mean, standard deviation and interpolated quantiles.
+func TestNewStats(t *testing.T) {
+	s := NewStats([]float64{4, 1, 3, 2}, []float64{0, 0.5, 1})
+	assert.InDelta(t, 2.5, s.Mean, 1e-9)
+	assert.InDelta(t, 1.118034, s.Std, 1e-6)
+	assert.InDeltaSlice(t, []float64{1, 2.5, 4}, s.Quantiles, 1e-9)
+
+	assert.Equal(t, Stats{}, NewStats(nil, []float64{0.5}))
+}
+
+// All the replicas run, and their metrics are aggregated per tick.
+func TestEnsembleRun(t *testing.T) {
+	w := NewWorld(3, 3, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	c := w.Config()
+	w.Close()
+
+	e := NewEnsemble(c, 5, 100, 30, 20)
+	e.Every = 4
+	e.Workers = 2
+	done := make(chan int64, len(e.Seeds))
+	e.Progress = func(seed int64) { done <- seed }
+	res, err := e.Run()
+	assert.NoError(t, err)
+	assert.Len(t, done, 5)
+	assert.Equal(t, []int64{100, 101, 102, 103, 104}, res.Seeds)
+
+	assert.Len(t, res.Ticks, 5)
+	tick := res.Ticks[0]
+	assert.Equal(t, 1_025_000, tick.Clock)
+	assert.Len(t, tick.Stats, len(EnsembleMetrics))
+	assert.Len(t, tick.Values[0], 5)
+	assert.Equal(t, 30.0, tick.Stats[0].Mean, "The population is fixed.")
+	assert.Equal(t, 0.0, tick.Stats[0].Std)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, res.WriteCSV(buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 6)
+	assert.True(t, strings.HasPrefix(lines[0], "clock,population_mean,population_std,population_q5,"))
+
+	buf.Reset()
+	assert.NoError(t, res.WriteSeedsCSV(buf))
+	assert.True(t, strings.HasPrefix(buf.String(), "seed,population,blinking,order\n100,30,"))
+
+	e.Quantiles = []float64{2}
+	_, err = e.Run()
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package firefly
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg" // decode jpeg fields
+	_ "image/png"  // decode png fields
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Field is a scalar value over the world, sampled on a regular grid.
+//
+// The values are interpolated bilinearly between the samples,
+// and the field wraps around like the world.
+type Field struct {
+	W, H         int       // Size of the grid in samples.
+	V            []float32 // Samples, row by row from y = 0.
+	SizeW, SizeH float32   // Size of the area covered by the field.
+	Min, Max     float32   // Range of the sampled values.
+}
+
+// NewFieldFromFunc samples the function on a grid of w x h samples covering sizeW x sizeH.
+func NewFieldFromFunc(w, h int, sizeW, sizeH float32, fn func(x, y float32) float32) *Field {
+	fd := &Field{W: w, H: h, SizeW: sizeW, SizeH: sizeH}
+	fd.V = make([]float32, w*h)
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			x := (float32(i) + 0.5) * sizeW / float32(w)
+			y := (float32(j) + 0.5) * sizeH / float32(h)
+			fd.V[j*w+i] = fn(x, y)
+		}
+	}
+	fd.updateRange()
+	return fd
+}
+
+// NewFieldFromImage maps the gray level of the image from [0, 1] to [lo, hi],
+// stretching the image over sizeW x sizeH.
+func NewFieldFromImage(img image.Image, sizeW, sizeH, lo, hi float32) *Field {
+	b := img.Bounds()
+	fd := &Field{W: b.Dx(), H: b.Dy(), SizeW: sizeW, SizeH: sizeH}
+	fd.V = make([]float32, fd.W*fd.H)
+	for j := 0; j < fd.H; j++ {
+		for i := 0; i < fd.W; i++ {
+			r, g, bl, _ := img.At(b.Min.X+i, b.Min.Y+j).RGBA()
+			// luminance as in color.GrayModel
+			gray := float32(19595*r+38470*g+7471*bl+1<<15) / (1 << 16) / 0xffff
+			fd.V[j*fd.W+i] = lo + gray*(hi-lo)
+		}
+	}
+	fd.updateRange()
+	return fd
+}
+
+// LoadFieldImage reads a png or jpeg image as a Field, see NewFieldFromImage.
+func LoadFieldImage(path string, sizeW, sizeH, lo, hi float32) (*Field, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %v", path, err)
+	}
+	return NewFieldFromImage(img, sizeW, sizeH, lo, hi), nil
+}
+
+// LoadFieldSpec creates a Field over the world from a 'source,lo,hi' description.
+//
+// The source is the path of a grayscale image, or one of the functions
+// gradx, grady (linear from lo to hi along the axis)
+// and radial (lo in the center to hi on the border).
+func LoadFieldSpec(spec string, sizeW, sizeH float32) (*Field, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid field %q, expected 'source,lo,hi'", spec)
+	}
+	lo, errLo := strconv.ParseFloat(parts[1], 32)
+	hi, errHi := strconv.ParseFloat(parts[2], 32)
+	if errLo != nil || errHi != nil {
+		return nil, fmt.Errorf("invalid range in field %q", spec)
+	}
+	// the fields multiply the params, that must stay positive
+	if !(lo > 0 && hi > 0) || math.IsInf(lo, 0) || math.IsInf(hi, 0) {
+		return nil, fmt.Errorf("the multipliers of field %q must be positive", spec)
+	}
+	l, h := float32(lo), float32(hi)
+
+	// analytic fields, sampled on a grid fine enough for the interpolation
+	res := 64
+	switch parts[0] {
+	case "gradx":
+		return NewFieldFromFunc(res, 1, sizeW, sizeH, func(x, y float32) float32 {
+			return l + (h-l)*x/sizeW
+		}), nil
+	case "grady":
+		return NewFieldFromFunc(1, res, sizeW, sizeH, func(x, y float32) float32 {
+			return l + (h-l)*y/sizeH
+		}), nil
+	case "radial":
+		return NewFieldFromFunc(res, res, sizeW, sizeH, func(x, y float32) float32 {
+			dx := 2*x/sizeW - 1
+			dy := 2*y/sizeH - 1
+			r := float32(math.Sqrt(float64(dx*dx+dy*dy)) / math.Sqrt2)
+			return l + (h-l)*r
+		}), nil
+	}
+	return LoadFieldImage(parts[0], sizeW, sizeH, l, h)
+}
+
+// At returns the value of the field in the position.
+func (fd *Field) At(x, y float32) float32 {
+	// position in samples, centered on the samples
+	sx := x*float32(fd.W)/fd.SizeW - 0.5
+	sy := y*float32(fd.H)/fd.SizeH - 0.5
+	fx := float32(math.Floor(float64(sx)))
+	fy := float32(math.Floor(float64(sy)))
+	tx, ty := sx-fx, sy-fy
+	i0, j0 := fd.wrap(int(fx), fd.W), fd.wrap(int(fy), fd.H)
+	i1, j1 := fd.wrap(i0+1, fd.W), fd.wrap(j0+1, fd.H)
+
+	v00 := fd.V[j0*fd.W+i0]
+	v10 := fd.V[j0*fd.W+i1]
+	v01 := fd.V[j1*fd.W+i0]
+	v11 := fd.V[j1*fd.W+i1]
+	return (v00*(1-tx)+v10*tx)*(1-ty) + (v01*(1-tx)+v11*tx)*ty
+}
+
+// Normalized returns the value of the field in the position, mapped from [Min, Max] to [0, 1].
+func (fd *Field) Normalized(x, y float32) float32 {
+	if fd.Max == fd.Min {
+		return 0.5
+	}
+	return (fd.At(x, y) - fd.Min) / (fd.Max - fd.Min)
+}
+
+// Wrap an index around the grid.
+func (fd *Field) wrap(i, n int) int {
+	i %= n
+	if i < 0 {
+		i += n
+	}
+	return i
+}
+
+// Compute the range of the sampled values.
+func (fd *Field) updateRange() {
+	fd.Min, fd.Max = fd.V[0], fd.V[0]
+	for _, v := range fd.V {
+		if v < fd.Min {
+			fd.Min = v
+		}
+		if v > fd.Max {
+			fd.Max = v
+		}
+	}
+}
+
+// SetPeriodField sets the field that multiplies the period of the fireflies.
+//
+// The field is rejected if it can make a period shorter than MinPeriod.
+func (w *World) SetPeriodField(fd *Field) error {
+	if fd != nil && float64(w.PeriodMin)*float64(fd.Min) < MinPeriod {
+		return fmt.Errorf("the period field goes down to %v, making periods shorter than %d us", fd.Min, MinPeriod)
+	}
+	w.PeriodField = fd
+	return nil
+}
+
+// SetRadiusField sets the field that modulates the NudgeRadius around each firefly.
+//
+// The blinks are sent to the neighboring cells according to the largest radius in the field.
+func (w *World) SetRadiusField(fd *Field) {
+	w.RadiusField = fd
+	w.SetNudgeRadius(w.NudgeRadius)
+}
+
+// Nudge radius of the firefly, modulated by the RadiusField.
+func (w *World) radiusAt(f *Firefly) float32 {
+	if w.RadiusField == nil {
+		return w.NudgeRadius
+	}
+	return w.NudgeRadius * w.RadiusField.At(f.X, f.Y)
+}
+
+// Period of the firefly, modulated by the PeriodField.
+func (w *World) periodAt(f *Firefly) int {
+	if w.PeriodField == nil {
+		return f.BasePeriod
+	}
+	p := int(float32(f.BasePeriod) * w.PeriodField.At(f.X, f.Y))
+	// the params can change after the field was set
+	if p < MinPeriod {
+		p = MinPeriod
+	}
+	return p
+}
+
+// Speed of the firefly, modulated by the SpeedField.
+func (w *World) speedAt(f *Firefly) float32 {
+	if w.SpeedField == nil {
+		return 1
+	}
+	return w.SpeedField.At(f.X, f.Y)
+}
@@ -0,0 +1,113 @@
+package firefly
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The field is interpolated between the samples, and wraps around.
+func TestFieldAt(t *testing.T) {
+	fd := NewFieldFromFunc(2, 1, 100, 100, func(x, y float32) float32 {
+		if x < 50 {
+			return 1
+		}
+		return 3
+	})
+	assert.InDelta(t, 1, fd.Min, 1e-6)
+	assert.InDelta(t, 3, fd.Max, 1e-6)
+
+	cases := []struct {
+		x, y float32
+		want float32
+	}{
+		{25, 10, 1},
+		{75, 80, 3},
+		{50, 50, 2},
+		{0, 0, 2},
+		{100, 0, 2},
+		{37.5, 0, 1.5},
+	}
+	for _, c := range cases {
+		got := fd.At(c.x, c.y)
+		assert.InDelta(t, c.want, got, 1e-5, fmt.Sprintf("Failed case %+v, got %+v", c, got))
+	}
+	assert.InDelta(t, 0.25, fd.Normalized(37.5, 0), 1e-5)
+}
+
+// The gray levels of an image are mapped to the range.
+func TestFieldFromImage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	img.SetGray(0, 0, color.Gray{0})
+	img.SetGray(1, 0, color.Gray{255})
+	img.SetGray(0, 1, color.Gray{255})
+	img.SetGray(1, 1, color.Gray{0})
+
+	fd := NewFieldFromImage(img, 200, 200, 0.5, 1.5)
+	assert.InDelta(t, 0.5, fd.At(50, 50), 1e-4)
+	assert.InDelta(t, 1.5, fd.At(150, 50), 1e-4)
+	assert.InDelta(t, 1.5, fd.At(50, 150), 1e-4)
+	assert.InDelta(t, 0.5, fd.At(150, 150), 1e-4)
+
+	_, err := LoadFieldSpec("gradx,1", 100, 100)
+	assert.Error(t, err)
+	_, err = LoadFieldSpec("missing.png,0.5,1", 100, 100)
+	assert.Error(t, err)
+	_, err = LoadFieldSpec("gradx,0,1", 100, 100)
+	assert.Error(t, err, "The multipliers must be positive.")
+	_, err = LoadFieldSpec("radial,1,-2", 100, 100)
+	assert.Error(t, err, "The multipliers must be positive.")
+	g, err := LoadFieldSpec("gradx,1,2", 100, 100)
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.5, g.At(50, 50), 0.02)
+}
+
+// The fields modulate period, radius and speed of the fireflies.
+func TestFieldModulation(t *testing.T) {
+	w := NewWorld(4, 4, 100, 1_000_000, 25_000, 50_000, 20, 500_000, 900_000, 1_1000_000)
+	half := NewFieldFromFunc(2, 1, w.SizeW, w.SizeH, func(x, y float32) float32 {
+		if x < w.SizeW/2 {
+			return 0.5
+		}
+		return 2
+	})
+
+	// period at hatch
+	assert.NoError(t, w.SetPeriodField(half))
+	f := NewFirefly(100, 100, 0, 0, 1_000_000, w)
+	assert.Equal(t, 500_000, f.Period)
+	assert.Equal(t, 1_000_000, f.BasePeriod)
+
+	// radius of the receiving firefly, and the border distance follows the max
+	w.SetRadiusField(half)
+	assert.InDelta(t, 20, w.borderDist, 1e-6)
+	g := NewFirefly(100, 115, 0, 1, 1_000_000, w)
+	g.SetNextBlink(w.Clock + 500_000)
+	old := g.NextBlink
+	g.Nudge(f)
+	assert.Equal(t, old, g.NextBlink, "A radius of 10 should not reach 15 away.")
+	h := NewFirefly(300, 100, 0, 2, 1_000_000, w)
+	k := NewFirefly(300, 135, 0, 3, 1_000_000, w)
+	k.SetNextBlink(w.Clock + 500_000)
+	old = k.NextBlink
+	k.Nudge(h)
+	assert.Equal(t, old-w.NudgeAmount, k.NextBlink, "A radius of 40 should reach 35 away.")
+
+	// speed
+	w.SpeedField = half
+	k.O = 0
+	k.Move()
+	assert.InDelta(t, 302, k.X, 1e-3)
+}
+
+// A period field cannot make periods shorter than MinPeriod.
+func TestPeriodFieldMin(t *testing.T) {
+	w := NewWorld(4, 4, 100, 1_000_000, 25_000, 50_000, 20, 500_000, 900_000, 1_100_000)
+	tiny, err := LoadFieldSpec("gradx,0.0001,0.0002", w.SizeW, w.SizeH)
+	assert.NoError(t, err)
+	assert.Error(t, w.SetPeriodField(tiny))
+	assert.Nil(t, w.PeriodField)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Side of the tiles processed in parallel.
+const tileSide = 128
+
+// Call fn on the tiles of a w x h image, in parallel.
+func forTiles(w, h int, fn func(r image.Rectangle)) {
+	tiles := make(chan image.Rectangle)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range tiles {
+				fn(r)
+			}
+		}()
+	}
+	for y := 0; y < h; y += tileSide {
+		for x := 0; x < w; x += tileSide {
+			tiles <- image.Rect(x, y, x+tileSide, y+tileSide).Intersect(image.Rect(0, 0, w, h))
+		}
+	}
+	close(tiles)
+	wg.Wait()
+}
+
+// Glow around the bright pixels, as the halo of the real fireflies in the footage.
+type bloom struct {
+	strength  float64   // Intensity of the glow added to the frame.
+	threshold float64   // Luminance above which the pixels glow, in [0, 1).
+	radii     []float64 // Reach of each blur, in world units.
+}
+
+// Parse the radii of the blurs, separated by ','.
+func parseRadii(s string) ([]float64, error) {
+	radii := []float64{}
+	for _, field := range strings.Split(s, ",") {
+		r, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || r <= 0 || math.IsInf(r, 0) {
+			return nil, fmt.Errorf("invalid bloom radius %q, use positive numbers as 'r,r,...'", field)
+		}
+		radii = append(radii, r)
+	}
+	return radii, nil
+}
+
+// Add the glow to the frame, with scale pixels per world unit.
+//
+// The bright part of the frame is extracted, blurred at each radius and added back:
+// the colors of the glow are the ones of the fireflies, from the palette.
+// The large blurs are done on a downsampled copy, that is cheaper and looks the same.
+func (b *bloom) apply(img *image.RGBA, scale int) {
+	W, H := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// extract the bright pixels, keeping their hue
+	bright := newFloatImage(W, H)
+	th := float32(b.threshold)
+	forTiles(W, H, func(r image.Rectangle) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := img.RGBAAt(x, y)
+				cr, cg, cb := float32(c.R)/255, float32(c.G)/255, float32(c.B)/255
+				lum := 0.2126*cr + 0.7152*cg + 0.0722*cb
+				if lum <= th {
+					continue
+				}
+				k := (lum - th) / (1 - th) / lum
+				p := bright.at(x, y)
+				p[0], p[1], p[2] = cr*k, cg*k, cb*k
+			}
+		}
+	})
+
+	// blur at each radius and sum the glows
+	glow := newFloatImage(W, H)
+	weight := float32(b.strength / float64(len(b.radii)))
+	for _, radius := range b.radii {
+		sigma := radius * float64(scale) / 3
+		// keep the blur in the small image within a few pixels
+		d := int(sigma / 2)
+		if d < 1 {
+			d = 1
+		}
+		small := shrink(bright, d)
+		small = gaussBlur(small, sigma/float64(d))
+		addUpsampled(glow, small, d, weight)
+	}
+
+	// composite the glow on the frame
+	forTiles(W, H, func(r image.Rectangle) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := img.RGBAAt(x, y)
+				g := glow.at(x, y)
+				img.SetRGBA(x, y, color.RGBA{
+					clamp255(float64(c.R) + 255*float64(g[0])),
+					clamp255(float64(c.G) + 255*float64(g[1])),
+					clamp255(float64(c.B) + 255*float64(g[2])),
+					255,
+				})
+			}
+		}
+	})
+}
+
+// Average each block of d x d pixels, the blocks on the border can be smaller.
+func shrink(src *floatImage, d int) *floatImage {
+	if d == 1 {
+		return src
+	}
+	dst := newFloatImage((src.W+d-1)/d, (src.H+d-1)/d)
+	forTiles(dst.W, dst.H, func(r image.Rectangle) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				p := dst.at(x, y)
+				n := 0
+				for sy := y * d; sy < (y+1)*d && sy < src.H; sy++ {
+					for sx := x * d; sx < (x+1)*d && sx < src.W; sx++ {
+						s := src.at(sx, sy)
+						p[0] += s[0]
+						p[1] += s[1]
+						p[2] += s[2]
+						n++
+					}
+				}
+				p[0] /= float32(n)
+				p[1] /= float32(n)
+				p[2] /= float32(n)
+			}
+		}
+	})
+	return dst
+}
+
+// Blur with a Gaussian of the given sigma in pixels, as a horizontal and a vertical pass.
+//
+// The pixels past the borders repeat the last one.
+func gaussBlur(src *floatImage, sigma float64) *floatImage {
+	reach := int(math.Ceil(3 * sigma))
+	kern := make([]float32, 2*reach+1)
+	sum := float32(0)
+	for i := range kern {
+		d := float64(i - reach)
+		kern[i] = float32(math.Exp(-d * d / (2 * sigma * sigma)))
+		sum += kern[i]
+	}
+	for i := range kern {
+		kern[i] /= sum
+	}
+
+	clampI := func(v, hi int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= hi {
+			return hi - 1
+		}
+		return v
+	}
+	pass := func(src *floatImage, dx, dy int) *floatImage {
+		dst := newFloatImage(src.W, src.H)
+		forTiles(src.W, src.H, func(r image.Rectangle) {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					p := dst.at(x, y)
+					for i, k := range kern {
+						o := i - reach
+						s := src.at(clampI(x+o*dx, src.W), clampI(y+o*dy, src.H))
+						p[0] += k * s[0]
+						p[1] += k * s[1]
+						p[2] += k * s[2]
+					}
+				}
+			}
+		})
+		return dst
+	}
+	return pass(pass(src, 1, 0), 0, 1)
+}
+
+// Add weight times the small image, bilinearly scaled up by d, to dst.
+func addUpsampled(dst, small *floatImage, d int, weight float32) {
+	forTiles(dst.W, dst.H, func(r image.Rectangle) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			// position of the pixel center in the small image
+			sy := (float32(y)+0.5)/float32(d) - 0.5
+			y0 := int(math.Floor(float64(sy)))
+			fy := sy - float32(y0)
+			y1 := y0 + 1
+			if y0 < 0 {
+				y0 = 0
+			}
+			if y1 >= small.H {
+				y1 = small.H - 1
+			}
+			for x := r.Min.X; x < r.Max.X; x++ {
+				sx := (float32(x)+0.5)/float32(d) - 0.5
+				x0 := int(math.Floor(float64(sx)))
+				fx := sx - float32(x0)
+				x1 := x0 + 1
+				if x0 < 0 {
+					x0 = 0
+				}
+				if x1 >= small.W {
+					x1 = small.W - 1
+				}
+				p := dst.at(x, y)
+				a, b := small.at(x0, y0), small.at(x1, y0)
+				c, e := small.at(x0, y1), small.at(x1, y1)
+				for ch := 0; ch < 3; ch++ {
+					top := a[ch] + (b[ch]-a[ch])*fx
+					bot := c[ch] + (e[ch]-c[ch])*fx
+					p[ch] += weight * (top + (bot-top)*fy)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A float image of w x h with all the channels of the pixels set by fn.
+func testFloatImage(w, h int, fn func(x, y int) float32) *floatImage {
+	fi := newFloatImage(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := fi.at(x, y)
+			p[0], p[1], p[2] = fn(x, y), fn(x, y), fn(x, y)
+		}
+	}
+	return fi
+}
+
+// Sum of the first channel.
+func lightSum(fi *floatImage) float64 {
+	sum := 0.0
+	for i := 0; i < len(fi.Pix); i += 3 {
+		sum += float64(fi.Pix[i])
+	}
+	return sum
+}
+
+// The blocks are averaged, the ones on the border over the pixels they have.
+func TestShrink(t *testing.T) {
+	src := testFloatImage(5, 3, func(x, y int) float32 { return float32(x + 10*y) })
+	assert.Same(t, src, shrink(src, 1))
+
+	dst := shrink(src, 2)
+	assert.Equal(t, 3, dst.W)
+	assert.Equal(t, 2, dst.H)
+	for _, tc := range []struct {
+		x, y int
+		want float32
+	}{
+		{0, 0, 5.5},  // 0, 1, 10, 11
+		{2, 0, 9},    // 4, 14
+		{1, 1, 22.5}, // 22, 23
+		{2, 1, 24},   // 24
+	} {
+		assert.InDelta(t, tc.want, dst.at(tc.x, tc.y)[0], 1e-5, "%+v", tc)
+		assert.Equal(t, dst.at(tc.x, tc.y)[0], dst.at(tc.x, tc.y)[2])
+	}
+}
+
+// The blur spreads a point symmetrically keeping its light, and keeps a uniform image.
+func TestGaussBlur(t *testing.T) {
+	for _, sigma := range []float64{0.5, 1, 3} {
+		point := testFloatImage(41, 41, func(x, y int) float32 {
+			if x == 20 && y == 20 {
+				return 1
+			}
+			return 0
+		})
+		blur := gaussBlur(point, sigma)
+		assert.InDelta(t, 1, lightSum(blur), 1e-5, "sigma %v", sigma)
+		c := blur.at(20, 20)[0]
+		for _, d := range [][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+			assert.InDelta(t, blur.at(21, 20)[0], blur.at(20+d[0], 20+d[1])[0], 1e-7, "sigma %v", sigma)
+			assert.Less(t, blur.at(20+d[0], 20+d[1])[0], c)
+		}
+
+		// past the borders the last pixel repeats
+		flat := gaussBlur(testFloatImage(9, 7, func(x, y int) float32 { return 0.3 }), sigma)
+		for _, v := range flat.Pix {
+			assert.InDelta(t, 0.3, v, 1e-6)
+		}
+	}
+}
+
+// The small image is scaled up bilinearly and added with its weight.
+func TestAddUpsampled(t *testing.T) {
+	// a uniform image stays uniform
+	dst := testFloatImage(10, 7, func(x, y int) float32 { return 0.1 })
+	addUpsampled(dst, testFloatImage(3, 2, func(x, y int) float32 { return 0.5 }), 4, 0.5)
+	for _, v := range dst.Pix {
+		assert.InDelta(t, 0.35, v, 1e-6)
+	}
+
+	// without scaling the image is copied
+	small := testFloatImage(6, 4, func(x, y int) float32 { return float32(x*y) / 10 })
+	dst = newFloatImage(6, 4)
+	addUpsampled(dst, small, 1, 1)
+	assert.Equal(t, small.Pix, dst.Pix)
+
+	// a ramp is interpolated between the centres of the small pixels
+	ramp := testFloatImage(2, 1, func(x, y int) float32 { return float32(x) })
+	dst = newFloatImage(4, 2)
+	addUpsampled(dst, ramp, 2, 1)
+	for x, want := range []float32{0, 0.25, 0.75, 1} {
+		assert.InDelta(t, want, dst.at(x, 1)[0], 1e-6, "x %d", x)
+	}
+}
+
+// The glow is only around the pixels above the threshold, and keeps their hue.
+func TestBloomApply(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 60, 40))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+		if i%4 != 3 {
+			img.Pix[i] = 40
+		}
+	}
+	dark := image.NewRGBA(img.Bounds())
+	copy(dark.Pix, img.Pix)
+	b := &bloom{strength: 1, threshold: 0.4, radii: []float64{2, 6}}
+	b.apply(dark, 2)
+	assert.Equal(t, img.Pix, dark.Pix)
+
+	img.SetRGBA(30, 20, color.RGBA{255, 255, 0, 255})
+	b.apply(img, 2)
+	near := img.RGBAAt(32, 20)
+	assert.Greater(t, near.R, uint8(40))
+	assert.Equal(t, near.R, near.G)
+	assert.Equal(t, uint8(40), near.B)
+	assert.Equal(t, color.RGBA{40, 40, 40, 255}, img.RGBAAt(0, 0))
+
+	for _, s := range []string{"2,6,16", "0.5"} {
+		_, err := parseRadii(s)
+		assert.NoError(t, err, s)
+	}
+	for _, s := range []string{"", "2,,6", "-1", "0", "inf", "x"} {
+		_, err := parseRadii(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/Pitrified/go-firefly"
+)
+
+// Largest side of the frames, in pixels.
+const maxFrameSide = 16384
+
+// filmConfig holds the parameters of a film, as given on the command line.
+//
+// The JSON keys are the names of the flags, so that a config file fills it directly,
+// and the times are in the units of the flags.
+type filmConfig struct {
+	// world params
+	CellWNum    int  `json:"cw"`
+	CellHNum    int  `json:"ch"`
+	CellSize    int  `json:"cs"`
+	CellDNum    int  `json:"cd"`
+	Bounded     bool `json:"bounded"`
+	NudgeRadius int  `json:"nr"`
+	Fireflies   int  `json:"nf"`
+
+	// simulation params, in ms
+	ClockTick     float64 `json:"tick"`
+	BlinkCooldown float64 `json:"cool"`
+	NudgeAmount   float64 `json:"na"`
+	PeriodMin     float64 `json:"pmin"`
+	PeriodMax     float64 `json:"pmax"`
+	Seed          int64   `json:"seed"`
+
+	// film params
+	FilmDuration   int     `json:"fd"`
+	Fps            int     `json:"fps"`
+	Scale          int     `json:"scale"`
+	Antialias      string  `json:"aa"`
+	Supersample    int     `json:"ss"`
+	Blend          string  `json:"blend"`
+	Tone           string  `json:"tone"`
+	BloomStrength  float64 `json:"bloom"`
+	BloomThreshold float64 `json:"bth"`
+	BloomRadii     string  `json:"brad"`
+	Preset         string  `json:"preset"`
+	Template       string  `json:"tmpl"`
+	Decay          float64 `json:"decay"`
+	LLevels        int     `json:"llev"`
+	DrawCircle     bool    `json:"dc"`
+	CircleIds      string  `json:"dcid"`
+	DrawGrid       bool    `json:"dgrid"`
+	DrawBands      bool    `json:"dband"`
+	DrawCounts     bool    `json:"dcount"`
+	Output         string  `json:"out"`
+	AnimFps        int     `json:"afps"`
+	Loop           int     `json:"loop"`
+	JPEGQuality    int     `json:"jq"`
+	OutputDir      string  `json:"dir"`
+	Overwrite      bool    `json:"overwrite"`
+
+	// lifecycle params, in s
+	EmergeRate  float64 `json:"er"`
+	LifespanMin float64 `json:"lmin"`
+	LifespanMax float64 `json:"lmax"`
+
+	// perception params
+	Perception      string  `json:"perc"`
+	PerceptionScale float64 `json:"ps"`
+	DetectionProb   float64 `json:"det"`
+	Coupling        string  `json:"coup"`
+
+	// pacemakers and timeline of changes
+	Pacemakers string `json:"pace"`
+	Stimuli    string `json:"stim"`
+	Scenario   string `json:"scenario"`
+
+	// parameter fields
+	FieldPeriod     string `json:"fperiod"`
+	FieldRadius     string `json:"fradius"`
+	FieldSpeed      string `json:"fspeed"`
+	FieldContinuous bool   `json:"fcont"`
+	FieldShow       string `json:"fshow"`
+
+	// traces and checkpoints
+	RecordPath      string `json:"record"`
+	ReplayPath      string `json:"replay"`
+	Resume          bool   `json:"resume"`
+	CheckpointEvery int    `json:"cpe"`
+
+	// adaptive cells and graph mode
+	Adaptive  int    `json:"adaptive"`
+	GraphSpec string `json:"graph"`
+
+	configPath string          // JSON file with the parameters.
+	set        map[string]bool // Parameters given on the command line or in the config file.
+}
+
+// Define the flags of the parameters, with their default values.
+func (c *filmConfig) registerFlags(fs *flag.FlagSet) {
+
+	// world params
+	fs.IntVar(&c.CellWNum, "cw", 16, "Width of the world in cells.")
+	fs.IntVar(&c.CellHNum, "ch", 9, "Height of the world in cells.")
+	fs.IntVar(&c.CellSize, "cs", 80, "Size of each cell.")
+	fs.IntVar(&c.CellDNum, "cd", 0, "Depth of the world in cells, 0 for a flat world.")
+	fs.BoolVar(&c.Bounded, "bounded", false, "Bounce the fireflies off the walls instead of wrapping around.")
+	fs.IntVar(&c.NudgeRadius, "nr", 22, "Max distance between interacting fireflies.")
+	fs.IntVar(&c.Fireflies, "nf", 1000, "Number of fireflies to simulate.")
+
+	// simulation params
+	fs.Float64Var(&c.ClockTick, "tick", 25, "Simulated time of each step, in ms.")
+	fs.Float64Var(&c.BlinkCooldown, "cool", 500, "Cooldown after a blink while the firefly cannot be nudged, in ms.")
+	fs.Float64Var(&c.NudgeAmount, "na", 20, "How much to nudge the deadlines, in ms.")
+	fs.Float64Var(&c.PeriodMin, "pmin", 900, "Minimum period of the fireflies, in ms.")
+	fs.Float64Var(&c.PeriodMax, "pmax", 1100, "Maximum period of the fireflies, in ms.")
+	fs.Int64Var(&c.Seed, "seed", 0, "Seed of the random source, random if 0.")
+
+	// film params
+	fs.IntVar(&c.FilmDuration, "fd", 10, "Lenght of the output in seconds.")
+	fs.IntVar(&c.Fps, "fps", 25, "Frames per second of the film, each one a step of the simulation.")
+	fs.IntVar(&c.Scale, "scale", 1, "Pixels per unit of the world.")
+	fs.StringVar(&c.Antialias, "aa", "none", "Anti-aliasing of the fireflies between the pixels: none, bilinear or gauss.")
+	fs.IntVar(&c.Supersample, "ss", 1, "Supersampling factor, the frames are drawn this many times larger and averaged.")
+	fs.StringVar(&c.Blend, "blend", "add", "Blending of the overlapping fireflies: add, screen or src to draw them on top of each other.")
+	fs.StringVar(&c.Tone, "tone", "soft", "Tone mapping of the light: soft, reinhard or clamp.")
+	fs.Float64Var(&c.BloomStrength, "bloom", 0, "Intensity of the glow around the bright fireflies, 0 to disable it.")
+	fs.Float64Var(&c.BloomThreshold, "bth", 0.4, "Luminance above which the pixels glow, in [0, 1).")
+	fs.StringVar(&c.BloomRadii, "brad", "2,6,16", "Reach of the glow in world units, as 'r,r,...' for the blurs summed.")
+	fs.StringVar(&c.Preset, "preset", "", "Resolution of the frames, as 4k, 1080p, 720p, ... or WxH: sets the size of the world and the scale, keeping the density of the fireflies.")
+	fs.StringVar(&c.Template, "tmpl", "F5", "Template of the fireflies: F3, F5 or L5.")
+	fs.Float64Var(&c.Decay, "decay", 600, "Time constant of the brightness decay after a blink, in ms.")
+	fs.IntVar(&c.LLevels, "llev", 100, "Lightness levels of the template.")
+	fs.BoolVar(&c.DrawCircle, "dc", false, "Draw a circle to show the nudge radius value.")
+	fs.StringVar(&c.CircleIds, "dcid", "", "Ids of the fireflies to draw the circle around, as 'id,id,...', all of them if empty.")
+	fs.BoolVar(&c.DrawGrid, "dgrid", false, "Draw the borders of the cells.")
+	fs.BoolVar(&c.DrawBands, "dband", false, "Shade the bands along the cell borders where the blinks are sent to the neighbors.")
+	fs.BoolVar(&c.DrawCounts, "dcount", false, "Write the number of fireflies in each cell.")
+	fs.StringVar(&c.Output, "out", "png", "Output format: png frames, an animated gif or apng, a y4m stream on stdout or an avi video.")
+	fs.IntVar(&c.AnimFps, "afps", 25, "Frames per second of the animated and video outputs.")
+	fs.IntVar(&c.Loop, "loop", 0, "Times to play the animated outputs, 0 to loop forever.")
+	fs.IntVar(&c.JPEGQuality, "jq", 90, "Quality of the JPEG frames of the avi video, 1 to 100.")
+	fs.StringVar(&c.OutputDir, "dir", "", "Output folder, a new one named after the start time if empty.")
+	fs.BoolVar(&c.Overwrite, "overwrite", false, "Replace the output folder if it exists.")
+
+	// lifecycle params
+	fs.Float64Var(&c.EmergeRate, "er", 0, "Fireflies emerging per simulated second.")
+	fs.Float64Var(&c.LifespanMin, "lmin", 0, "Minimum lifespan of a firefly in seconds, 0 for immortal fireflies.")
+	fs.Float64Var(&c.LifespanMax, "lmax", 0, "Maximum lifespan of a firefly in seconds.")
+
+	// perception params
+	fs.StringVar(&c.Perception, "perc", "step", "Perception model: step, linear, invsq or gauss.")
+	fs.Float64Var(&c.PerceptionScale, "ps", 0, "Distance scale of the perception falloff, half the nudge radius if 0.")
+	fs.Float64Var(&c.DetectionProb, "det", 1, "Probability that a firefly sees each flash.")
+	fs.StringVar(&c.Coupling, "coup", "exc", "Coupling mode: exc, inh or reset.")
+
+	// pacemakers
+	fs.StringVar(&c.Pacemakers, "pace", "", "Pacemakers with a fixed period, as 'x,y,period_s;...'.")
+	fs.StringVar(&c.Stimuli, "stim", "", "Scripted stimuli, as 'x,y,t1_s,t2_s,...;...'.")
+
+	// timeline of changes
+	fs.StringVar(&c.Scenario, "scenario", "", "JSON scenario to apply during the film.")
+
+	// parameter fields
+	fs.StringVar(&c.FieldPeriod, "fperiod", "", "Field multiplying the period, as 'image.png|gradx|grady|radial,lo,hi'.")
+	fs.StringVar(&c.FieldRadius, "fradius", "", "Field multiplying the nudge radius, as 'image.png|gradx|grady|radial,lo,hi'.")
+	fs.StringVar(&c.FieldSpeed, "fspeed", "", "Field multiplying the speed, as 'image.png|gradx|grady|radial,lo,hi'.")
+	fs.BoolVar(&c.FieldContinuous, "fcont", false, "Apply the period field at every step, not only when hatching.")
+	fs.StringVar(&c.FieldShow, "fshow", "", "Show a field as overlay: period, radius or speed.")
+
+	// traces
+	fs.StringVar(&c.RecordPath, "record", "", "Record the trace of the simulation in this file.")
+	fs.StringVar(&c.ReplayPath, "replay", "", "Render a recorded trace instead of simulating.")
+
+	// checkpoints
+	fs.BoolVar(&c.Resume, "resume", false, "Resume from the checkpoint, keeping the frames already rendered.")
+	fs.IntVar(&c.CheckpointEvery, "cpe", 250, "Save a checkpoint every this many frames, 0 to disable.")
+
+	// adaptive cells
+	fs.IntVar(&c.Adaptive, "adaptive", 0, "Split the cells with more than this many fireflies, 0 for the fixed grid.")
+
+	// graph mode
+	fs.StringVar(&c.GraphSpec, "graph", "", "Interaction graph instead of the swarm, as an edge list file or 'ring,n,k', 'smallworld,n,k,p', 'scalefree,n,m'.")
+
+	// config file
+	fs.StringVar(&c.configPath, "config", "", "JSON file with the values of the flags, as {\"nf\": 2000, \"tmpl\": \"F3\"}: the flags on the command line take precedence.")
+}
+
+// Parse the command line, then the config file if one is given.
+func (c *filmConfig) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c.set = map[string]bool{}
+	fs.Visit(func(fl *flag.Flag) { c.set[fl.Name] = true })
+	if c.configPath == "" {
+		return nil
+	}
+	return c.load(c.configPath, fs)
+}
+
+// Load the parameters from a JSON object with the names of the flags as keys, as {"nf": 2000, "tmpl": "F3"}.
+//
+// The flags already set on the command line of fs take precedence over the file.
+// The Flags saved in run.json can be used as config, to film again with the same parameters.
+func (c *filmConfig) load(path string, fs *flag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// the flags on the command line are set again after the file
+	cmdline := map[string]string{}
+	fs.Visit(func(fl *flag.Flag) { cmdline[fl.Name] = fl.Value.String() })
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	keys := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	for name := range keys {
+		c.set[name] = true
+	}
+
+	for name, v := range cmdline {
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("flag %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Check that the parameters make a film that can be rendered.
+func (f *Filmer) validate() error {
+	if err := checkLight(f.blend, f.tone); err != nil {
+		return err
+	}
+	switch {
+	case templateByName(f.whichTemplate) == nil:
+		return fmt.Errorf("unknown template %q, use F3, F5 or L5", f.whichTemplate)
+	case f.cw < 1 || f.ch < 1 || f.cd < 0 || f.cellSize < 1:
+		return fmt.Errorf("invalid world of %dx%dx%d cells of %d px", f.cw, f.ch, f.cd, f.cellSize)
+	case f.scale < 1:
+		return fmt.Errorf("the scale must be at least 1, got %d", f.scale)
+	case f.cw*f.cellSize > maxFrameSide/f.scale || f.ch*f.cellSize > maxFrameSide/f.scale:
+		return fmt.Errorf("a world of %dx%d px at scale %d does not fit in a frame of at most %d px",
+			f.cw*f.cellSize, f.ch*f.cellSize, f.scale, maxFrameSide)
+	case f.fps < 1 || f.filmDuration < 0:
+		return fmt.Errorf("invalid duration of %d s at %d fps", f.filmDuration, f.fps)
+	case f.supersample < 1 || f.supersample > 8:
+		return fmt.Errorf("the supersampling must be in [1, 8], got %d", f.supersample)
+	case f.bloom != nil && (f.bloom.strength < 0 || f.bloom.threshold < 0 || f.bloom.threshold >= 1):
+		return fmt.Errorf("the bloom needs a positive intensity and a threshold in [0, 1)")
+	case f.lLevels < 1 || f.lLevels > 1000:
+		return fmt.Errorf("the lightness levels must be in [1, 1000], got %d", f.lLevels)
+	case f.decay <= 0 || math.IsInf(f.decay, 0) || math.IsNaN(f.decay):
+		return fmt.Errorf("the brightness decay must have a positive time constant")
+	case f.clockTickLen < 1:
+		return fmt.Errorf("the tick must be positive, got %d us", f.clockTickLen)
+	case f.blinkCooldown < 0 || f.nudgeAmount < 0 || f.nudgeRadius < 0 || f.nF < 0:
+		return fmt.Errorf("the cooldown, nudge amount, nudge radius and fireflies cannot be negative")
+	case f.periodMin < firefly.MinPeriod || f.periodMax < f.periodMin:
+		return fmt.Errorf("invalid period range [%d, %d] us, the shortest period is %d us", f.periodMin, f.periodMax, firefly.MinPeriod)
+	case f.graphSpec != "" && len(f.pacemakers) > 0:
+		return fmt.Errorf("the pacemakers need the swarm, not a graph")
+	}
+	return nil
+}
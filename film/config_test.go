@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Parse the command line, with a config file holding data if not empty.
+func parseConfig(t *testing.T, data string, args ...string) (*filmConfig, error) {
+	c := &filmConfig{}
+	fs := flag.NewFlagSet("film", flag.ContinueOnError)
+	c.registerFlags(fs)
+	if data != "" {
+		path := filepath.Join(t.TempDir(), "film.json")
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+		args = append(args, "-config", path)
+	}
+	return c, c.parse(fs, args)
+}
+
+// The config file fills the parameters, the command line takes precedence.
+func TestFilmConfigLoad(t *testing.T) {
+	c, err := parseConfig(t, `{"nf": 2000, "tmpl": "F3", "scale": 2, "pmin": 800.5, "dc": true}`, "-nf", "50")
+	assert.NoError(t, err)
+	assert.Equal(t, 50, c.Fireflies)
+	assert.Equal(t, "F3", c.Template)
+	assert.Equal(t, 2, c.Scale)
+	assert.Equal(t, 800.5, c.PeriodMin)
+	assert.True(t, c.DrawCircle)
+	// the defaults are kept
+	assert.Equal(t, 16, c.CellWNum)
+	assert.Equal(t, "none", c.Antialias)
+	assert.Equal(t, map[string]bool{"nf": true, "tmpl": true, "scale": true, "pmin": true, "dc": true, "config": true}, c.set)
+
+	for _, data := range []string{
+		`{"nope": 1}`,
+		`{"config": "other.json"}`,
+		`{"nf": "many"}`,
+		`[1, 2]`,
+	} {
+		_, err := parseConfig(t, data)
+		assert.Error(t, err, data)
+	}
+}
+
+// The Flags saved in run.json make the same config.
+func TestFilmConfigRun(t *testing.T) {
+	c, err := parseConfig(t, "", "-nf", "300", "-preset", "720p", "-blend", "screen")
+	assert.NoError(t, err)
+	run, err := json.Marshal(runInfo{Flags: *c})
+	assert.NoError(t, err)
+	saved := struct{ Flags json.RawMessage }{}
+	assert.NoError(t, json.Unmarshal(run, &saved))
+
+	again, err := parseConfig(t, string(saved.Flags))
+	assert.NoError(t, err)
+	again.set, again.configPath, c.set = nil, "", nil
+	assert.Equal(t, c, again)
+}
+
+// The filmer takes the parameters in the units of the world, and checks them.
+func TestNewFilmer(t *testing.T) {
+	c, err := parseConfig(t, "", "-tick", "20", "-pmin", "1.5", "-pmax", "3", "-pace", "10,10,1")
+	assert.NoError(t, err)
+	f, err := NewFilmer(*c)
+	assert.NoError(t, err)
+	assert.Equal(t, 20_000, f.clockTickLen)
+	assert.Equal(t, 1500, f.periodMin)
+	assert.Len(t, f.pacemakers, 1)
+	assert.NoError(t, f.validate())
+
+	for _, args := range [][]string{
+		{"-perc", "nope"},
+		{"-aa", "nope"},
+		{"-dcid", "a,b"},
+		{"-bloom", "1", "-brad", "-2"},
+	} {
+		c, err := parseConfig(t, "", args...)
+		assert.NoError(t, err)
+		_, err = NewFilmer(*c)
+		assert.Error(t, err, "%v", args)
+	}
+
+	for _, args := range [][]string{
+		{"-pmin", "0.999", "-pmax", "0.999"},
+		{"-pmin", "900", "-pmax", "800"},
+		{"-tmpl", "X9"},
+		{"-ss", "9"},
+		{"-graph", "ring,10,2", "-pace", "10,10,1"},
+	} {
+		c, err := parseConfig(t, "", args...)
+		assert.NoError(t, err)
+		f, err := NewFilmer(*c)
+		assert.NoError(t, err)
+		assert.Error(t, f.validate(), "%v", args)
+	}
+}
@@ -5,5 +5,6 @@ go 1.16
 require (
 	github.com/Pitrified/go-firefly v0.0.0-20220326204615-a1458e10a657
 	github.com/lucasb-eyer/go-colorful v1.2.0
+	github.com/stretchr/testify v1.7.0
 	golang.org/x/image v0.0.0-20220321031419-a8550c1d254a
 )
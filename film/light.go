@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// Blending of the overlapping fireflies.
+const (
+	blendSrc    = "src"
+	blendAdd    = "add"
+	blendScreen = "screen"
+)
+
+// Tone mapping of the light to the colors of the frame.
+const (
+	toneClamp    = "clamp"
+	toneSoft     = "soft"
+	toneReinhard = "reinhard"
+)
+
+// Luminance below which the soft tone mapping keeps the colors.
+const toneKnee = 0.8
+
+// Check the names of the blending and of the tone mapping.
+func checkLight(blend, tone string) error {
+	switch blend {
+	case blendSrc, blendAdd, blendScreen:
+	default:
+		return fmt.Errorf("unknown blending %q, use add, screen or src", blend)
+	}
+	switch tone {
+	case toneClamp, toneSoft, toneReinhard:
+	default:
+		return fmt.Errorf("unknown tone mapping %q, use soft, reinhard or clamp", tone)
+	}
+	return nil
+}
+
+// Image with float channels, to add the light without clamping.
+type floatImage struct {
+	W, H int
+	Pix  []float32 // RGB of the pixels row by row, 1 is full intensity.
+}
+
+func newFloatImage(w, h int) *floatImage {
+	return &floatImage{W: w, H: h, Pix: make([]float32, w*h*3)}
+}
+
+// Channels of the pixel at x, y.
+func (fi *floatImage) at(x, y int) []float32 {
+	i := (y*fi.W + x) * 3
+	return fi.Pix[i : i+3 : i+3]
+}
+
+// Light accumulated on the pixels of a rectangle of the frame.
+//
+// Each tile is owned by a single goroutine, so that the writes never race.
+type lightTile struct {
+	r     image.Rectangle // Pixels of the frame in the tile.
+	light *floatImage     // Light of the pixels, starting from the background.
+	back  [3]float32      // Color of the background, that the sprites lighten.
+	blend string          // How the sprites are combined with the light.
+}
+
+// Start a tile from the pixels of m in r.
+func newLightTile(m *image.RGBA, r image.Rectangle, back colorful.Color, blend string) *lightTile {
+	t := &lightTile{r: r, light: newFloatImage(r.Dx(), r.Dy()), blend: blend}
+	br, bg, bb := back.Clamped().RGB255()
+	t.back = [3]float32{float32(br) / 255, float32(bg) / 255, float32(bb) / 255}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := m.RGBAAt(x, y)
+			p := t.light.at(x-r.Min.X, y-r.Min.Y)
+			p[0], p[1], p[2] = float32(c.R)/255, float32(c.G)/255, float32(c.B)/255
+		}
+	}
+	return t
+}
+
+// Add a pixel of a sprite at p, as the color premultiplied by the coverage in [0, 255] and the coverage.
+//
+// With add and screen the light of the sprite is its difference from the background:
+// a single firefly looks the same with any blending, the overlapping ones get brighter.
+// The pixels out of the tile are drawn by the tile they belong to.
+func (t *lightTile) add(p image.Point, acc [4]float64) {
+	cov := float32(acc[3])
+	if cov <= 0 || !p.In(t.r) {
+		return
+	}
+	d := t.light.at(p.X-t.r.Min.X, p.Y-t.r.Min.Y)
+	for ch := 0; ch < 3; ch++ {
+		s := float32(acc[ch]) / 255
+		switch t.blend {
+		case blendSrc:
+			d[ch] = s + float32(math.Max(0, float64(1-cov)))*d[ch]
+		case blendAdd:
+			d[ch] += s - cov*t.back[ch]
+		case blendScreen:
+			d[ch] = 1 - (1-d[ch])*(1-cov*t.screenLight(ch, s/cov))
+		}
+	}
+}
+
+// Light that screened on the background gives the color c of a sprite, in [0, 1].
+//
+// The screen only lightens: the sprites darker than the background leave it unchanged,
+// and nothing is added to a white background.
+func (t *lightTile) screenLight(ch int, c float32) float32 {
+	if t.back[ch] >= 1 || c <= t.back[ch] {
+		return 0
+	}
+	if c >= 1 {
+		return 1
+	}
+	return 1 - (1-c)/(1-t.back[ch])
+}
+
+// Tone map the light and write it on m.
+func (t *lightTile) resolve(m *image.RGBA, tone string) {
+	for y := t.r.Min.Y; y < t.r.Max.Y; y++ {
+		for x := t.r.Min.X; x < t.r.Max.X; x++ {
+			p := t.light.at(x-t.r.Min.X, y-t.r.Min.Y)
+			k := toneScale(tone, 0.2126*p[0]+0.7152*p[1]+0.0722*p[2])
+			m.SetRGBA(x, y, color.RGBA{
+				clamp255(float64(p[0]*k) * 255),
+				clamp255(float64(p[1]*k) * 255),
+				clamp255(float64(p[2]*k) * 255),
+				255,
+			})
+		}
+	}
+}
+
+// Factor of the channels that maps the luminance lum in the range of the frame.
+//
+// Scaling the luminance keeps the hue of the light from the palette.
+func toneScale(tone string, lum float32) float32 {
+	if lum <= 0 {
+		return 1
+	}
+	switch tone {
+	case toneSoft:
+		// unchanged up to the knee, then approaching 1 smoothly
+		if lum <= toneKnee {
+			return 1
+		}
+		over := float64(lum-toneKnee) / (1 - toneKnee)
+		return float32(toneKnee+(1-toneKnee)*(1-math.Exp(-over))) / lum
+	case toneReinhard:
+		return 1 / (1 + lum)
+	}
+	return 1
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/stretchr/testify/assert"
+)
+
+// A tile of 4x4 pixels filled with the background.
+func testTile(back color.RGBA, blend string) *lightTile {
+	m := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(m, m.Bounds(), image.NewUniform(back), image.Point{}, draw.Src)
+	return newLightTile(m, m.Bounds(), colorful.Color{R: float64(back.R) / 255, G: float64(back.G) / 255, B: float64(back.B) / 255}, blend)
+}
+
+// A pixel of a sprite of color c, premultiplied by the coverage.
+func sprite(c color.RGBA, cov float64) [4]float64 {
+	return [4]float64{cov * float64(c.R), cov * float64(c.G), cov * float64(c.B), cov}
+}
+
+// A single sprite looks the same with any blending, the overlapping ones get brighter with add and screen.
+func TestLightBlend(t *testing.T) {
+	back := color.RGBA{20, 30, 40, 255}
+	fly := color.RGBA{200, 220, 60, 255}
+	for _, blend := range []string{blendSrc, blendAdd, blendScreen} {
+		lt := testTile(back, blend)
+		lt.add(image.Pt(1, 1), sprite(fly, 1))
+		lt.add(image.Pt(2, 2), sprite(fly, 1))
+		lt.add(image.Pt(2, 2), sprite(fly, 1))
+		// out of the tile
+		lt.add(image.Pt(9, 9), sprite(fly, 1))
+
+		m := image.NewRGBA(lt.r)
+		lt.resolve(m, toneClamp)
+		assert.Equal(t, back, m.RGBAAt(0, 0), blend)
+		assert.Equal(t, fly, m.RGBAAt(1, 1), blend)
+		twice := m.RGBAAt(2, 2)
+		if blend == blendSrc {
+			assert.Equal(t, fly, twice, blend)
+			continue
+		}
+		assert.Greater(t, twice.R, fly.R, blend)
+		assert.Greater(t, twice.B, fly.B, blend)
+	}
+}
+
+// The screen stays finite and in [0, 1] on any background, and never darkens it.
+func TestLightScreen(t *testing.T) {
+	for _, back := range []color.RGBA{
+		{0, 0, 0, 255},
+		{255, 255, 255, 255},
+		{254, 255, 0, 255},
+		{128, 128, 128, 255},
+	} {
+		for _, fly := range []color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}, {200, 100, 30, 255}} {
+			for _, cov := range []float64{1, 0.5, 1e-6, 1e-30, 1e-45} {
+				lt := testTile(back, blendScreen)
+				for i := 0; i < 3; i++ {
+					lt.add(image.Pt(1, 1), sprite(fly, cov))
+				}
+				p := lt.light.at(1, 1)
+				for ch, v := range p {
+					assert.False(t, math.IsNaN(float64(v)) || math.IsInf(float64(v), 0), "%v %v %v", back, fly, cov)
+					assert.LessOrEqual(t, v, float32(1), "%v %v %v", back, fly, cov)
+					assert.GreaterOrEqual(t, v, lt.back[ch], "%v %v %v", back, fly, cov)
+				}
+			}
+		}
+	}
+}
+
+// The tone mapping keeps the dark colors and brings the bright ones in range.
+func TestToneScale(t *testing.T) {
+	for _, tone := range []string{toneClamp, toneSoft, toneReinhard} {
+		assert.Equal(t, float32(1), toneScale(tone, 0), tone)
+		assert.Equal(t, float32(1), toneScale(tone, -1), tone)
+		prev := float32(0)
+		for _, lum := range []float32{0.1, 0.5, 0.8, 0.9, 1, 2, 10, 1000} {
+			k := toneScale(tone, lum)
+			assert.Greater(t, k, float32(0), "%s at %v", tone, lum)
+			// the luminance mapped never decreases
+			assert.GreaterOrEqual(t, k*lum, prev, "%s at %v", tone, lum)
+			prev = k * lum
+			switch tone {
+			case toneClamp:
+				assert.Equal(t, float32(1), k)
+			case toneSoft:
+				if lum <= toneKnee {
+					assert.Equal(t, float32(1), k)
+				}
+				assert.Less(t, k*lum, float32(1)+1e-6)
+			case toneReinhard:
+				assert.InDelta(t, lum/(1+lum), k*lum, 1e-6)
+			}
+		}
+	}
+	// the soft tone mapping is continuous at the knee
+	assert.InDelta(t, toneKnee, toneScale(toneSoft, toneKnee+1e-4)*(toneKnee+1e-4), 1e-3)
+
+	assert.NoError(t, checkLight(blendScreen, toneSoft))
+	assert.Error(t, checkLight("multiply", toneSoft))
+	assert.Error(t, checkLight(blendAdd, "filmic"))
+}
@@ -4,10 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Pitrified/go-firefly"
 	"github.com/lucasb-eyer/go-colorful"
@@ -17,19 +21,57 @@ type Filmer struct {
 
 	// input
 	cellSize, cw, ch int
+	cd               int
+	bounded          bool
 	nudgeRadius      int
 	nF               int
 	filmDuration     int
-	drawCircle       bool
+	overlay          overlay
+	emergeRate       float64
+	lifespanMin      int
+	lifespanMax      int
+	perception       firefly.Perception
+	perceptionScale  float64
+	detectionProb    float64
+	coupling         firefly.Coupling
+	pacemakers       []pacemakerSpec
+	scenario         *firefly.Scenario
+	fieldSpecs       map[string]string
+	fieldContinuous  bool
+	fieldShow        string
+	recordPath       string
+	replayPath       string
+	resume           bool
+	checkpointEvery  int
+	checkpoint       *firefly.Checkpoint
+	graphSpec        string
+	adaptive         int
+	output           string
+	animFps          int
+	loop             int
+	jpegQuality      int
+	outputDir        string
+	overwrite        bool
+	seed             int64
+	config           filmConfig
 
 	// utils
 	blitTemplate  *image.RGBA
+	farTemplate   *image.RGBA
+	fieldOverlay  *image.RGBA
 	backCol       colorful.Color
 	w             *firefly.World
 	fps           int
 	scale         int
+	antialias     *kernel
+	supersample   int
+	bloom         *bloom
+	blend         string
+	tone          string
 	frameSize     image.Rectangle
 	outputFolder  string
+	out           frameWriter
+	run           runInfo
 	renderWG      sync.WaitGroup
 	decay         float64
 	lLevels       int
@@ -45,61 +87,172 @@ type Filmer struct {
 	periodMax     int
 }
 
-func NewFilmer(
-	cellSize, cw, ch,
-	nudgeRadius,
-	nF,
-	filmDuration int,
-	drawCircle bool,
-) *Filmer {
+// NewFilmer creates a Filmer with the parameters of the config.
+func NewFilmer(c filmConfig) (*Filmer, error) {
 
 	f := &Filmer{}
 
-	f.cellSize = cellSize
-	f.cw = cw
-	f.ch = ch
-	f.nudgeRadius = nudgeRadius
-	f.nF = nF
-	f.filmDuration = filmDuration
-	f.drawCircle = drawCircle
+	perception, err := firefly.ParsePerception(c.Perception)
+	if err != nil {
+		return nil, err
+	}
+	coupling, err := firefly.ParseCoupling(c.Coupling)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := parseIds(c.CircleIds)
+	if err != nil {
+		return nil, err
+	}
+	f.antialias, err = kernelByName(c.Antialias)
+	if err != nil {
+		return nil, err
+	}
+	if c.BloomStrength != 0 {
+		radii, err := parseRadii(c.BloomRadii)
+		if err != nil {
+			return nil, err
+		}
+		f.bloom = &bloom{strength: c.BloomStrength, threshold: c.BloomThreshold, radii: radii}
+	}
+	pacemakers, err := parsePacemakers(c.Pacemakers, false)
+	if err != nil {
+		return nil, err
+	}
+	stimuli, err := parsePacemakers(c.Stimuli, true)
+	if err != nil {
+		return nil, err
+	}
+	if c.Scenario != "" {
+		f.scenario, err = firefly.LoadScenario(c.Scenario)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return f
+	f.cellSize = c.CellSize
+	f.cw = c.CellWNum
+	f.ch = c.CellHNum
+	f.cd = c.CellDNum
+	f.bounded = c.Bounded
+	f.nudgeRadius = c.NudgeRadius
+	f.nF = c.Fireflies
+	f.filmDuration = c.FilmDuration
+	f.overlay = overlay{
+		radius: c.DrawCircle,
+		ids:    ids,
+		grid:   c.DrawGrid,
+		bands:  c.DrawBands,
+		counts: c.DrawCounts,
+	}
+	f.emergeRate = c.EmergeRate
+	f.lifespanMin = int(c.LifespanMin * 1_000_000)
+	f.lifespanMax = int(c.LifespanMax * 1_000_000)
+	f.perception = perception
+	f.perceptionScale = c.PerceptionScale
+	f.detectionProb = c.DetectionProb
+	f.coupling = coupling
+	f.pacemakers = append(pacemakers, stimuli...)
+	f.fieldSpecs = map[string]string{
+		"period": c.FieldPeriod,
+		"radius": c.FieldRadius,
+		"speed":  c.FieldSpeed,
+	}
+	f.fieldContinuous = c.FieldContinuous
+	f.fieldShow = c.FieldShow
+	f.recordPath = c.RecordPath
+	f.replayPath = c.ReplayPath
+	f.resume = c.Resume
+	f.checkpointEvery = c.CheckpointEvery
+	f.graphSpec = c.GraphSpec
+	f.adaptive = c.Adaptive
+	f.output = c.Output
+	f.animFps = c.AnimFps
+	f.loop = c.Loop
+	f.jpegQuality = c.JPEGQuality
+	f.outputDir = c.OutputDir
+	f.overwrite = c.Overwrite
+	f.seed = c.Seed
+	f.config = c
+	f.whichTemplate = c.Template
+	f.fps = c.Fps
+	f.scale = c.Scale
+	f.decay = 1.0 / (c.Decay * 1000)
+	f.lLevels = c.LLevels
+	f.clockTickLen = int(c.ClockTick * 1000)
+	f.blinkCooldown = int(c.BlinkCooldown * 1000)
+	f.nudgeAmount = int(c.NudgeAmount * 1000)
+	f.periodMin = int(c.PeriodMin * 1000)
+	f.periodMax = int(c.PeriodMax * 1000)
+	f.supersample = c.Supersample
+	f.blend = c.Blend
+	f.tone = c.Tone
+
+	return f, nil
 }
 
 func (f *Filmer) film() {
 
-	// various simulation params
-	f.clockTickLen = 25_000
-	f.blinkCooldown = 500_000
-	f.nudgeAmount = 20_000
-	f.periodMin = 900_000
-	f.periodMax = 1_100_000
+	// a replayed trace sets the size of the world
+	var trace *firefly.TraceReader
+	if f.replayPath != "" {
+		traceFile, err := os.Open(f.replayPath)
+		check(err)
+		defer traceFile.Close()
+		trace, err = firefly.NewTraceReader(traceFile)
+		check(err)
+		c := trace.Header.Config
+		f.cw, f.ch, f.cd = c.CellWNum, c.CellHNum, c.CellDNum
+		f.cellSize = int(c.CellSize)
+		f.nudgeRadius = int(c.NudgeRadius)
+		f.clockTickLen = c.ClockTickLen
+	}
 
-	// f.whichTemplate = "F3"
-	f.whichTemplate = "F5"
-	// f.whichTemplate = "L5"
+	// path, a new folder named after the start time if not requested
+	f.outputFolder = f.outputDir
+	if f.outputFolder == "" {
+		f.outputFolder = uniqueFolder(time.Now())
+	}
+	fmt.Printf("outputFolder = %+v\n", f.outputFolder)
 
-	// rand.Seed(time.Now().UnixNano())
-	f.decay = 1.0 / 600_000.0
+	// when resuming, the checkpoint sets the size of the world
+	if f.resume && trace == nil {
+		cp, err := firefly.LoadCheckpoint(f.checkpointPath())
+		if os.IsNotExist(err) {
+			fmt.Println("no checkpoint found, starting from scratch")
+		} else {
+			check(err)
+			if f.recordPath != "" {
+				check(fmt.Errorf("cannot record the trace of a resumed film"))
+			}
+			f.checkpoint = cp
+			c := cp.Config
+			f.cw, f.ch, f.cd = c.CellWNum, c.CellHNum, c.CellDNum
+			f.cellSize = int(c.CellSize)
+			f.nudgeRadius = int(c.NudgeRadius)
+			f.clockTickLen = c.ClockTickLen
+		}
+	}
 
-	// film parameters
-	f.fps = 25
-	// TODO this might also be linked to which template you are using
-	f.scale = 1
+	// the trace or the checkpoint might have changed the world
+	check(f.validate())
+	// TODO the scale might also be linked to which template you are using
 	f.frameSize = image.Rect(0, 0, f.cw*f.cellSize*f.scale, f.ch*f.cellSize*f.scale)
 
-	// path
-	// outputFolder := fmt.Sprintf("film_%v", time.Now().Unix())
-	f.outputFolder = fmt.Sprintf("film_%v", 2)
-	fmt.Printf("outputFolder = %+v\n", f.outputFolder)
-	err := os.RemoveAll(f.outputFolder)
-	check(err)
-	err = os.Mkdir(f.outputFolder, 0755)
+	// keep the frames already rendered when resuming
+	if f.resume && f.output != outputPNG {
+		check(fmt.Errorf("only the png frames can be resumed, not the %s output", f.output))
+	}
+	if _, err := os.Stat(f.outputFolder); err == nil && !f.resume {
+		if !f.overwrite {
+			check(fmt.Errorf("the output folder %q exists, use -overwrite to replace it", f.outputFolder))
+		}
+		check(os.RemoveAll(f.outputFolder))
+	}
+	err := os.MkdirAll(f.outputFolder, 0755)
 	check(err)
 
-	// number of lightness levels (-1 as it is inclusive)
-	f.lLevels = 100
-	// setup the blit map
+	// setup the blit map, with lLevels+1 lightness levels as it is inclusive
 	f.blitTemplate = genBlitMap(f.lLevels, f.whichTemplate)
 	// TODO this is dependent on which template you are using
 	switch f.whichTemplate {
@@ -113,144 +266,448 @@ func (f *Filmer) film() {
 		f.templateSize = 5
 		f.rotNum = 2
 	}
+	// in a 3D world the fireflies in the back half are drawn with the small template
+	if f.cd > 0 {
+		f.farTemplate = genBlitMap(f.lLevels, "F3")
+	}
+	// the supersampled frames use larger templates, averaged back at the end
+	if f.supersample > 1 {
+		f.blitTemplate = UpscaleImg(f.blitTemplate, f.supersample)
+		if f.farTemplate != nil {
+			f.farTemplate = UpscaleImg(f.farTemplate, f.supersample)
+		}
+	}
 
 	// background color
 	f.backCol = elemColor['a'].GetBlent(1)
 
-	// start world
-	f.w = firefly.NewWorld(
-		f.cw, f.ch, float32(f.cellSize),
-		1_000_000, f.clockTickLen,
-		f.nudgeAmount, float32(f.nudgeRadius),
-		f.blinkCooldown,
-		f.periodMin, f.periodMax,
-	)
-	f.w.HatchFireflies(f.nF)
-	// firefly.NewFirefly(100, 100, 0, 0, 1000000, f.w)
-	// firefly.NewFirefly(100, 110, 45, 1, 1000000, f.w)
-	// firefly.NewFirefly(90, 110, 90, 2, 1000000, f.w)
-	// firefly.NewFirefly(80, 110, 135, 3, 1000000, f.w)
-	// firefly.NewFirefly(80, 100, 180, 4, 1000000, f.w)
-	// firefly.NewFirefly(80, 90, 225, 5, 1000000, f.w)
-	// firefly.NewFirefly(90, 90, 270, 6, 1000000, f.w)
-	// firefly.NewFirefly(100, 90, 315, 7, 1000000, f.w)
+	f.out, err = f.newFrameWriter()
+	check(err)
+	if trace != nil {
+		f.filmTrace(trace)
+	} else {
+		f.filmSimulation()
+	}
+	check(f.out.Close())
+	f.saveRun()
 
+	// the gif and apng outputs are ready to share, to turn the png frames into a video:
+	// ffmpeg -framerate 25 -i frame_%06d.png -c:v libx264 -r 25 -pix_fmt yuv420p out.mp4
+	// https://trac.ffmpeg.org/wiki/Slideshow
+	// https://stackoverflow.com/questions/24961127/how-to-create-a-video-from-images-with-ffmpeg
+	// https://hamelot.io/visualization/using-ffmpeg-to-convert-a-set-of-images-into-a-video/
+}
+
+// Render the frames of a recorded trace, without simulating.
+func (f *Filmer) filmTrace(trace *firefly.TraceReader) {
+	f.startRun(trace.Header.Config)
 	for frameI := 0; frameI < f.filmDuration*f.fps; frameI++ {
+		fr, err := trace.Next()
+		if err == io.EOF {
+			fmt.Printf("trace ended at frameI = %+v\n", frameI)
+			return
+		}
+		check(err)
+		f.recordClock(frameI, fr.Clock)
+		if f.resume && f.frameDone(frameI) {
+			continue
+		}
+		fmt.Printf("render frameI = %+v\n", frameI)
+		f.renderFrame(frameI, fr)
+	}
+}
+
+// Simulate a world and render it, recording the trace if requested.
+func (f *Filmer) filmSimulation() {
+
+	// timeline of changes to apply during the film
+	var runner *firefly.ScenarioRunner
+	if f.scenario != nil {
+		runner = firefly.NewScenarioRunner(f.scenario)
+	}
+
+	// restore the world from the checkpoint, or start a new one
+	frameStart := 0
+	if f.checkpoint != nil {
+		w, err := firefly.RestoreWorld(f.checkpoint)
+		check(err)
+		f.w = w
+		f.setupFields()
+		frameStart = f.checkpoint.Step
+		if runner != nil {
+			runner.Next = f.checkpoint.ScenarioNext
+		}
+		fmt.Printf("resume from frameI = %+v clock = %+v\n", frameStart, f.w.Clock)
+	} else {
+		f.newWorld()
+	}
+	f.startRun(f.w.Config())
+
+	// trace of the simulation, to render it again later
+	var recorder *firefly.TraceWriter
+	if f.recordPath != "" {
+		traceFile, err := os.Create(f.recordPath)
+		check(err)
+		defer traceFile.Close()
+		recorder, err = firefly.NewTraceWriter(traceFile, f.w.Config(), 10*f.fps)
+		check(err)
+		defer func() { check(recorder.Flush()) }()
+	}
+
+	for frameI := frameStart; frameI < f.filmDuration*f.fps; frameI++ {
 
 		// ########## //
 		//   render   //
 		// ########## //
 
-		fmt.Printf("render frameI = %+v\n", frameI)
-		f.renderFrame(frameI)
+		fr := f.w.Frame()
+		f.recordClock(frameI, fr.Clock)
+		if recorder != nil {
+			check(recorder.Write(fr))
+		}
+		if f.resume && f.frameDone(frameI) {
+			fmt.Printf("skip frameI = %+v\n", frameI)
+		} else {
+			fmt.Printf("render frameI = %+v\n", frameI)
+			f.renderFrame(frameI, fr)
+		}
 
 		// ########## //
 		//  simulate  //
 		// ########## //
 
-		fmt.Printf("simulate frameI = %+v\n", frameI)
+		if runner != nil {
+			applied, err := runner.Apply(f.w)
+			check(err)
+			for _, a := range applied {
+				fmt.Printf("applied action = %+v\n", a)
+			}
+		}
+		fmt.Printf("simulate frameI = %+v population = %+v\n", frameI, f.w.Population())
 		// f.w.DoStep <- 'M'
-		f.w.Move()
-		f.w.ClockTick()
+		f.w.Step()
+
+		// report how far the pacemakers entrained the swarm
+		for _, p := range f.w.Pacemakers() {
+			e := f.w.Entrainment(p, 2*f.clockTickLen, float32(f.nudgeRadius)/2)
+			fmt.Printf("entrainment t = %d id = %d entrained = %d/%d radius = %.1f\n",
+				e.Clock, e.Id, e.Entrained, e.Total, e.Radius)
+		}
+
+		// save the state to resume from the next frame
+		if f.checkpointEvery > 0 && (frameI+1)%f.checkpointEvery == 0 {
+			cp := f.w.Checkpoint()
+			cp.Step = frameI + 1
+			if runner != nil {
+				cp.ScenarioNext = runner.Next
+			}
+			check(firefly.SaveCheckpoint(f.checkpointPath(), cp))
+			f.saveRun()
+			fmt.Printf("checkpoint frameI = %+v\n", frameI+1)
+		}
 
 		// if frameI == 100 {
 		// 	break
 		// }
 	}
+}
 
-	// to turn the frames into a video:
-	// ffmpeg -framerate 25 -i frame_%06d.png -c:v libx264 -r 25 -pix_fmt yuv420p out.mp4
-	// https://trac.ffmpeg.org/wiki/Slideshow
-	// https://stackoverflow.com/questions/24961127/how-to-create-a-video-from-images-with-ffmpeg
-	// https://hamelot.io/visualization/using-ffmpeg-to-convert-a-set-of-images-into-a-video/
+// Create a new world with the film parameters.
+func (f *Filmer) newWorld() {
+	f.w = firefly.NewWorld3D(
+		f.cw, f.ch, f.cd, float32(f.cellSize),
+		1_000_000, f.clockTickLen,
+		f.nudgeAmount, float32(f.nudgeRadius),
+		f.blinkCooldown,
+		f.periodMin, f.periodMax,
+	)
+	if f.seed != 0 {
+		f.w.SetSeed(f.seed)
+	}
+	f.w.Bounded = f.bounded
+	f.w.Perception = f.perception
+	f.w.PerceptionScale = float32(f.perceptionScale)
+	f.w.DetectionProb = f.detectionProb
+	f.w.Coupling = f.coupling
+	f.setupFields()
+	if f.emergeRate > 0 || f.lifespanMin > 0 {
+		f.w.Lifecycle = firefly.NewLifecycle(f.emergeRate, f.lifespanMin, f.lifespanMax)
+	}
+	if f.graphSpec != "" {
+		g, err := firefly.ParseGraphSpec(f.graphSpec, firefly.NewRand(f.w.Seed))
+		check(err)
+		f.w.SetGraph(g)
+	} else {
+		f.w.HatchFireflies(f.nF)
+	}
+	if f.adaptive > 0 {
+		f.w.SetAdaptive(firefly.NewAdaptive(f.adaptive, f.w.NudgeRadius))
+	}
+	for _, p := range f.pacemakers {
+		if len(p.schedule) > 0 {
+			f.w.AddStimulus(p.x, p.y, p.schedule)
+		} else {
+			f.w.AddPacemaker(p.x, p.y, p.period, f.w.Clock+p.period)
+		}
+	}
+	// firefly.NewFirefly(100, 100, 0, 0, 1000000, f.w)
+	// firefly.NewFirefly(100, 110, 45, 1, 1000000, f.w)
+	// firefly.NewFirefly(90, 110, 90, 2, 1000000, f.w)
+	// firefly.NewFirefly(80, 110, 135, 3, 1000000, f.w)
+	// firefly.NewFirefly(80, 100, 180, 4, 1000000, f.w)
+	// firefly.NewFirefly(80, 90, 225, 5, 1000000, f.w)
+	// firefly.NewFirefly(90, 90, 270, 6, 1000000, f.w)
+	// firefly.NewFirefly(100, 90, 315, 7, 1000000, f.w)
+}
+
+// Path of the checkpoint, kept with the frames.
+func (f *Filmer) checkpointPath() string {
+	return filepath.Join(f.outputFolder, "checkpoint.json")
+}
+
+// Check if the frame was already rendered.
+func (f *Filmer) frameDone(frameI int) bool {
+	_, err := os.Stat(filepath.Join(f.outputFolder, fmt.Sprintf("frame_%06d.png", frameI)))
+	return err == nil
+}
+
+// Load the parameter fields of the world, and prepare the overlay to show.
+//
+// Must be called before hatching, as the period field is applied at birth.
+func (f *Filmer) setupFields() {
+	fields := map[string]*firefly.Field{}
+	for name, spec := range f.fieldSpecs {
+		if spec == "" {
+			continue
+		}
+		fd, err := firefly.LoadFieldSpec(spec, f.w.SizeW, f.w.SizeH)
+		check(err)
+		fields[name] = fd
+	}
+	check(f.w.SetPeriodField(fields["period"]))
+	f.w.PeriodContinuous = f.fieldContinuous
+	if fd, ok := fields["radius"]; ok {
+		f.w.SetRadiusField(fd)
+	}
+	f.w.SpeedField = fields["speed"]
+
+	if f.fieldShow == "" {
+		return
+	}
+	fd, ok := fields[f.fieldShow]
+	if !ok {
+		check(fmt.Errorf("cannot show the %q field, it is not set", f.fieldShow))
+	}
+
+	// the fields do not change, draw the overlay once
+	// lighten the background where the field is high
+	f.fieldOverlay = image.NewRGBA(f.frameSize)
+	highCol := elemColor['A'].GetBlent(1)
+	for y := 0; y < f.frameSize.Dy(); y++ {
+		for x := 0; x < f.frameSize.Dx(); x++ {
+			v := fd.Normalized(float32(x)/float32(f.scale), float32(y)/float32(f.scale))
+			c := f.backCol.BlendLuv(highCol, float64(v))
+			r, g, b := c.Clamped().RGB255()
+			f.fieldOverlay.SetRGBA(x, y, color.RGBA{r, g, b, 255})
+		}
+	}
+	// drawn below the supersampled fireflies
+	if f.supersample > 1 {
+		f.fieldOverlay = UpscaleImg(f.fieldOverlay, f.supersample)
+	}
 }
 
-func (f *Filmer) renderFrame(frameI int) {
+func (f *Filmer) renderFrame(frameI int, fr *firefly.Frame) {
 
 	img := image.NewRGBA(f.frameSize)
+	// the fireflies are drawn on a larger canvas when supersampling
+	canvas := img
+	if f.supersample > 1 {
+		canvas = image.NewRGBA(image.Rect(0, 0, f.frameSize.Dx()*f.supersample, f.frameSize.Dy()*f.supersample))
+	}
 
 	// fill background
 	draw.Draw(
-		img, img.Bounds(),
+		canvas, canvas.Bounds(),
 		&image.Uniform{f.backCol},
 		image.Point{0, 0},
 		draw.Src,
 	)
+	if f.fieldOverlay != nil {
+		draw.Draw(canvas, canvas.Bounds(), f.fieldOverlay, image.Point{0, 0}, draw.Src)
+	}
+
+	// group the fireflies by cell
+	cells := make([][]firefly.FireflyState, f.cw*f.ch)
+	for _, s := range fr.Fireflies {
+		cx := int(s.X) / f.cellSize
+		cy := int(s.Y) / f.cellSize
+		cells[cx*f.ch+cy] = append(cells[cx*f.ch+cy], s)
+	}
 
 	// draw each cell
-	for i := 0; i < f.w.CellWNum; i++ {
-		for ii := 0; ii < f.w.CellHNum; ii++ {
-			f.renderWG.Add(1)
-			go f.renderCell(f.w.Cells[i][ii], img)
-		}
+	for i := range cells {
+		f.renderWG.Add(1)
+		go f.renderCell(i, cells, fr.Clock, canvas)
 	}
 	f.renderWG.Wait()
+	if f.supersample > 1 {
+		downsample(img, canvas, f.supersample)
+	}
+	if f.bloom != nil {
+		f.bloom.apply(img, f.scale)
+	}
+	f.drawOverlay(img, cells)
 
 	// save the frame
-	frameName := fmt.Sprintf("frame_%06d.png", frameI)
-	fmt.Printf("frameName = %+v\n", frameName)
-	framePath := filepath.Join(f.outputFolder, frameName)
 	// img = UpscaleImg(img, 5)
-	SavePNG(framePath, img)
+	check(f.out.WriteFrame(frameI, img))
 }
 
-func (F *Filmer) renderCell(c *firefly.Cell, m *image.RGBA) {
+// Render the pixels of the cell cellI.
+//
+// Each goroutine writes only the pixels of its own cell, and draws also the fireflies of the cells around
+// that spill over its border, in the order of the cells: the frame does not depend on the scheduling.
+func (F *Filmer) renderCell(cellI int, cells [][]firefly.FireflyState, clock int, m *image.RGBA) {
+	cellPx := F.cellSize * F.scale * F.supersample
+	cx, cy := cellI/F.ch, cellI%F.ch
+	tile := image.Rect(cx*cellPx, cy*cellPx, (cx+1)*cellPx, (cy+1)*cellPx)
+
+	// the sprites of the fireflies in the cells around can reach the tile
+	extent := F.templateSize * F.supersample
+	if F.antialias != nil {
+		extent += 2 * F.antialias.radius
+	}
+	reach := 1 + extent/cellPx
+	fireflies := []firefly.FireflyState{}
+	for nx := cx - reach; nx <= cx+reach; nx++ {
+		for ny := cy - reach; ny <= cy+reach; ny++ {
+			if nx < 0 || nx >= F.cw || ny < 0 || ny >= F.ch {
+				continue
+			}
+			fireflies = append(fireflies, cells[nx*F.ch+ny]...)
+		}
+	}
+
+	// project a 3D world along the depth, drawing the far fireflies first
+	if F.cd > 0 {
+		sort.SliceStable(fireflies, func(i, j int) bool { return fireflies[i].Z < fireflies[j].Z })
+	}
 
-	for _, f := range c.Fireflies {
+	lt := newLightTile(m, tile, F.backCol, F.blend)
+	for _, f := range fireflies {
 		// blit the right firefly in the right place
 
 		// get the lightness level
-		since := F.w.Clock - (f.NextBlink - f.Period)
+		// the last blink is used, as a delayed deadline can move away from the clock
+		since := clock - f.LastBlink
 		br := Brightness(since, F.decay)
+
+		// far fireflies are dimmer and smaller
+		template, templateSize, rotNum := F.blitTemplate, F.templateSize, F.rotNum
+		if F.cd > 0 {
+			depth := float64(f.Z) / float64(F.cd*F.cellSize)
+			br *= 0.35 + 0.65*depth
+			if depth < 0.5 {
+				template, templateSize, rotNum = F.farTemplate, 3, 2
+			}
+		}
 		lLev := int(br * float64(F.lLevels))
+		templateSize *= F.supersample
 
 		// go from firefly to template reference system
 		remappedOri := remapOri(f.O)
 		// find the corner of the rect in the source (template) image
-		bX, bY := findBlitPos(remappedOri, lLev, F.templateSize, F.rotNum)
+		bX, bY := findBlitPos(remappedOri, lLev, templateSize, rotNum)
 		// rectangle in the source image
-		sr := image.Rect(bX, bY, bX+F.templateSize, bY+F.templateSize)
-		// corner of the rect in the dest image
-		dp := image.Pt(int(f.X*float32(F.scale)), int(f.Y*float32(F.scale)))
-		// rectangle in the dest image
-		dr := image.Rectangle{dp, dp.Add(sr.Size())}
-		draw.Draw(m, dr, F.blitTemplate, sr.Min, draw.Src)
-
+		sr := image.Rect(bX, bY, bX+templateSize, bY+templateSize)
+		// corner of the rect in the dest image, between the pixels when anti-aliasing
+		px := float64(f.X) * float64(F.scale*F.supersample)
+		py := float64(f.Y) * float64(F.scale*F.supersample)
+		if F.antialias != nil {
+			F.antialias.spread(template, sr, px, py, lt.add)
+		} else {
+			spreadGrid(template, sr, px, py, lt.add)
+		}
 	}
+	lt.resolve(m, F.tone)
 
 	F.renderWG.Done()
 }
 
 func main() {
+
+	c := &filmConfig{}
+	c.registerFlags(flag.CommandLine)
+	check(c.parse(flag.CommandLine, os.Args[1:]))
+
+	switch c.Output {
+	case outputPNG, outputGIF, outputAPNG, outputAVI:
+	case outputY4M:
+		// the video stream takes stdout, the logs go to stderr
+		os.Stdout = os.Stderr
+	default:
+		check(fmt.Errorf("unknown output format %q", c.Output))
+	}
+	if c.AnimFps < 1 || c.AnimFps > 100 || c.Loop < 0 || c.Loop > 65535 {
+		check(fmt.Errorf("the animation needs 1 to 100 fps and 0 to 65535 loops"))
+	}
+	if c.Resume && c.OutputDir == "" {
+		check(fmt.Errorf("set the -dir of the film to resume"))
+	}
+	if c.JPEGQuality < 1 || c.JPEGQuality > 100 {
+		check(fmt.Errorf("the jpeg quality must be in [1, 100], got %d", c.JPEGQuality))
+	}
 	fmt.Println("Start filming.")
 
-	// world params
-	cw := flag.Int("cw", 16, "Width of the world in cells.")
-	ch := flag.Int("ch", 9, "Height of the world in cells.")
-	cellSize := flag.Int("cs", 80, "Size of each cell.")
-	nudgeRadius := flag.Int("nr", 22, "Max distance between interacting fireflies.")
-	nF := flag.Int("nf", 1000, "Number of fireflies to simulate.")
-
-	// film params
-	filmDuration := flag.Int("fd", 10, "Lenght of the output in seconds.")
-	drawCircle := flag.Bool("dc", false, "Draw a circle to show the nudge radius value.")
-
-	flag.Parse()
-
-	fmt.Println("cs    :", *cellSize)
-	fmt.Println("cw ch :", *cw, *ch)
-	fmt.Println("nr    :", *nudgeRadius)
-	fmt.Println("nf    :", *nF)
-	fmt.Println("fd    :", *filmDuration)
-	fmt.Println("dc    :", *drawCircle)
-
-	f := NewFilmer(
-		*cellSize, *cw, *ch,
-		*nudgeRadius,
-		*nF,
-		*filmDuration,
-		*drawCircle,
-	)
+	// the preset fits the requested world to the resolution
+	if c.Preset != "" {
+		res, err := parsePreset(c.Preset)
+		check(err)
+		presetScale := 0
+		if c.set["scale"] {
+			presetScale = c.Scale
+		}
+		l, err := presetLayout(res, c.CellWNum, c.CellHNum, c.CellDNum, c.CellSize, c.NudgeRadius, c.Fireflies, presetScale)
+		check(err)
+		c.CellWNum, c.CellHNum, c.CellSize, c.Scale, c.Fireflies = l.cw, l.ch, l.cellSize, l.scale, l.nF
+		fmt.Printf("preset: %dx%d px, %dx%d cells of %d at scale %d, %d fireflies\n", res.X, res.Y, l.cw, l.ch, l.cellSize, l.scale, l.nF)
+	}
 
+	fmt.Println("cs    :", c.CellSize)
+	fmt.Println("cw ch :", c.CellWNum, c.CellHNum)
+	fmt.Println("cd    :", c.CellDNum, c.Bounded)
+	fmt.Println("nr    :", c.NudgeRadius)
+	fmt.Println("nf    :", c.Fireflies)
+	fmt.Println("fd    :", c.FilmDuration)
+	fmt.Println("dc    :", c.DrawCircle, c.CircleIds)
+	fmt.Println("debug :", c.DrawGrid, c.DrawBands, c.DrawCounts)
+	fmt.Println("er    :", c.EmergeRate)
+	fmt.Println("lmin  :", c.LifespanMin)
+	fmt.Println("lmax  :", c.LifespanMax)
+	fmt.Println("perc  :", c.Perception)
+	fmt.Println("ps    :", c.PerceptionScale)
+	fmt.Println("det   :", c.DetectionProb)
+	fmt.Println("coup  :", c.Coupling)
+	fmt.Println("pace  :", c.Pacemakers)
+	fmt.Println("stim  :", c.Stimuli)
+	fmt.Println("scen  :", c.Scenario)
+	fmt.Println("fields:", c.FieldPeriod, c.FieldRadius, c.FieldSpeed, c.FieldContinuous, c.FieldShow)
+	fmt.Println("record:", c.RecordPath)
+	fmt.Println("replay:", c.ReplayPath)
+	fmt.Println("resume:", c.Resume, c.CheckpointEvery)
+	fmt.Println("graph:", c.GraphSpec)
+	fmt.Println("adapt:", c.Adaptive)
+	fmt.Println("out  :", c.Output, c.AnimFps, c.Loop, c.JPEGQuality)
+	fmt.Println("dir  :", c.OutputDir, c.Overwrite)
+	fmt.Println("seed :", c.Seed)
+	fmt.Println("sim  :", c.ClockTick, c.BlinkCooldown, c.NudgeAmount, c.PeriodMin, c.PeriodMax)
+	fmt.Println("rend :", c.Fps, c.Scale, c.Template, c.Decay, c.LLevels)
+	fmt.Println("aa   :", c.Antialias, c.Supersample)
+	fmt.Println("bloom:", c.BloomStrength, c.BloomThreshold, c.BloomRadii)
+	fmt.Println("light:", c.Blend, c.Tone)
+
+	f, err := NewFilmer(*c)
+	check(err)
 	f.film()
 }
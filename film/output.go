@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Formats of the output.
+const (
+	outputPNG  = "png"  // Numbered PNG frames in the output folder.
+	outputGIF  = "gif"  // Animated GIF with a palette of the firefly colours.
+	outputAPNG = "apng" // Animated PNG in full colour.
+	outputY4M  = "y4m"  // YUV4MPEG2 stream on stdout, to pipe into an encoder.
+	outputAVI  = "avi"  // Motion-JPEG AVI video.
+)
+
+// Stdout of the process, kept for the video stream when the logs are moved to stderr.
+var stdout io.Writer = os.Stdout
+
+// frameWriter saves the rendered frames of the film.
+type frameWriter interface {
+	WriteFrame(frameI int, img *image.RGBA) error
+	Close() error
+}
+
+// Create the writer for the output format requested.
+func (f *Filmer) newFrameWriter() (frameWriter, error) {
+	switch f.output {
+	case outputPNG:
+		return &pngWriter{f.outputFolder}, nil
+	case outputGIF:
+		keys := templateKeys(f.whichTemplate)
+		if f.cd > 0 {
+			keys = append(keys, templateKeys("F3")...)
+		}
+		// the background and the field overlay
+		keys = append(keys, 'a', 'A')
+		return newGIFWriter(filepath.Join(f.outputFolder, "film.gif"), gifPalette(keys), f.animFps, f.loop)
+	case outputAPNG:
+		return newAPNGWriter(filepath.Join(f.outputFolder, "film.png"), f.animFps, f.loop)
+	case outputY4M:
+		return newY4MWriter(stdout, f.frameSize, f.animFps), nil
+	case outputAVI:
+		return newAVIWriter(filepath.Join(f.outputFolder, "film.avi"), f.frameSize, f.animFps, f.jpegQuality)
+	}
+	return nil, fmt.Errorf("unknown output format %q", f.output)
+}
+
+// pngWriter saves each frame in a numbered PNG.
+type pngWriter struct {
+	folder string
+}
+
+func (pw *pngWriter) WriteFrame(frameI int, img *image.RGBA) error {
+	frameName := fmt.Sprintf("frame_%06d.png", frameI)
+	fmt.Printf("frameName = %+v\n", frameName)
+	SavePNG(filepath.Join(pw.folder, frameName), img)
+	return nil
+}
+
+func (pw *pngWriter) Close() error {
+	return nil
+}
+
+// Build a palette sampling the lightness ranges of the elements of the templates.
+//
+// The elements with the same range share the colours, the constant ones take a single colour,
+// the others split evenly the rest of the 256 colours.
+func gifPalette(keys []byte) color.Palette {
+	ranges := []*RangeColorHCL{}
+	seen := map[RangeColorHCL]bool{}
+	constant := 0
+	for _, k := range keys {
+		r := elemColor[k]
+		id := RangeColorHCL{H: r.H, C: r.C, Lh: r.Lh, Ll: r.Ll}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ranges = append(ranges, r)
+		if r.Lh == r.Ll {
+			constant++
+		}
+	}
+
+	levels := 256
+	if len(ranges) > constant {
+		levels = (256 - constant) / (len(ranges) - constant)
+	}
+	p := color.Palette{}
+	for _, r := range ranges {
+		n := levels
+		if r.Lh == r.Ll {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			t := 1.0
+			if n > 1 {
+				t = float64(i) / float64(n-1)
+			}
+			cr, cg, cb := r.GetBlent(t).Clamped().RGB255()
+			p = append(p, color.RGBA{cr, cg, cb, 255})
+		}
+	}
+	return p
+}
+
+// Keys of the elements used in a template.
+func templateKeys(whichTemplate string) []byte {
+	keys := []byte{}
+	for _, rot := range templateByName(whichTemplate) {
+		for _, row := range rot {
+			keys = append(keys, row...)
+		}
+	}
+	return keys
+}
+
+// Colours kept in the cache of a gifWriter, past which it starts over.
+//
+// The glow, the bloom and the tone mapping can give a new colour to any pixel,
+// the cache must not grow with the length of the film.
+const gifIndexMax = 1 << 16
+
+// gifWriter streams the frames to an animated GIF.
+//
+// Each frame is encoded with image/gif, and the image block is copied after the
+// header of the first one, so that the frames are not kept in memory.
+type gifWriter struct {
+	file    *os.File
+	bw      *bufio.Writer
+	palette color.Palette
+	index   map[color.RGBA]uint8 // Cache of the closest colour in the palette.
+	delay   int                  // Delay between the frames, in 1/100 s.
+	loop    int                  // Times to play the animation, 0 to loop forever.
+	started bool
+	buf     bytes.Buffer
+}
+
+func newGIFWriter(name string, palette color.Palette, fps, loop int) (*gifWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	gw := &gifWriter{}
+	gw.file = file
+	gw.bw = bufio.NewWriter(file)
+	gw.palette = palette
+	gw.index = map[color.RGBA]uint8{}
+	gw.delay = (100 + fps/2) / fps
+	gw.loop = loop
+	return gw, nil
+}
+
+func (gw *gifWriter) WriteFrame(frameI int, img *image.RGBA) error {
+	// map the pixels to the palette, the frames only have a few distinct colours
+	pm := image.NewPaletted(img.Bounds(), gw.palette)
+	for i := range pm.Pix {
+		c := color.RGBA{img.Pix[4*i], img.Pix[4*i+1], img.Pix[4*i+2], 255}
+		ci, ok := gw.index[c]
+		if !ok {
+			ci = uint8(gw.palette.Index(c))
+			if len(gw.index) >= gifIndexMax {
+				gw.index = map[color.RGBA]uint8{}
+			}
+			gw.index[c] = ci
+		}
+		pm.Pix[i] = ci
+	}
+
+	gw.buf.Reset()
+	if err := gif.Encode(&gw.buf, pm, nil); err != nil {
+		return err
+	}
+	b := gw.buf.Bytes()
+	// signature, screen descriptor and global colour table
+	header := 13
+	if b[10]&0x80 != 0 {
+		header += 3 << (b[10]&0x07 + 1)
+	}
+
+	if !gw.started {
+		gw.started = true
+		gw.bw.Write(b[:header])
+		if gw.loop != 1 {
+			// the NETSCAPE extension counts the repetitions after the first play
+			count := gw.loop - 1
+			if gw.loop == 0 {
+				count = 0
+			}
+			gw.bw.Write([]byte{0x21, 0xff, 0x0b})
+			gw.bw.WriteString("NETSCAPE2.0")
+			gw.bw.Write([]byte{0x03, 0x01, byte(count), byte(count >> 8), 0x00})
+		}
+	}
+
+	// graphic control extension with the delay, then the image block without the trailer
+	gw.bw.Write([]byte{0x21, 0xf9, 0x04, 0x00, byte(gw.delay), byte(gw.delay >> 8), 0x00, 0x00})
+	_, err := gw.bw.Write(b[header : len(b)-1])
+	return err
+}
+
+func (gw *gifWriter) Close() error {
+	gw.bw.WriteByte(0x3b)
+	if err := gw.bw.Flush(); err != nil {
+		gw.file.Close()
+		return err
+	}
+	return gw.file.Close()
+}
+
+// apngWriter streams the frames to an animated PNG.
+//
+// Each frame is encoded with image/png, and its data chunks are copied in the animation.
+// The number of frames is written in the acTL chunk when closing the file.
+type apngWriter struct {
+	file    *os.File
+	bw      *bufio.Writer
+	fps     int    // Frames per second of the animation.
+	loop    int    // Times to play the animation, 0 to loop forever.
+	seq     uint32 // Sequence number of the next fcTL or fdAT chunk.
+	frames  uint32
+	ihdr    []byte // Header of the first frame, all the frames must match it.
+	actlPos int64  // Offset of the acTL chunk in the file.
+	buf     bytes.Buffer
+}
+
+func newAPNGWriter(name string, fps, loop int) (*apngWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	aw := &apngWriter{}
+	aw.file = file
+	aw.bw = bufio.NewWriter(file)
+	aw.fps = fps
+	aw.loop = loop
+	return aw, nil
+}
+
+// Write a PNG chunk with its length and checksum.
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var head [8]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(len(data)))
+	copy(head[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(head[4:])
+	crc.Write(data)
+	var tail [4]byte
+	binary.BigEndian.PutUint32(tail[:], crc.Sum32())
+	w.Write(head[:])
+	w.Write(data)
+	_, err := w.Write(tail[:])
+	return err
+}
+
+// Content of the acTL chunk.
+func (aw *apngWriter) actl() []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[:4], aw.frames)
+	binary.BigEndian.PutUint32(data[4:], uint32(aw.loop))
+	return data
+}
+
+func (aw *apngWriter) WriteFrame(frameI int, img *image.RGBA) error {
+	aw.buf.Reset()
+	if err := png.Encode(&aw.buf, img); err != nil {
+		return err
+	}
+
+	// split the PNG in chunks, after the signature
+	b := aw.buf.Bytes()[8:]
+	idat := [][]byte{}
+	var ihdr []byte
+	for len(b) >= 12 {
+		n := binary.BigEndian.Uint32(b[:4])
+		typ, data := string(b[4:8]), b[8:8+n]
+		switch typ {
+		case "IHDR":
+			ihdr = data
+		case "IDAT":
+			idat = append(idat, data)
+		}
+		b = b[12+n:]
+	}
+
+	if aw.ihdr == nil {
+		aw.ihdr = append([]byte{}, ihdr...)
+		aw.bw.Write([]byte("\x89PNG\r\n\x1a\n"))
+		writeChunk(aw.bw, "IHDR", aw.ihdr)
+		aw.actlPos = 8 + 12 + int64(len(aw.ihdr))
+		writeChunk(aw.bw, "acTL", aw.actl())
+	} else if !bytes.Equal(aw.ihdr, ihdr) {
+		return fmt.Errorf("apng: frame %d has a different format", frameI)
+	}
+
+	// frame control: full size, shown for 1/fps s, replacing the previous one
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:], aw.seq)
+	copy(fctl[4:12], aw.ihdr[:8])
+	binary.BigEndian.PutUint16(fctl[20:], 1)
+	binary.BigEndian.PutUint16(fctl[22:], uint16(aw.fps))
+	aw.seq++
+	writeChunk(aw.bw, "fcTL", fctl)
+
+	// the first frame is the default image, the others are in fdAT chunks
+	for _, data := range idat {
+		if aw.frames == 0 {
+			writeChunk(aw.bw, "IDAT", data)
+			continue
+		}
+		fdat := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, aw.seq)
+		copy(fdat[4:], data)
+		aw.seq++
+		writeChunk(aw.bw, "fdAT", fdat)
+	}
+	aw.frames++
+	return nil
+}
+
+func (aw *apngWriter) Close() error {
+	if aw.ihdr == nil {
+		aw.file.Close()
+		return fmt.Errorf("apng: no frames to write")
+	}
+	writeChunk(aw.bw, "IEND", nil)
+	err := aw.bw.Flush()
+
+	// now the number of frames is known
+	if err == nil {
+		_, err = aw.file.Seek(aw.actlPos, io.SeekStart)
+	}
+	if err == nil {
+		err = writeChunk(aw.file, "acTL", aw.actl())
+	}
+	if cerr := aw.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// y4mWriter streams the frames as YUV4MPEG2, with full resolution chroma.
+type y4mWriter struct {
+	bw      *bufio.Writer
+	size    image.Rectangle
+	fps     int
+	started bool
+	planes  []byte // Y, Cb and Cr planes of the frame.
+}
+
+func newY4MWriter(w io.Writer, size image.Rectangle, fps int) *y4mWriter {
+	yw := &y4mWriter{}
+	yw.bw = bufio.NewWriterSize(w, 1<<20)
+	yw.size = size
+	yw.fps = fps
+	yw.planes = make([]byte, 3*size.Dx()*size.Dy())
+	return yw
+}
+
+func (yw *y4mWriter) WriteFrame(frameI int, img *image.RGBA) error {
+	if !yw.started {
+		yw.started = true
+		fmt.Fprintf(yw.bw, "YUV4MPEG2 W%d H%d F%d:1 Ip A1:1 C444 XCOLORRANGE=FULL\n",
+			yw.size.Dx(), yw.size.Dy(), yw.fps)
+	}
+	n := yw.size.Dx() * yw.size.Dy()
+	for i := 0; i < n; i++ {
+		yy, cb, cr := color.RGBToYCbCr(img.Pix[4*i], img.Pix[4*i+1], img.Pix[4*i+2])
+		yw.planes[i], yw.planes[n+i], yw.planes[2*n+i] = yy, cb, cr
+	}
+	yw.bw.WriteString("FRAME\n")
+	_, err := yw.bw.Write(yw.planes)
+	return err
+}
+
+func (yw *y4mWriter) Close() error {
+	return yw.bw.Flush()
+}
+
+// aviWriter saves the frames as JPEG in an AVI file.
+//
+// The header is written with placeholders for the number of frames and the sizes,
+// filled when closing the file.
+type aviWriter struct {
+	file    *os.File
+	bw      *bufio.Writer
+	quality int    // Quality of the JPEG frames, 1 to 100.
+	pos     int64  // Bytes written so far.
+	index   []byte // Entries of the idx1 chunk.
+	frames  uint32
+	buf     bytes.Buffer
+}
+
+// Offsets in the AVI header.
+const (
+	aviTotalFrames = 48  // Frames in the main header.
+	aviLength      = 140 // Frames in the stream header.
+	aviMovi        = 216 // Size of the movi list.
+)
+
+func newAVIWriter(name string, size image.Rectangle, fps, quality int) (*aviWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	aw := &aviWriter{}
+	aw.file = file
+	aw.bw = bufio.NewWriter(file)
+	aw.quality = quality
+
+	w, h := uint32(size.Dx()), uint32(size.Dy())
+	hdr := &bytes.Buffer{}
+	le := func(vs ...interface{}) {
+		for _, v := range vs {
+			if s, ok := v.(string); ok {
+				hdr.WriteString(s)
+				continue
+			}
+			binary.Write(hdr, binary.LittleEndian, v)
+		}
+	}
+	le("RIFF", uint32(0), "AVI ")
+	le("LIST", uint32(192), "hdrl")
+	// main header: us per frame, max bytes per second, padding, flags (has index),
+	// frames, initial frames, streams, buffer size, width, height, reserved
+	le("avih", uint32(56), uint32(1_000_000/fps), uint32(0), uint32(0), uint32(0x10),
+		uint32(0), uint32(0), uint32(1), uint32(0), w, h, [4]uint32{})
+	le("LIST", uint32(116), "strl")
+	// stream header: type, handler, flags, priority, language, initial frames, scale, rate,
+	// start, length, buffer size, quality, sample size, frame rectangle
+	le("strh", uint32(56), "vids", "MJPG", uint32(0), uint16(0), uint16(0), uint32(0),
+		uint32(1), uint32(fps), uint32(0), uint32(0), uint32(0), ^uint32(0), uint32(0),
+		[4]uint16{0, 0, uint16(w), uint16(h)})
+	// bitmap info: size, width, height, planes, bits, compression, image size, resolution, colours
+	le("strf", uint32(40), uint32(40), w, h, uint16(1), uint16(24), "MJPG", w*h*3,
+		uint32(0), uint32(0), uint32(0), uint32(0))
+	le("LIST", uint32(0), "movi")
+
+	aw.pos, err = hdr.WriteTo(aw.bw)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *aviWriter) WriteFrame(frameI int, img *image.RGBA) error {
+	aw.buf.Reset()
+	if err := jpeg.Encode(&aw.buf, img, &jpeg.Options{Quality: aw.quality}); err != nil {
+		return err
+	}
+	n := aw.buf.Len()
+	// the chunks are padded to an even size
+	pad := n % 2
+	if aw.pos+int64(8+n+pad+16*(int(aw.frames)+1)+8) > 1<<32-1 {
+		return fmt.Errorf("avi: the video is larger than 4 GB, use the y4m output")
+	}
+
+	// index entry: id, flags (key frame), offset from the movi list type, size
+	entry := make([]byte, 16)
+	copy(entry, "00dc")
+	binary.LittleEndian.PutUint32(entry[4:], 0x10)
+	binary.LittleEndian.PutUint32(entry[8:], uint32(aw.pos-(aviMovi+4)))
+	binary.LittleEndian.PutUint32(entry[12:], uint32(n))
+	aw.index = append(aw.index, entry...)
+
+	var head [8]byte
+	copy(head[:], "00dc")
+	binary.LittleEndian.PutUint32(head[4:], uint32(n))
+	aw.bw.Write(head[:])
+	aw.bw.Write(aw.buf.Bytes())
+	if pad == 1 {
+		aw.bw.WriteByte(0)
+	}
+	aw.pos += int64(8 + n + pad)
+	aw.frames++
+	return nil
+}
+
+func (aw *aviWriter) Close() error {
+	moviSize := uint32(aw.pos - (aviMovi + 4))
+	var head [8]byte
+	copy(head[:], "idx1")
+	binary.LittleEndian.PutUint32(head[4:], uint32(len(aw.index)))
+	aw.bw.Write(head[:])
+	aw.bw.Write(aw.index)
+	aw.pos += int64(8 + len(aw.index))
+	err := aw.bw.Flush()
+
+	// now the sizes are known
+	patch := func(off int64, v uint32) {
+		if err != nil {
+			return
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], v)
+		_, err = aw.file.WriteAt(b[:], off)
+	}
+	patch(4, uint32(aw.pos-8))
+	patch(aviTotalFrames, aw.frames)
+	patch(aviLength, aw.frames)
+	patch(aviMovi, moviSize)
+	if cerr := aw.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Colours of the test frames, frame i is filled with the colour i modulo their number.
+var testColors = color.Palette{
+	color.RGBA{0, 0, 0, 255},
+	color.RGBA{255, 255, 255, 255},
+	color.RGBA{200, 180, 40, 255},
+}
+
+// A frame filled with the colour of frame i.
+func testFrame(i int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 6, 4))
+	draw.Draw(img, img.Bounds(), image.NewUniform(testColors[i%len(testColors)]), image.Point{}, draw.Src)
+	return img
+}
+
+// Write the frames with fw and close it.
+func writeFrames(t *testing.T, fw frameWriter, n int) {
+	for i := 0; i < n; i++ {
+		assert.NoError(t, fw.WriteFrame(i, testFrame(i)))
+	}
+	assert.NoError(t, fw.Close())
+}
+
+// The animated GIF decodes with all the frames, the delay and the loops.
+func TestGIFWriter(t *testing.T) {
+	for _, tc := range []struct {
+		frames, fps, loop int
+		delay, loopCount  int
+	}{
+		{1, 25, 0, 4, 0},
+		{5, 25, 0, 4, 0},
+		{4, 30, 1, 3, -1},
+		{3, 10, 3, 10, 2},
+	} {
+		name := filepath.Join(t.TempDir(), "film.gif")
+		gw, err := newGIFWriter(name, testColors, tc.fps, tc.loop)
+		assert.NoError(t, err)
+		writeFrames(t, gw, tc.frames)
+
+		file, err := os.Open(name)
+		assert.NoError(t, err)
+		g, err := gif.DecodeAll(file)
+		file.Close()
+		assert.NoError(t, err)
+		assert.Len(t, g.Image, tc.frames, "%+v", tc)
+		for i, d := range g.Delay {
+			assert.Equal(t, tc.delay, d, "%+v", tc)
+			assert.Equal(t, testColors[i%len(testColors)], g.Image[i].At(2, 2), "%+v", tc)
+		}
+		assert.Equal(t, tc.loopCount, g.LoopCount, "%+v", tc)
+	}
+}
+
+// The cache of the palette stays bounded, and the pixels keep their closest colour.
+func TestGIFWriterIndex(t *testing.T) {
+	// a frame with more colours than the cache holds
+	img := image.NewRGBA(image.Rect(0, 0, 512, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 512; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x / 2), 255})
+		}
+	}
+	name := filepath.Join(t.TempDir(), "film.gif")
+	gw, err := newGIFWriter(name, testColors, 25, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, gw.WriteFrame(0, img))
+	assert.LessOrEqual(t, len(gw.index), gifIndexMax)
+	assert.NotEmpty(t, gw.index)
+	assert.NoError(t, gw.Close())
+
+	file, err := os.Open(name)
+	assert.NoError(t, err)
+	g, err := gif.DecodeAll(file)
+	file.Close()
+	assert.NoError(t, err)
+	for _, p := range []image.Point{{0, 0}, {511, 255}, {300, 10}, {10, 200}} {
+		assert.Equal(t, testColors.Convert(img.At(p.X, p.Y)), g.Image[0].At(p.X, p.Y), "%v", p)
+	}
+}
+
+// The animated PNG decodes as its first frame, with the frames and the delays in its chunks.
+func TestAPNGWriter(t *testing.T) {
+	for _, tc := range []struct {
+		frames, fps, loop int
+	}{
+		{1, 25, 0},
+		{5, 25, 0},
+		{3, 60, 2},
+	} {
+		name := filepath.Join(t.TempDir(), "film.png")
+		aw, err := newAPNGWriter(name, tc.fps, tc.loop)
+		assert.NoError(t, err)
+		writeFrames(t, aw, tc.frames)
+
+		// the viewers without animation show the first frame
+		file, err := os.Open(name)
+		assert.NoError(t, err)
+		img, err := png.Decode(file)
+		file.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, color.NRGBA{0, 0, 0, 255}, color.NRGBAModel.Convert(img.At(2, 2)))
+
+		data, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		chunks := map[string]int{}
+		seq := uint32(0)
+		for b := data[8:]; len(b) >= 12; {
+			n := binary.BigEndian.Uint32(b[:4])
+			typ, body := string(b[4:8]), b[8:8+n]
+			chunks[typ]++
+			switch typ {
+			case "acTL":
+				assert.Equal(t, uint32(tc.frames), binary.BigEndian.Uint32(body[:4]), "%+v", tc)
+				assert.Equal(t, uint32(tc.loop), binary.BigEndian.Uint32(body[4:]), "%+v", tc)
+			case "fcTL":
+				assert.Equal(t, seq, binary.BigEndian.Uint32(body[:4]))
+				assert.Equal(t, uint16(1), binary.BigEndian.Uint16(body[20:]))
+				assert.Equal(t, uint16(tc.fps), binary.BigEndian.Uint16(body[22:]))
+				seq++
+			case "fdAT":
+				assert.Equal(t, seq, binary.BigEndian.Uint32(body[:4]))
+				seq++
+			}
+			b = b[12+n:]
+		}
+		assert.Equal(t, 1, chunks["acTL"])
+		assert.Equal(t, tc.frames, chunks["fcTL"])
+		assert.Equal(t, 1, chunks["IEND"])
+	}
+}
+
+// An APNG without frames is an error.
+func TestAPNGWriterEmpty(t *testing.T) {
+	aw, err := newAPNGWriter(filepath.Join(t.TempDir(), "film.png"), 25, 0)
+	assert.NoError(t, err)
+	assert.Error(t, aw.Close())
+}
+
+// The AVI has the sizes of the RIFF and movi lists, the frames in the headers and an index of the frames.
+func TestAVIWriter(t *testing.T) {
+	for _, frames := range []int{1, 2, 7} {
+		name := filepath.Join(t.TempDir(), "film.avi")
+		aw, err := newAVIWriter(name, testFrame(0).Bounds(), 25, 90)
+		assert.NoError(t, err)
+		writeFrames(t, aw, frames)
+
+		data, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		le := func(off int) int { return int(binary.LittleEndian.Uint32(data[off:])) }
+		assert.Equal(t, "RIFF", string(data[:4]))
+		assert.Equal(t, len(data)-8, le(4))
+		assert.Equal(t, "AVI ", string(data[8:12]))
+		assert.Equal(t, frames, le(aviTotalFrames))
+		assert.Equal(t, frames, le(aviLength))
+		assert.Equal(t, 40_000, le(32), "us per frame")
+
+		// the movi list is followed by the index
+		assert.Equal(t, "LIST", string(data[aviMovi-4:aviMovi]))
+		movi := aviMovi + 4
+		assert.Equal(t, "movi", string(data[movi:movi+4]))
+		idx := movi + le(aviMovi)
+		assert.Equal(t, "idx1", string(data[idx:idx+4]))
+		assert.Equal(t, 16*frames, le(idx+4))
+		assert.Equal(t, len(data), idx+8+16*frames)
+
+		// each entry points at a JPEG frame
+		for i := 0; i < frames; i++ {
+			e := idx + 8 + 16*i
+			assert.Equal(t, "00dc", string(data[e:e+4]))
+			off, size := movi+le(e+8), le(e+12)
+			assert.Equal(t, "00dc", string(data[off:off+4]))
+			assert.Equal(t, size, le(off+4))
+			img, err := jpeg.Decode(bytes.NewReader(data[off+8 : off+8+size]))
+			assert.NoError(t, err)
+			assert.Equal(t, testFrame(0).Bounds(), img.Bounds())
+		}
+	}
+}
+
+// The Y4M stream has a header and a frame of three full planes for each frame.
+func TestY4MWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	size := testFrame(0).Bounds()
+	yw := newY4MWriter(buf, size, 30)
+	writeFrames(t, yw, 3)
+
+	header := fmt.Sprintf("YUV4MPEG2 W%d H%d F30:1 Ip A1:1 C444 XCOLORRANGE=FULL\n", size.Dx(), size.Dy())
+	frame := len("FRAME\n") + 3*size.Dx()*size.Dy()
+	assert.Equal(t, header, buf.String()[:len(header)])
+	assert.Equal(t, len(header)+3*frame, buf.Len())
+	// the white frame has full luma
+	assert.Equal(t, byte(255), buf.Bytes()[len(header)+frame+len("FRAME\n")])
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/Pitrified/go-firefly"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Overlay layers drawn on top of the fireflies, to show what the parameters mean.
+type overlay struct {
+	radius bool         // Outline the nudge radius around the fireflies.
+	ids    map[int]bool // Fireflies to outline, all of them if empty.
+	grid   bool         // Draw the borders of the cells.
+	bands  bool         // Shade the bands along the borders where the blinks reach the neighbors.
+	counts bool         // Write the number of fireflies in each cell.
+}
+
+// Parse a list of firefly ids separated by ','.
+func parseIds(s string) (map[int]bool, error) {
+	ids := map[int]bool{}
+	if s == "" {
+		return ids, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid firefly id %q: %v", field, err)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// Convert a color of the palette for the image.
+func toRGBA(r *RangeColorHCL, t float64, alpha uint8) color.NRGBA {
+	cr, cg, cb := r.GetBlent(t).Clamped().RGB255()
+	return color.NRGBA{cr, cg, cb, alpha}
+}
+
+// Draw the requested overlay layers on the frame.
+//
+// The fireflies are grouped by cell as in renderFrame.
+func (f *Filmer) drawOverlay(img *image.RGBA, cells [][]firefly.FireflyState) {
+	ov := f.overlay
+	cs := f.cellSize * f.scale
+	W, H := f.frameSize.Dx(), f.frameSize.Dy()
+
+	// the blinks are sent to a neighbor when the firefly is this close to the border
+	borderDist := float32(f.nudgeRadius) / 2
+	if f.w != nil {
+		borderDist = f.w.BorderDist()
+	}
+
+	if ov.bands {
+		band := int(borderDist * float32(f.scale))
+		bandCol := &image.Uniform{toRGBA(elemColor['W'], 0.5, 50)}
+		shade := func(r image.Rectangle) {
+			draw.Draw(img, r, bandCol, image.Point{}, draw.Over)
+		}
+		for i := 0; i < f.cw; i++ {
+			x := i * cs
+			shade(image.Rect(x-band, 0, x+band, H))
+			if x-band < 0 {
+				shade(image.Rect(W+x-band, 0, W, H))
+			}
+		}
+		for i := 0; i < f.ch; i++ {
+			y := i * cs
+			shade(image.Rect(0, y-band, W, y+band))
+			if y-band < 0 {
+				shade(image.Rect(0, H+y-band, W, H))
+			}
+		}
+	}
+
+	if ov.grid {
+		gridCol := toRGBA(elemColor['A'], 1, 255)
+		for i := 0; i < f.cw; i++ {
+			for y := 0; y < H; y++ {
+				img.Set(i*cs, y, gridCol)
+			}
+		}
+		for i := 0; i < f.ch; i++ {
+			for x := 0; x < W; x++ {
+				img.Set(x, i*cs, gridCol)
+			}
+		}
+	}
+
+	if ov.radius {
+		radiusCol := toRGBA(elemColor['W'], 1, 255)
+		for _, cell := range cells {
+			for _, s := range cell {
+				if len(ov.ids) > 0 && !ov.ids[s.Id] {
+					continue
+				}
+				r := float32(f.nudgeRadius)
+				if f.w != nil && f.w.RadiusField != nil {
+					r *= f.w.RadiusField.At(s.X, s.Y)
+				}
+				// the sprite is drawn from its top left corner
+				half := f.templateSize / 2
+				cx := int(s.X*float32(f.scale)) + half
+				cy := int(s.Y*float32(f.scale)) + half
+				f.outlineManhattan(img, cx, cy, int(r*float32(f.scale)), radiusCol)
+			}
+		}
+	}
+
+	if ov.counts {
+		d := &font.Drawer{
+			Dst:  img,
+			Src:  &image.Uniform{toRGBA(elemColor['B'], 1, 255)},
+			Face: basicfont.Face7x13,
+		}
+		for i, cell := range cells {
+			cx, cy := i/f.ch, i%f.ch
+			d.Dot = fixed.P(cx*cs+3, cy*cs+13)
+			d.DrawString(strconv.Itoa(len(cell)))
+		}
+	}
+}
+
+// Outline the points at Manhattan distance r from the center, the distance used by the World.
+//
+// The outline is a diamond, that wraps around the borders unless the world is bounded.
+func (f *Filmer) outlineManhattan(img *image.RGBA, cx, cy, r int, col color.Color) {
+	W, H := f.frameSize.Dx(), f.frameSize.Dy()
+	set := func(x, y int) {
+		if !f.bounded {
+			x, y = (x%W+W)%W, (y%H+H)%H
+		}
+		img.Set(x, y, col)
+	}
+	for t := 0; t <= r; t++ {
+		set(cx+t, cy+r-t)
+		set(cx-t, cy+r-t)
+		set(cx+t, cy-r+t)
+		set(cx-t, cy-r+t)
+	}
+}
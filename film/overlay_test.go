@@ -0,0 +1,125 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/Pitrified/go-firefly"
+	"github.com/stretchr/testify/assert"
+)
+
+// A filmer of 2x1 cells of 10 pixels, drawn at scale 1.
+func testOverlayFilmer(bounded bool, ov overlay) *Filmer {
+	return &Filmer{
+		cellSize:    10,
+		cw:          2,
+		ch:          1,
+		bounded:     bounded,
+		nudgeRadius: 4,
+		overlay:     ov,
+		scale:       1,
+		frameSize:   image.Rect(0, 0, 20, 10),
+	}
+}
+
+// The pixels of img that were drawn.
+func litPixels(img *image.RGBA) map[image.Point]bool {
+	lit := map[image.Point]bool{}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if img.RGBAAt(x, y).A != 0 {
+				lit[image.Pt(x, y)] = true
+			}
+		}
+	}
+	return lit
+}
+
+// The outline is the diamond of the Manhattan distance, wrapped unless the world is bounded.
+func TestOutlineManhattan(t *testing.T) {
+	col := color.RGBA{255, 255, 255, 255}
+
+	f := testOverlayFilmer(true, overlay{})
+	img := image.NewRGBA(f.frameSize)
+	f.outlineManhattan(img, 10, 5, 3, col)
+	lit := litPixels(img)
+	assert.Len(t, lit, 12)
+	for p := range lit {
+		d := p.Sub(image.Pt(10, 5))
+		assert.Equal(t, 3, abs(d.X)+abs(d.Y), "%v", p)
+	}
+
+	// on the corner the diamond wraps around the borders
+	f = testOverlayFilmer(false, overlay{})
+	img = image.NewRGBA(f.frameSize)
+	f.outlineManhattan(img, 1, 1, 3, col)
+	lit = litPixels(img)
+	assert.Len(t, lit, 12)
+	for _, p := range []image.Point{{18, 1}, {1, 8}, {19, 0}, {0, 9}, {4, 1}, {1, 4}} {
+		assert.True(t, lit[p], "%v", p)
+	}
+
+	// or is clipped
+	f = testOverlayFilmer(true, overlay{})
+	img = image.NewRGBA(f.frameSize)
+	f.outlineManhattan(img, 1, 1, 3, col)
+	assert.Equal(t, map[image.Point]bool{
+		{1, 4}: true, {4, 1}: true, {2, 3}: true, {0, 3}: true, {3, 2}: true, {3, 0}: true,
+	}, litPixels(img))
+}
+
+// The grid is on the borders of the cells, the bands around them wrap around the frame.
+func TestDrawOverlay(t *testing.T) {
+	f := testOverlayFilmer(false, overlay{grid: true})
+	img := image.NewRGBA(f.frameSize)
+	f.drawOverlay(img, nil)
+	gridCol := color.RGBAModel.Convert(toRGBA(elemColor['A'], 1, 255))
+	for _, p := range []image.Point{{0, 5}, {10, 5}, {10, 9}, {5, 0}, {19, 0}} {
+		assert.Equal(t, gridCol, img.At(p.X, p.Y), "%v", p)
+	}
+	assert.Len(t, litPixels(img), 2*10+20-2)
+
+	// the blinks reach the neighbors within half the nudge radius of the borders
+	f = testOverlayFilmer(false, overlay{bands: true})
+	img = image.NewRGBA(f.frameSize)
+	f.drawOverlay(img, nil)
+	lit := litPixels(img)
+	for _, p := range []image.Point{{0, 5}, {1, 5}, {18, 5}, {19, 5}, {8, 5}, {11, 5}, {5, 0}, {5, 1}, {5, 8}, {5, 9}} {
+		assert.True(t, lit[p], "%v", p)
+	}
+	for _, p := range []image.Point{{2, 5}, {7, 5}, {12, 5}, {17, 5}, {5, 2}, {5, 7}} {
+		assert.False(t, lit[p], "%v", p)
+	}
+
+	// only the fireflies requested are outlined
+	f = testOverlayFilmer(true, overlay{radius: true, ids: map[int]bool{1: true}})
+	img = image.NewRGBA(f.frameSize)
+	f.drawOverlay(img, [][]firefly.FireflyState{{{Id: 0, X: 5, Y: 5}}, {{Id: 1, X: 15, Y: 5}}})
+	lit = litPixels(img)
+	assert.Len(t, lit, 16)
+	assert.True(t, lit[image.Pt(19, 5)])
+	assert.False(t, lit[image.Pt(9, 5)])
+}
+
+// The ids are integers separated by ','.
+func TestParseIds(t *testing.T) {
+	ids, err := parseIds("")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	ids, err = parseIds(" 3, 4,3")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]bool{3: true, 4: true}, ids)
+
+	for _, s := range []string{"1,x", "1,,2", "1.5", ","} {
+		_, err := parseIds(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Resolutions of the presets, in pixels.
+var presets = map[string]image.Point{
+	"8k":    {7680, 4320},
+	"4k":    {3840, 2160},
+	"1440p": {2560, 1440},
+	"1080p": {1920, 1080},
+	"720p":  {1280, 720},
+	"540p":  {960, 540},
+	"360p":  {640, 360},
+}
+
+// Largest scale tried by the presets.
+const maxPresetScale = 16
+
+// Size of a world that fills the frame of a preset.
+type layout struct {
+	cw, ch   int // Size of the world in cells.
+	cellSize int // Size of each cell in world units.
+	scale    int // Pixels per world unit.
+	nF       int // Fireflies, to keep the requested density.
+}
+
+// Names of the presets, from the largest.
+func presetNames() string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return presets[names[i]].X > presets[names[j]].X })
+	return strings.Join(names, ", ")
+}
+
+// Parse a preset name, or a resolution as 'WxH'.
+func parsePreset(name string) (image.Point, error) {
+	if res, ok := presets[strings.ToLower(name)]; ok {
+		return res, nil
+	}
+	var res image.Point
+	if _, err := fmt.Sscanf(name, "%dx%d", &res.X, &res.Y); err != nil || res.X < 1 || res.Y < 1 {
+		return res, fmt.Errorf("unknown preset %q, use %s or WxH", name, presetNames())
+	}
+	return res, nil
+}
+
+// Find the world that fills the frame of a preset.
+//
+// The world is the requested one, cw x ch cells of cellSize, scaled to the aspect of the frame:
+// its area is kept as far as possible, then the cell size.
+// The number of fireflies changes with the area to keep their density,
+// while the nudge radius is in world units and does not change: the cells are never smaller.
+// If scale is positive only that scale is tried.
+//
+// In the TODO the 4K frame is 3840 = 80 * 16 * 3 by 2160 = 80 * 9 * 3:
+// a world of 16x9 cells of 80 units at scale 3.
+func presetLayout(res image.Point, cw, ch, cd, cellSize, nudgeRadius, nF, scale int) (layout, error) {
+	if res.X > maxFrameSide || res.Y > maxFrameSide {
+		return layout{}, fmt.Errorf("the frame of %dx%d px is larger than %d px", res.X, res.Y, maxFrameSide)
+	}
+	if cw < 1 || ch < 1 || cd < 0 || cellSize < 1 {
+		return layout{}, fmt.Errorf("invalid world of %dx%dx%d cells of %d units", cw, ch, cd, cellSize)
+	}
+	area := float64(cw*cellSize) * float64(ch*cellSize)
+
+	minScale, maxScale := 1, maxPresetScale
+	if scale > 0 {
+		minScale, maxScale = scale, scale
+	}
+	minCell := nudgeRadius
+	if minCell < 1 {
+		minCell = 1
+	}
+
+	var best layout
+	bestArea, bestCell := math.Inf(1), math.Inf(1)
+	for s := minScale; s <= maxScale; s++ {
+		if res.X%s != 0 || res.Y%s != 0 {
+			continue
+		}
+		ww, wh := res.X/s, res.Y/s
+		// how far the area of the world is from the requested one
+		dArea := math.Abs(math.Log(float64(ww) * float64(wh) / area))
+		g := gcd(ww, wh)
+		for cs := minCell; cs <= g; cs++ {
+			if g%cs != 0 {
+				continue
+			}
+			dCell := math.Abs(math.Log(float64(cs) / float64(cellSize)))
+			// the areas of different scales are compared with some slack for the rounding
+			if dArea < bestArea-1e-9 || (dArea < bestArea+1e-9 && dCell < bestCell) {
+				bestArea, bestCell = dArea, dCell
+				best = layout{cw: ww / cs, ch: wh / cs, cellSize: cs, scale: s}
+			}
+		}
+	}
+	if best.scale == 0 {
+		return layout{}, fmt.Errorf("no world with cells of at least %d units fills a frame of %dx%d px", minCell, res.X, res.Y)
+	}
+
+	// the fireflies of a 3D world fill the volume
+	volume := float64(best.cw*best.cellSize) * float64(best.ch*best.cellSize) / area
+	if cd > 0 {
+		volume *= float64(best.cellSize) / float64(cellSize)
+	}
+	best.nF = int(math.Round(float64(nF) * volume))
+
+	if best.cw*best.cellSize*best.scale != res.X || best.ch*best.cellSize*best.scale != res.Y {
+		return layout{}, fmt.Errorf("the world of %dx%d cells of %d units at scale %d does not fit %dx%d px",
+			best.cw, best.ch, best.cellSize, best.scale, res.X, res.Y)
+	}
+	return best, nil
+}
+
+// Greatest common divisor.
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The presets fill the frame with the default world of 16x9 cells of 80 and 1000 fireflies.
+//
+// The 4K rows are the factors in the TODO: 3840 = 80 * 16 * 3 = 60 * 16 * 4 = 48 * 16 * 5 = 40 * 16 * 6.
+func TestPresetLayout(t *testing.T) {
+	for _, tc := range []struct {
+		preset string
+		cd     int
+		scale  int
+		want   layout
+	}{
+		{"4k", 0, 0, layout{cw: 16, ch: 9, cellSize: 80, scale: 3, nF: 1000}},
+		{"4k", 0, 3, layout{cw: 16, ch: 9, cellSize: 80, scale: 3, nF: 1000}},
+		{"4k", 0, 4, layout{cw: 16, ch: 9, cellSize: 60, scale: 4, nF: 563}},
+		{"4k", 0, 5, layout{cw: 16, ch: 9, cellSize: 48, scale: 5, nF: 360}},
+		{"4k", 0, 6, layout{cw: 16, ch: 9, cellSize: 40, scale: 6, nF: 250}},
+		{"1080p", 0, 0, layout{cw: 16, ch: 9, cellSize: 60, scale: 2, nF: 563}},
+		{"720p", 0, 0, layout{cw: 16, ch: 9, cellSize: 80, scale: 1, nF: 1000}},
+		// the fireflies of a 3D world fill the thinner layers too
+		{"4k", 2, 6, layout{cw: 16, ch: 9, cellSize: 40, scale: 6, nF: 125}},
+		// the resolutions not in the presets, the density is kept in a different area
+		{"1280x720", 0, 0, layout{cw: 16, ch: 9, cellSize: 80, scale: 1, nF: 1000}},
+		{"1001x1001", 0, 0, layout{cw: 13, ch: 13, cellSize: 77, scale: 1, nF: 1087}},
+	} {
+		res, err := parsePreset(tc.preset)
+		assert.NoError(t, err)
+		l, err := presetLayout(res, 16, 9, tc.cd, 80, 22, 1000, tc.scale)
+		assert.NoError(t, err, "%+v", tc)
+		// nF is rounded from the area
+		assert.InDelta(t, tc.want.nF, l.nF, 1, "%+v", tc)
+		l.nF = tc.want.nF
+		assert.Equal(t, tc.want, l, "%+v", tc)
+		assert.Equal(t, res, image.Pt(l.cw*l.cellSize*l.scale, l.ch*l.cellSize*l.scale))
+	}
+}
+
+// The presets that cannot be filled are errors.
+func TestPresetLayoutInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		res         image.Point
+		cw, ch      int
+		nudgeRadius int
+		scale       int
+	}{
+		{image.Pt(32768, 100), 16, 9, 22, 0},
+		{image.Pt(1280, 720), 0, 9, 22, 0},
+		// cells of 81 do not fit in the 720p frame
+		{image.Pt(1280, 720), 16, 9, 81, 0},
+		// 7 does not divide the frame
+		{image.Pt(1280, 720), 16, 9, 22, 7},
+		// primes have no cells larger than the nudge radius but the whole side
+		{image.Pt(1009, 1013), 16, 9, 22, 0},
+	} {
+		_, err := presetLayout(tc.res, tc.cw, tc.ch, 0, 80, tc.nudgeRadius, 1000, tc.scale)
+		assert.Error(t, err, "%+v", tc)
+	}
+
+	for _, name := range []string{"5k", "1920x", "0x10", "-4x4"} {
+		_, err := parsePreset(name)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/Pitrified/go-firefly"
+)
+
+// runInfo is saved as run.json next to the frames, to reproduce the film exactly.
+type runInfo struct {
+	Version  string            // Version of the filmer and of the firefly module.
+	Args     []string          // Command line of the film.
+	Flags    filmConfig        // Values of all the flags, defaults included.
+	Config   firefly.Config    // Parameters of the world at the start of the film, seed included.
+	Scenario *firefly.Scenario `json:",omitempty"` // Timeline of changes applied during the film.
+
+	// film parameters
+	Template string  // Template of the fireflies.
+	Fps      int     // Frames per simulated second.
+	Scale    int     // Pixels per world unit.
+	Decay    float64 // Decay rate of the brightness since the blink.
+	LLevels  int     // Lightness levels of the template.
+	Width    int     // Size of the frames in pixels.
+	Height   int
+
+	Clocks []int // Virtual time of each frame (us).
+}
+
+// Path of the run metadata, kept with the frames.
+func (f *Filmer) runPath() string {
+	return filepath.Join(f.outputFolder, "run.json")
+}
+
+// Fill the run metadata with the parameters of the film.
+//
+// When resuming, the metadata of the first run are kept, with the clocks of the frames done.
+func (f *Filmer) startRun(c firefly.Config) {
+	if f.resume {
+		data, err := os.ReadFile(f.runPath())
+		if err == nil {
+			check(json.Unmarshal(data, &f.run))
+			return
+		}
+		if !os.IsNotExist(err) {
+			check(err)
+		}
+	}
+	f.run = runInfo{
+		Version:  version(),
+		Args:     os.Args,
+		Flags:    f.config,
+		Config:   c,
+		Scenario: f.scenario,
+		Template: f.whichTemplate,
+		Fps:      f.fps,
+		Scale:    f.scale,
+		Decay:    f.decay,
+		LLevels:  f.lLevels,
+		Width:    f.frameSize.Dx(),
+		Height:   f.frameSize.Dy(),
+		Clocks:   []int{},
+	}
+	f.saveRun()
+}
+
+// Record the virtual time of a frame.
+func (f *Filmer) recordClock(frameI, clock int) {
+	for len(f.run.Clocks) <= frameI {
+		f.run.Clocks = append(f.run.Clocks, 0)
+	}
+	f.run.Clocks[frameI] = clock
+}
+
+// Write the run metadata.
+func (f *Filmer) saveRun() {
+	data, err := json.MarshalIndent(f.run, "", "  ")
+	check(err)
+	check(os.WriteFile(f.runPath(), data, 0644))
+}
+
+// Version of the filmer, of the firefly module and of the source, as far as the build knows.
+func version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := fmt.Sprintf("%s %s", bi.Main.Path, bi.Main.Version)
+	for _, d := range bi.Deps {
+		if d.Path != "github.com/Pitrified/go-firefly" {
+			continue
+		}
+		v += fmt.Sprintf(", %s %s", d.Path, d.Version)
+		if d.Replace != nil {
+			v += fmt.Sprintf(" => %s %s", d.Replace.Path, d.Replace.Version)
+		}
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" || s.Key == "vcs.modified" {
+			v += fmt.Sprintf(", %s=%s", s.Key, s.Value)
+		}
+	}
+	return v
+}
+
+// Name of a new output folder, from the start time of the film.
+//
+// A suffix is added if the folder exists, so that a film never overwrites another.
+func uniqueFolder(t time.Time) string {
+	base := t.Format("film_20060102_150405")
+	name := base
+	for i := 2; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+}
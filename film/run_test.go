@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Pitrified/go-firefly"
+	"github.com/stretchr/testify/assert"
+)
+
+// A new film never goes in the folder of another.
+func TestUniqueFolder(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+
+	start := time.Date(2021, 6, 5, 22, 30, 15, 0, time.UTC)
+	assert.Equal(t, "film_20210605_223015", uniqueFolder(start))
+	assert.NoError(t, os.Mkdir("film_20210605_223015", 0755))
+	assert.Equal(t, "film_20210605_223015_2", uniqueFolder(start))
+	assert.NoError(t, os.Mkdir("film_20210605_223015_2", 0755))
+	assert.Equal(t, "film_20210605_223015_3", uniqueFolder(start))
+}
+
+// A resumed film keeps the metadata of its first run.
+func TestStartRunResume(t *testing.T) {
+	f := &Filmer{outputFolder: t.TempDir(), whichTemplate: "right", fps: 25, scale: 2}
+	f.startRun(firefly.Config{Seed: 7})
+	f.recordClock(0, 40_000)
+	f.saveRun()
+
+	data, err := os.ReadFile(f.runPath())
+	assert.NoError(t, err)
+	first := runInfo{}
+	assert.NoError(t, json.Unmarshal(data, &first))
+	assert.Equal(t, int64(7), first.Config.Seed)
+	assert.Equal(t, 25, first.Fps)
+
+	// the parameters of the second run are ignored
+	again := &Filmer{outputFolder: f.outputFolder, resume: true, whichTemplate: "left", fps: 60}
+	again.startRun(firefly.Config{Seed: 8})
+	assert.Equal(t, first, again.run)
+
+	// without a run to resume a new one starts
+	fresh := &Filmer{outputFolder: t.TempDir(), resume: true, fps: 60}
+	fresh.startRun(firefly.Config{Seed: 8})
+	assert.Equal(t, 60, fresh.run.Fps)
+	assert.Empty(t, fresh.run.Clocks)
+	assert.FileExists(t, fresh.runPath())
+}
+
+// The clocks are kept in the order of the frames, whatever order they are recorded in.
+func TestRecordClock(t *testing.T) {
+	f := &Filmer{}
+	f.recordClock(2, 120_000)
+	f.recordClock(0, 40_000)
+	f.recordClock(1, 80_000)
+	assert.Equal(t, []int{40_000, 80_000, 120_000}, f.run.Clocks)
+	f.recordClock(1, 90_000)
+	f.recordClock(4, 200_000)
+	assert.Equal(t, []int{40_000, 90_000, 120_000, 0, 200_000}, f.run.Clocks)
+}
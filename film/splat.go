@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Kernel spreading each pixel of a sprite placed between the pixels of the frame.
+type kernel struct {
+	radius int                     // Pixels reached on each side.
+	weight func(d float64) float64 // Weight at distance d from the position of the pixel.
+}
+
+// Kernels of the anti-aliasing, none blits the sprites on the pixel grid.
+var kernels = map[string]*kernel{
+	"none":     nil,
+	"bilinear": {1, func(d float64) float64 { return math.Max(0, 1-math.Abs(d)) }},
+	"gauss":    {2, func(d float64) float64 { return math.Exp(-d * d / (2 * 0.5 * 0.5)) }},
+}
+
+// Get the kernel with the requested name.
+func kernelByName(name string) (*kernel, error) {
+	k, ok := kernels[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown anti-aliasing %q, use none, bilinear or gauss", name)
+	}
+	return k, nil
+}
+
+// Weights of the pixels from -radius+1 to radius, for a position frac past a pixel.
+//
+// The weights sum to 1, so that the sprite keeps its light wherever it is.
+func (k *kernel) weights(frac float64) []float64 {
+	w := make([]float64, 2*k.radius)
+	sum := 0.0
+	for i := range w {
+		w[i] = k.weight(float64(i-k.radius+1) - frac)
+		sum += w[i]
+	}
+	for i := range w {
+		w[i] /= sum
+	}
+	return w
+}
+
+// Spread the sprite in the rectangle sr of src with its top left corner at x, y.
+//
+// Each pixel of the sprite is spread over the pixels around it by the kernel,
+// and add gets each pixel reached with the color premultiplied by the coverage and the coverage.
+func (k *kernel) spread(src *image.RGBA, sr image.Rectangle, x, y float64, add func(p image.Point, acc [4]float64)) {
+	ix, iy := math.Floor(x), math.Floor(y)
+	wx, wy := k.weights(x-ix), k.weights(y-iy)
+
+	// accumulate the color and the coverage of the pixels reached
+	n := sr.Dx()
+	side := n + 2*k.radius - 1
+	acc := make([][4]float64, side*side)
+	for sy := 0; sy < n; sy++ {
+		for sx := 0; sx < n; sx++ {
+			// like draw.Draw, the part of the sprite out of the template is skipped
+			if !image.Pt(sr.Min.X+sx, sr.Min.Y+sy).In(src.Bounds()) {
+				continue
+			}
+			c := src.RGBAAt(sr.Min.X+sx, sr.Min.Y+sy)
+			for j, wj := range wy {
+				for i, wi := range wx {
+					w := wj * wi
+					a := &acc[(sy+j)*side+sx+i]
+					a[0] += w * float64(c.R)
+					a[1] += w * float64(c.G)
+					a[2] += w * float64(c.B)
+					a[3] += w
+				}
+			}
+		}
+	}
+
+	x0, y0 := int(ix)-k.radius+1, int(iy)-k.radius+1
+	for j := 0; j < side; j++ {
+		for i := 0; i < side; i++ {
+			add(image.Pt(x0+i, y0+j), acc[j*side+i])
+		}
+	}
+}
+
+// Spread the sprite on the pixel grid, with its top left corner at x, y.
+func spreadGrid(src *image.RGBA, sr image.Rectangle, x, y float64, add func(p image.Point, acc [4]float64)) {
+	dp := image.Pt(int(x), int(y))
+	for sy := 0; sy < sr.Dy(); sy++ {
+		for sx := 0; sx < sr.Dx(); sx++ {
+			if !image.Pt(sr.Min.X+sx, sr.Min.Y+sy).In(src.Bounds()) {
+				continue
+			}
+			c := src.RGBAAt(sr.Min.X+sx, sr.Min.Y+sy)
+			add(dp.Add(image.Pt(sx, sy)), [4]float64{float64(c.R), float64(c.G), float64(c.B), 1})
+		}
+	}
+}
+
+// Round and clamp a channel to a byte.
+func clamp255(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// Average each block of ss x ss pixels of the supersampled src in dst.
+//
+// The rows are split among goroutines.
+func downsample(dst, src *image.RGBA, ss int) {
+	b := dst.Bounds()
+	rows := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := ss * ss
+			for y := range rows {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					var r, g, bl int
+					for j := 0; j < ss; j++ {
+						for i := 0; i < ss; i++ {
+							c := src.RGBAAt(x*ss+i, y*ss+j)
+							r += int(c.R)
+							g += int(c.G)
+							bl += int(c.B)
+						}
+					}
+					dst.SetRGBA(x, y, color.RGBA{
+						uint8((r + n/2) / n),
+						uint8((g + n/2) / n),
+						uint8((bl + n/2) / n),
+						255,
+					})
+				}
+			}
+		}()
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		rows <- y
+	}
+	close(rows)
+	wg.Wait()
+}
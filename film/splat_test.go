@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The weights of the kernels sum to 1 wherever the sprite is, and follow its position.
+func TestKernelWeights(t *testing.T) {
+	for _, name := range []string{"bilinear", "gauss"} {
+		k, err := kernelByName(name)
+		assert.NoError(t, err)
+		for _, frac := range []float64{0, 0.1, 0.25, 0.5, 0.75, 0.999} {
+			w := k.weights(frac)
+			assert.Len(t, w, 2*k.radius)
+			sum, mean := 0.0, 0.0
+			for i, wi := range w {
+				assert.GreaterOrEqual(t, wi, 0.0)
+				sum += wi
+				mean += wi * float64(i-k.radius+1)
+			}
+			assert.InDelta(t, 1, sum, 1e-12, "%s at %v", name, frac)
+			// the symmetric kernels are centred on the position
+			if name == "bilinear" || frac == 0.5 {
+				assert.InDelta(t, frac, mean, 1e-9, "%s at %v", name, frac)
+			}
+		}
+	}
+
+	k, err := kernelByName("none")
+	assert.NoError(t, err)
+	assert.Nil(t, k)
+	_, err = kernelByName("lanczos")
+	assert.Error(t, err)
+}
+
+// Spreading a sprite keeps its light, and on the grid the pixels are copied.
+func TestSpread(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+	src.SetRGBA(1, 1, color.RGBA{50, 100, 150, 255})
+	total := [4]float64{8*200 + 50, 8*200 + 100, 8*200 + 150, 9}
+
+	for _, name := range []string{"bilinear", "gauss"} {
+		k, _ := kernelByName(name)
+		sum := [4]float64{}
+		k.spread(src, src.Bounds(), 10.3, 20.8, func(p image.Point, acc [4]float64) {
+			for i := range sum {
+				sum[i] += acc[i]
+			}
+		})
+		for i := range sum {
+			assert.InDelta(t, total[i], sum[i], 1e-9, name)
+		}
+	}
+
+	// the part of the sprite out of the template is skipped
+	got := map[image.Point][4]float64{}
+	spreadGrid(src, image.Rect(1, 1, 4, 4), 10.7, 20.2, func(p image.Point, acc [4]float64) { got[p] = acc })
+	assert.Len(t, got, 4)
+	assert.Equal(t, [4]float64{50, 100, 150, 1}, got[image.Pt(10, 20)])
+	assert.Equal(t, [4]float64{200, 200, 200, 1}, got[image.Pt(11, 21)])
+}
+
+// Each block of the supersampled image is averaged.
+func TestDownsample(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	src.SetRGBA(0, 0, color.RGBA{255, 0, 0, 255})
+	src.SetRGBA(1, 1, color.RGBA{0, 255, 0, 255})
+	for x := 2; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			src.SetRGBA(x, y, color.RGBA{10, 20, 30, 255})
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	downsample(dst, src, 2)
+	assert.Equal(t, color.RGBA{64, 64, 0, 255}, dst.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{10, 20, 30, 255}, dst.RGBAAt(1, 0))
+}
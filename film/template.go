@@ -134,20 +134,25 @@ func remapOri(o int16) int16 {
 
 }
 
-// Generate an image with all the needed fireflies to use.
-// horizontal change the luminosity
-// vertical change the rotation
-func genBlitMap(lLevels int, whichTemplate string) *image.RGBA {
-
-	var templateFirefly [][][]byte
+// Get the template with the requested name.
+func templateByName(whichTemplate string) [][][]byte {
 	switch whichTemplate {
 	case "F3":
-		templateFirefly = TemplateFirefly3
+		return TemplateFirefly3
 	case "F5":
-		templateFirefly = TemplateFirefly5
+		return TemplateFirefly5
 	case "L5":
-		templateFirefly = TemplateSpherical5
+		return TemplateSpherical5
 	}
+	return nil
+}
+
+// Generate an image with all the needed fireflies to use.
+// horizontal change the luminosity
+// vertical change the rotation
+func genBlitMap(lLevels int, whichTemplate string) *image.RGBA {
+
+	templateFirefly := templateByName(whichTemplate)
 
 	numTemplates := len(templateFirefly)
 	fSize := len(templateFirefly[0])
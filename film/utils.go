@@ -6,6 +6,8 @@ import (
 	"image/png"
 	"math"
 	"os"
+	"strconv"
+	"strings"
 
 	"golang.org/x/image/draw"
 )
@@ -44,3 +46,48 @@ func check(e error) {
 		panic(e)
 	}
 }
+
+// A pacemaker requested on the command line.
+type pacemakerSpec struct {
+	x, y     float32
+	period   int   // Period of the flashes (us).
+	schedule []int // Virtual times of the flashes (us), for scripted stimuli.
+}
+
+// Parse a list of pacemakers separated by ';'.
+//
+// Each pacemaker is 'x,y,period' with the period in seconds,
+// or 'x,y,t1,t2,...' with the times of the flashes in seconds if scripted is true.
+func parsePacemakers(s string, scripted bool) ([]pacemakerSpec, error) {
+	specs := []pacemakerSpec{}
+	if s == "" {
+		return specs, nil
+	}
+	for _, ps := range strings.Split(s, ";") {
+		fields := strings.Split(ps, ",")
+		if len(fields) < 3 || (!scripted && len(fields) != 3) {
+			return nil, fmt.Errorf("invalid pacemaker %q", ps)
+		}
+		vals := make([]float64, len(fields))
+		for i, field := range fields {
+			v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pacemaker %q: %v", ps, err)
+			}
+			vals[i] = v
+		}
+		p := pacemakerSpec{x: float32(vals[0]), y: float32(vals[1])}
+		if scripted {
+			for _, t := range vals[2:] {
+				p.schedule = append(p.schedule, int(t*1_000_000))
+			}
+		} else {
+			p.period = int(vals[2] * 1_000_000)
+			if p.period <= 0 {
+				return nil, fmt.Errorf("invalid pacemaker %q: the period must be positive", ps)
+			}
+		}
+		specs = append(specs, p)
+	}
+	return specs, nil
+}
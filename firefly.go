@@ -1,21 +1,32 @@
 package firefly
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+)
 
 // Firefly represents a firefly in the environment.
 type Firefly struct {
 	X, Y float32 // Position on the map.
+	Z    float32 // Depth in a 3D world, 0 in a flat one.
 	O    int16   // Orientation in degrees.
+	P    int16   // Pitch in degrees in a 3D world, in [-90, 90], 0 in a flat one.
 
 	Id int // Unique id of the firefly.
 
 	c *Cell  // Cell currently occupied.
 	w *World // World this firefly is in.
 
-	Period    int  // Period between blinks for this firefly (us).
-	LastBlink int  // Virtual time of the last blink (us).
-	NextBlink int  // Virtual time of the next scheduled blink (us).
-	nudgeable bool // True if the firefly timer can be nudged.
+	Period     int  // Period between blinks for this firefly (us).
+	BasePeriod int  // Period before the modulation of the PeriodField (us).
+	LastBlink  int  // Virtual time of the last blink (us).
+	NextBlink  int  // Virtual time of the next scheduled blink (us).
+	nudgeable  bool // True if the firefly timer can be nudged.
+
+	Born  int // Virtual time of birth (us).
+	Death int // Virtual time of death (us), 0 if the firefly never dies.
+
+	Pacemaker *Pacemaker // Schedule of the flashes if this is a pacemaker, nil otherwise.
 }
 
 // Create a new firefly.
@@ -28,26 +39,63 @@ func NewFirefly(
 	period int,
 	w *World,
 ) *Firefly {
+	return NewFirefly3D(x, y, 0, o, id, period, w)
+}
+
+// Create a new firefly at depth z, with a random pitch in a 3D world.
+//
+// NOTE: The World must already be listening on chChangeCell.
+func NewFirefly3D(
+	x, y, z float32,
+	o int16,
+	id int,
+	period int,
+	w *World,
+) *Firefly {
+	f := newFirefly(x, y, z, o, id, period, w)
+	f.w.EnterCell(f, f.c)
+	return f
+}
+
+// Create a new firefly, without entering the cell.
+func newFirefly(
+	x, y, z float32,
+	o int16,
+	id int,
+	period int,
+	w *World,
+) *Firefly {
 
 	// create the firefly
 	f := &Firefly{}
 	f.w = w
-	f.X, f.Y = f.w.validatePos(x, y)
+	f.X, f.Y, f.Z = f.w.validatePos(x, y, z)
 	f.O = ValidateOri(o)
 	f.Id = id
+	if id >= w.nextID {
+		w.nextID = id + 1
+	}
+
+	// the pitch is drawn so that the directions are uniform on the sphere
+	if w.CellDNum > 0 {
+		f.P = int16(math.Asin(2*w.rng.Float64()-1) * 180 / math.Pi)
+	}
 
 	// find the the right cell
-	cx := int(f.X / f.w.CellSize)
-	cy := int(f.Y / f.w.CellSize)
-	c := f.w.Cells[cx][cy]
-	f.c = c
-	f.w.EnterCell(f, c)
-
-	// setup the period and deadlines
-	f.Period = period
-	f.SetNextBlink(w.Clock + RandRangeInt(1000, f.Period))
+	f.c = f.w.cellAt(f.X, f.Y, f.Z)
+
+	// setup the period and deadlines, with a random phase
+	f.BasePeriod = period
+	f.Period = w.periodAt(f)
+	f.SetNextBlink(w.Clock + w.rng.RangeInt(1000, f.Period))
 	f.ResetNudgeable()
 
+	// setup the lifespan
+	f.Born = w.Clock
+	if w.Lifecycle != nil {
+		f.Death = w.Lifecycle.deathTime(w)
+	}
+
 	return f
 }
 
@@ -56,56 +104,102 @@ func NewFirefly(
 // Return a ChangeCellReq if needed, nil if it stays in the same cell.
 func (f *Firefly) Move() *ChangeCellReq {
 
+	// pacemakers stay where they are placed
+	if f.Pacemaker != nil {
+		return nil
+	}
+
 	// change orientation sometimes
-	newO := f.O + RandRangeInt16(-1, 1)
+	// the draw depends only on the seed, so that each world is reproducible
+	newO := f.O + int16(HashUnit(f.w.Seed, f.Id, f.w.Clock)*3) - 1
 	f.O = ValidateOri(newO)
+	if f.w.CellDNum > 0 {
+		f.P += int16(HashUnit(f.w.Seed, f.Id, f.w.Clock, 1)*3) - 1
+		// going over the pole turns the firefly around
+		if f.P > 90 {
+			f.P = 180 - f.P
+			f.O = ValidateOri(f.O + 180)
+		} else if f.P < -90 {
+			f.P = -180 - f.P
+			f.O = ValidateOri(f.O + 180)
+		}
+	}
 
 	// move and validate the pos
-	f.X += cCos[f.O]
-	f.Y += cSin[f.O]
-	f.X, f.Y = f.w.validatePos(f.X, f.Y)
+	// the pitch is 0 in a flat world, the firefly moves only horizontally
+	speed := f.w.speedAt(f)
+	pitch := ValidateOri(f.P)
+	f.X += cCos[f.O] * cCos[pitch] * speed
+	f.Y += cSin[f.O] * cCos[pitch] * speed
+	f.Z += cSin[pitch] * speed
+	if f.w.Bounded {
+		f.bounce()
+	}
+	f.X, f.Y, f.Z = f.w.validatePos(f.X, f.Y, f.Z)
+
+	// the period follows the local field
+	if f.w.PeriodContinuous {
+		f.Period = f.w.periodAt(f)
+	}
 
 	// change cell if needed
+	// the cell is found from the position, as it might have wrapped around the torus
 	r := (*ChangeCellReq)(nil)
-	changed := false
-	dx, dy := 0, 0
-	if f.X < f.c.left {
-		// move to the cell to the left
-		changed = true
-		dx = -1
-	} else if f.X > f.c.right {
-		// move to the cell to the right
-		changed = true
-		dx = 1
-	}
-	if f.Y < f.c.bottom {
-		// move to the cell to the bottom
-		changed = true
-		dy = -1
-	} else if f.Y > f.c.top {
-		// move to the cell to the top
-		changed = true
-		dy = 1
-	}
-	if changed {
-		// find the new cell and request to move there
-		ncx, ncy := f.w.MoveWrapCell(f.c.Cx, f.c.Cy, dx, dy)
-		r = &ChangeCellReq{f, f.c, f.w.Cells[ncx][ncy]}
+	if nc := f.w.cellAt(f.X, f.Y, f.Z); nc != f.c {
+		r = &ChangeCellReq{f, f.c, nc}
 	}
 
 	return r
 }
 
-// Nudge the internal deadline, if the other Firefly is close.
+// Reflect the firefly off the walls of a bounded world.
+func (f *Firefly) bounce() {
+	w := f.w
+	if f.X < 0 || f.X >= w.SizeW {
+		f.X = reflectCoord(f.X, w.SizeW)
+		f.O = ValidateOri(180 - f.O)
+	}
+	if f.Y < 0 || f.Y >= w.SizeH {
+		f.Y = reflectCoord(f.Y, w.SizeH)
+		f.O = ValidateOri(-f.O)
+	}
+	if w.CellDNum > 0 && (f.Z < 0 || f.Z >= w.SizeD) {
+		f.Z = reflectCoord(f.Z, w.SizeD)
+		f.P = -f.P
+	}
+}
+
+// Nudge the internal deadline, if the other Firefly is close and seen.
+//
+// The amount of the nudge depends on the distance, according to the Perception of the World,
+// and the direction on the Coupling of the World.
+//
+// Pacemakers are never nudged.
 //
 // Return true if this firefly blinked.
 func (f *Firefly) Nudge(fOther *Firefly) bool {
-	if f.w.ManhattanDist(f, fOther) < f.w.NudgeRadius {
-		f.NextBlink -= f.w.NudgeAmount
+	if f.Pacemaker != nil {
+		return false
+	}
+	d := f.w.ManhattanDist(f, fOther)
+	r := f.w.radiusAt(f)
+	if d < r && f.w.detects(f, fOther) {
+		f.applyNudge(f.w.perceive(d, r))
 	}
 	return f.CheckBlink()
 }
 
+// Check if the firefly blinks on her own with the current clock.
+//
+// Pacemakers flash on their own schedule, and only act as senders.
+func (f *Firefly) blinkOnOwn() bool {
+	if f.Pacemaker != nil {
+		return f.Pacemaker.flash(f)
+	}
+	f.ResetNudgeable()
+	return f.nudgeable && f.CheckBlink()
+}
+
 // Check if the deadline is before the clock.
 //
 // Return true if the firefly blinked.
@@ -123,8 +217,8 @@ func (f *Firefly) CheckBlink() bool {
 
 // Reset the nudgeable status of the Firefly using the current clock.
 func (f *Firefly) ResetNudgeable() {
-	// if it is already nudgeable no problem
-	if f.nudgeable {
+	// if it is already nudgeable no problem, pacemakers never are
+	if f.nudgeable || f.Pacemaker != nil {
 		return
 	}
 	// check if enough time has passed since the last blink
@@ -10,7 +10,7 @@ import (
 func TestStringFirefly(t *testing.T) {
 	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
 	f := NewFirefly(0, 0, 0, 0, 1000000, w)
-	f.String()
+	_ = f.String()
 }
 
 func TestCheckBlink(t *testing.T) {
@@ -0,0 +1,50 @@
+package firefly
+
+import "sort"
+
+// FireflyState is a copy of the state of a firefly, detached from the World.
+type FireflyState struct {
+	Id        int     // Unique id of the firefly.
+	X, Y      float32 // Position on the map.
+	Z         float32 `json:",omitempty"` // Depth in a 3D world.
+	O         int16   // Orientation in degrees.
+	P         int16   `json:",omitempty"` // Pitch in degrees in a 3D world.
+	Period    int     // Period between blinks (us).
+	LastBlink int     // Virtual time of the last blink (us).
+}
+
+// Frame is the state of all the fireflies at a virtual time.
+type Frame struct {
+	Clock     int            // Virtual time of the frame (us).
+	Fireflies []FireflyState // State of the fireflies, sorted by id.
+}
+
+// State returns a copy of the state of the firefly.
+func (f *Firefly) State() FireflyState {
+	return FireflyState{
+		Id:        f.Id,
+		X:         f.X,
+		Y:         f.Y,
+		Z:         f.Z,
+		O:         f.O,
+		P:         f.P,
+		Period:    f.Period,
+		LastBlink: f.LastBlink,
+	}
+}
+
+// Frame returns the state of all the fireflies, pacemakers included.
+//
+// Must be called between steps.
+func (w *World) Frame() *Frame {
+	fr := &Frame{Clock: w.Clock}
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			fr.Fireflies = append(fr.Fireflies, f.State())
+		}
+	}
+	sort.Slice(fr.Fireflies, func(i, j int) bool {
+		return fr.Fireflies[i].Id < fr.Fireflies[j].Id
+	})
+	return fr
+}
@@ -0,0 +1,275 @@
+package firefly
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Graph is an explicit interaction topology between fireflies.
+//
+// The nodes are the ids of the fireflies: a blink nudges only the graph neighbours,
+// regardless of the distance between the fireflies.
+type Graph struct {
+	N   int     // Number of nodes.
+	Adj [][]int // Neighbours of each node.
+}
+
+// NewGraph creates a Graph with n nodes and no edges.
+func NewGraph(n int) *Graph {
+	g := &Graph{}
+	g.N = n
+	g.Adj = make([][]int, n)
+	return g
+}
+
+// AddEdge connects the nodes a and b, ignoring self loops and duplicate edges.
+func (g *Graph) AddEdge(a, b int) {
+	if a == b || g.HasEdge(a, b) {
+		return
+	}
+	g.Adj[a] = append(g.Adj[a], b)
+	g.Adj[b] = append(g.Adj[b], a)
+}
+
+// HasEdge is true if a and b are connected.
+func (g *Graph) HasEdge(a, b int) bool {
+	for _, n := range g.Adj[a] {
+		if n == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Edges returns the number of edges in the graph.
+func (g *Graph) Edges() int {
+	tot := 0
+	for _, adj := range g.Adj {
+		tot += len(adj)
+	}
+	return tot / 2
+}
+
+// NewRingGraph creates a ring lattice, with each node connected to its k nearest neighbours on each side.
+func NewRingGraph(n, k int) *Graph {
+	g := NewGraph(n)
+	for i := 0; i < n; i++ {
+		for j := 1; j <= k; j++ {
+			g.AddEdge(i, (i+j)%n)
+		}
+	}
+	return g
+}
+
+// NewSmallWorldGraph creates a Watts-Strogatz small-world graph:
+// a ring lattice with each edge rewired to a random node with probability p.
+func NewSmallWorldGraph(n, k int, p float64, rng *Rand) *Graph {
+	g := NewGraph(n)
+	for i := 0; i < n; i++ {
+		for j := 1; j <= k; j++ {
+			b := (i + j) % n
+			if rng.Float64() < p {
+				// pick a new endpoint, avoiding loops and duplicates
+				for tries := 0; tries < n; tries++ {
+					c := rng.Intn(n)
+					if c != i && !g.HasEdge(i, c) {
+						b = c
+						break
+					}
+				}
+			}
+			g.AddEdge(i, b)
+		}
+	}
+	return g
+}
+
+// NewScaleFreeGraph creates a Barabasi-Albert scale-free graph:
+// each new node connects to m existing nodes, picked proportionally to their degree.
+func NewScaleFreeGraph(n, m int, rng *Rand) *Graph {
+	g := NewGraph(n)
+	if n == 0 {
+		return g
+	}
+	if m < 1 {
+		m = 1
+	}
+	// the first nodes are fully connected
+	start := m + 1
+	if start > n {
+		start = n
+	}
+	ends := []int{}
+	for i := 0; i < start; i++ {
+		for j := i + 1; j < start; j++ {
+			g.AddEdge(i, j)
+			ends = append(ends, i, j)
+		}
+	}
+	// each node appears in ends once per edge, so a uniform pick follows the degree
+	for i := start; i < n; i++ {
+		for len(g.Adj[i]) < m {
+			g.AddEdge(i, ends[rng.Intn(len(ends))])
+		}
+		for _, j := range g.Adj[i] {
+			ends = append(ends, i, j)
+		}
+	}
+	return g
+}
+
+// LoadEdgeList reads a Graph from an edge list file.
+func LoadEdgeList(path string) (*Graph, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadEdgeList(f)
+}
+
+// ReadEdgeList decodes a Graph from an edge list:
+// a pair of node ids per line, blank lines and lines starting with # are skipped.
+//
+// The graph has as many nodes as the largest id plus one.
+func ReadEdgeList(r io.Reader) (*Graph, error) {
+	edges := [][2]int{}
+	n := 0
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("edge list: line %d: expected two nodes", line)
+		}
+		var e [2]int
+		for i := range e {
+			v, err := strconv.Atoi(fields[i])
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("edge list: line %d: invalid node %q", line, fields[i])
+			}
+			e[i] = v
+			if v >= n {
+				n = v + 1
+			}
+		}
+		edges = append(edges, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	g := NewGraph(n)
+	for _, e := range edges {
+		g.AddEdge(e[0], e[1])
+	}
+	return g, nil
+}
+
+// ParseGraphSpec creates a Graph from a spec, either an edge list file
+// or a generator with its parameters:
+//
+//	ring,n,k          ring lattice
+//	smallworld,n,k,p  Watts-Strogatz small-world
+//	scalefree,n,m     Barabasi-Albert scale-free
+func ParseGraphSpec(spec string, rng *Rand) (*Graph, error) {
+	parts := strings.Split(spec, ",")
+	args := make([]float64, len(parts)-1)
+	for i, p := range parts[1:] {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("graph spec %q: %v", spec, err)
+		}
+		args[i] = v
+	}
+	want := map[string]int{"ring": 2, "smallworld": 3, "scalefree": 2}
+	nArgs, ok := want[parts[0]]
+	if !ok {
+		if len(parts) > 1 {
+			return nil, fmt.Errorf("graph spec %q: unknown generator %q", spec, parts[0])
+		}
+		return LoadEdgeList(spec)
+	}
+	if len(args) != nArgs {
+		return nil, fmt.Errorf("graph spec %q: %s needs %d parameters", spec, parts[0], nArgs)
+	}
+	if args[0] < 1 {
+		return nil, fmt.Errorf("graph spec %q: at least one node is needed", spec)
+	}
+
+	switch parts[0] {
+	case "ring":
+		return NewRingGraph(int(args[0]), int(args[1])), nil
+	case "smallworld":
+		return NewSmallWorldGraph(int(args[0]), int(args[1]), args[2], rng), nil
+	default:
+		return NewScaleFreeGraph(int(args[0]), int(args[1]), rng), nil
+	}
+}
+
+// SetGraph switches the World to graph mode, hatching a firefly for each node.
+//
+// The fireflies are placed on a circle, at half the depth of a 3D world, and do not move nor age:
+// a blink nudges the graph neighbours instead of the fireflies nearby.
+// Must be called on an empty World, between steps.
+func (w *World) SetGraph(g *Graph) {
+	w.Graph = g
+	w.nodes = make([]*Firefly, g.N)
+	cx, cy := w.SizeW/2, w.SizeH/2
+	r := 0.4 * float64(w.SizeH)
+	if w.SizeW < w.SizeH {
+		r = 0.4 * float64(w.SizeW)
+	}
+	for i := 0; i < g.N; i++ {
+		a := 2 * math.Pi * float64(i) / float64(g.N)
+		x := cx + float32(r*math.Cos(a))
+		y := cy + float32(r*math.Sin(a))
+		p := w.rng.RangeInt(w.PeriodMin, w.PeriodMax)
+		f := newFirefly(x, y, w.sizeHalfD, 0, i, p, w)
+		w.ChangeCell(&ChangeCellReq{f, nil, f.c})
+		w.nodes[i] = f
+	}
+}
+
+// Blink the fireflies of the graph with the current clock,
+// and cascade the blinks along the edges.
+func (w *World) graphBlink() {
+	queue := []*Firefly{}
+	for _, f := range w.nodes {
+		f.ResetNudgeable()
+		if f.nudgeable && f.CheckBlink() {
+			queue = append(queue, f)
+		}
+	}
+	for len(queue) > 0 {
+		fBlink := queue[0]
+		queue = queue[1:]
+		for _, n := range w.Graph.Adj[fBlink.Id] {
+			fOther := w.nodes[n]
+			if !fOther.nudgeable {
+				continue
+			}
+			if fOther.NudgeNeighbour(fBlink) {
+				queue = append(queue, fOther)
+			}
+		}
+	}
+}
+
+// NudgeNeighbour nudges the firefly after a graph neighbour blinked, at full strength.
+//
+// Return true if the firefly blinked.
+func (f *Firefly) NudgeNeighbour(fOther *Firefly) bool {
+	if f.w.detects(f, fOther) {
+		f.applyNudge(1)
+	}
+	return f.CheckBlink()
+}
@@ -0,0 +1,90 @@
+package firefly
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The generators build graphs with the expected degrees.
+func TestGraphGenerators(t *testing.T) {
+	g := NewRingGraph(10, 2)
+	assert.Equal(t, 20, g.Edges())
+	for i := 0; i < g.N; i++ {
+		assert.Len(t, g.Adj[i], 4)
+	}
+	assert.True(t, g.HasEdge(0, 9))
+	assert.False(t, g.HasEdge(0, 5))
+
+	// without rewiring a small world is a ring
+	sw := NewSmallWorldGraph(10, 2, 0, NewRand(1))
+	assert.Equal(t, g.Edges(), sw.Edges())
+	sw = NewSmallWorldGraph(100, 2, 0.2, NewRand(1))
+	assert.InDelta(t, 200, sw.Edges(), 10)
+
+	sf := NewScaleFreeGraph(100, 2, NewRand(1))
+	assert.Equal(t, 3+97*2, sf.Edges())
+	maxDeg := 0
+	for i := 0; i < sf.N; i++ {
+		assert.GreaterOrEqual(t, len(sf.Adj[i]), 2)
+		if len(sf.Adj[i]) > maxDeg {
+			maxDeg = len(sf.Adj[i])
+		}
+	}
+	assert.Greater(t, maxDeg, 10, "The early nodes become hubs.")
+}
+
+// Edge lists skip comments, and bad lines are errors.
+func TestReadEdgeList(t *testing.T) {
+	g, err := ReadEdgeList(strings.NewReader("# a triangle\n0 1\n1 2\n\n2 0\n0 1\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, g.N)
+	assert.Equal(t, 3, g.Edges())
+
+	_, err = ReadEdgeList(strings.NewReader("0 1\n1\n"))
+	assert.Error(t, err)
+	_, err = ReadEdgeList(strings.NewReader("0 -1\n"))
+	assert.Error(t, err)
+
+	g, err = ParseGraphSpec("smallworld,20,2,0.1", NewRand(3))
+	assert.NoError(t, err)
+	assert.Equal(t, 20, g.N)
+	_, err = ParseGraphSpec("ring,20", NewRand(3))
+	assert.Error(t, err)
+	_, err = ParseGraphSpec("tree,20,2", NewRand(3))
+	assert.Error(t, err)
+}
+
+// A blink nudges only the graph neighbours, and the cascade follows the edges.
+func TestGraphBlink(t *testing.T) {
+	w := NewWorld(4, 4, 50, 1_000_000, 25_000, 100_000, 5, 500_000, 1_000_000, 1_000_000)
+	w.SetGraph(NewRingGraph(10, 1))
+	assert.Equal(t, 10, w.Population())
+
+	for _, f := range w.nodes {
+		f.SetNextBlink(w.Clock + 500_000)
+		f.nudgeable = true
+	}
+	// 0 blinks on its own, 1 and 2 follow along the ring, 3 is too far in time
+	w.nodes[0].SetNextBlink(w.Clock + 10_000)
+	w.nodes[1].SetNextBlink(w.Clock + 100_000)
+	w.nodes[2].SetNextBlink(w.Clock + 120_000)
+	w.nodes[3].SetNextBlink(w.Clock + 300_000)
+	// 5 would blink if nudged, but it is not a neighbour
+	w.nodes[5].SetNextBlink(w.Clock + 50_000)
+	x, y := w.nodes[0].X, w.nodes[0].Y
+
+	w.Step()
+	// after a blink the next one is a period away
+	blinked := func(i int) bool { return w.nodes[i].NextBlink > w.Clock+600_000 }
+	assert.True(t, blinked(0))
+	assert.True(t, blinked(1))
+	assert.True(t, blinked(2))
+	assert.False(t, blinked(3))
+	assert.False(t, blinked(5))
+
+	// the nodes do not move
+	assert.Equal(t, x, w.nodes[0].X)
+	assert.Equal(t, y, w.nodes[0].Y)
+}
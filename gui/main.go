@@ -1,12 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"math"
 	"math/rand"
+	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -50,6 +53,9 @@ type mySidebar struct {
 	confNRdec    *widget.Button
 	confDrawGrid *widget.Check
 	confInteract *widget.Check
+	confLife     *widget.Check
+	confCoupling *widget.Select
+	confPopLab   *widget.Label
 	confRequest  bool
 	nudgeRadius  int
 
@@ -63,9 +69,15 @@ type mySidebar struct {
 	resRequest  bool
 
 	miscCard   *widget.Card
+	miscField  *widget.Check
 	miscFull   *widget.Button
 	miscCredit *widget.Button
 	miscHelp   *widget.Button
+
+	repCard   *widget.Card
+	repSlider *widget.Slider
+	repPlay   *widget.Button
+	repLab    *widget.Label
 }
 
 func newSidebar(a *myApp) *mySidebar {
@@ -74,13 +86,18 @@ func newSidebar(a *myApp) *mySidebar {
 
 // Build the sidebar.
 func (s *mySidebar) buildSidebar() *container.Scroll {
-	contSidebar := container.NewVScroll(
-		container.NewVBox(
-			s.buildConfig(),
-			s.buildReset(),
-			s.buildMisc(),
-		),
+	contCards := container.NewVBox(
+		s.buildConfig(),
+		s.buildReset(),
+		s.buildMisc(),
 	)
+	// a replayed trace can not be changed, only scrubbed
+	if s.a.replay != nil {
+		s.confCard.Hide()
+		s.resCard.Hide()
+		contCards.Add(s.buildReplay())
+	}
+	contSidebar := container.NewVScroll(contCards)
 	return contSidebar
 }
 
@@ -101,6 +118,8 @@ func (s *mySidebar) initSidebar() {
 // * nudgeRadius
 // * blinkCooldown
 // * interact fireflies
+// * birth and death of the fireflies
+// * coupling mode
 func (s *mySidebar) buildConfig() *widget.Card {
 
 	// button to reset world
@@ -144,10 +163,32 @@ func (s *mySidebar) buildConfig() *widget.Card {
 	)
 	s.nradOnChanged(0)
 
+	// birth and death, and the resulting population
+	s.confLife = widget.NewCheck("Birth and death", s.confConfigChecked)
+	s.confPopLab = widget.NewLabel("")
+	contLife := container.NewGridWithColumns(2, s.confLife, s.confPopLab)
+
+	// coupling mode
+	s.confCoupling = widget.NewSelect(
+		[]string{
+			firefly.CouplingExcitatory.String(),
+			firefly.CouplingInhibitory.String(),
+			firefly.CouplingReset.String(),
+		},
+		s.confCouplingSelected,
+	)
+	s.confCoupling.Selected = firefly.CouplingExcitatory.String()
+	contCoupling := container.NewBorder(
+		nil, nil, widget.NewLabel("Coupling:"), nil,
+		s.confCoupling,
+	)
+
 	contCard := container.NewVBox(
 		contFireNum,
 		contNAmount,
 		contNRadius,
+		contLife,
+		contCoupling,
 		s.confApply,
 	)
 	s.confCard = widget.NewCard("Config", "", contCard)
@@ -169,6 +210,11 @@ func (s *mySidebar) confConfigChecked(state bool) {
 	s.confRequest = true
 }
 
+// Selected a coupling mode in the world config card.
+func (s *mySidebar) confCouplingSelected(_ string) {
+	s.confRequest = true
+}
+
 // Dragged the nudge radius slider. FIXME
 func (s *mySidebar) nradOnChanged(i int) {
 	fmt.Printf("nradOnChanged = %+v\n", i)
@@ -283,9 +329,12 @@ func (s *mySidebar) resResetSubmitted(_ string) {
 // Set misc params.
 //
 // * drawCheckerboard
+// * show field overlay
 func (s *mySidebar) buildMisc() *widget.Card {
 	// draw grid
 	s.confDrawGrid = widget.NewCheck("Draw cell grid", s.confConfigChecked)
+	// show the parameter field
+	s.miscField = widget.NewCheck("Show field", s.confConfigChecked)
 	// fullscreen button
 	s.miscFull = widget.NewButton("Fullscreen", s.toggleFullscreen)
 	// credits window
@@ -298,6 +347,9 @@ func (s *mySidebar) buildMisc() *widget.Card {
 			s.confDrawGrid,
 			s.miscHelp,
 		),
+		container.NewGridWithColumns(2,
+			s.miscField,
+		),
 		container.NewGridWithColumns(2,
 			s.miscFull,
 			s.miscCredit,
@@ -307,6 +359,44 @@ func (s *mySidebar) buildMisc() *widget.Card {
 	return s.miscCard
 }
 
+// ##### REPLAY #####
+
+// Scrub through a recorded trace.
+func (s *mySidebar) buildReplay() *widget.Card {
+	// slider to pick the frame
+	s.repSlider = widget.NewSlider(0, float64(len(s.a.replay)-1))
+	s.repSlider.OnChanged = s.repSliderChanged
+	// play/pause button
+	s.repPlay = widget.NewButton("Pause", s.repPlayCB)
+	// current frame and time
+	s.repLab = widget.NewLabel("")
+
+	contCard := container.NewVBox(
+		s.repSlider,
+		container.NewGridWithColumns(2,
+			s.repPlay,
+			s.repLab,
+		),
+	)
+	s.repCard = widget.NewCard("Replay", "", contCard)
+	return s.repCard
+}
+
+// Moved the replay slider.
+func (s *mySidebar) repSliderChanged(v float64) {
+	s.a.replayI = int(v)
+}
+
+// Clicked button play/pause the replay.
+func (s *mySidebar) repPlayCB() {
+	s.a.replayPlay = !s.a.replayPlay
+	if s.a.replayPlay {
+		s.repPlay.SetText("Pause")
+	} else {
+		s.repPlay.SetText("Play")
+	}
+}
+
 // Clicked button toggle fullscreen.
 func (s *mySidebar) toggleFullscreen() {
 	newState := !s.a.mainWin.FullScreen()
@@ -366,6 +456,8 @@ type myApp struct {
 	wCellSize int             // Size of each cell as int.
 	wCellW    int             // Width of the world in cells.
 	wCellH    int             // Height of the world in cells.
+	wCellD    int             // Depth of the world in cells, 0 for a flat world.
+	wBounded  bool            // The fireflies bounce off the walls.
 
 	clockTickLen  int
 	nudgeAmount   int
@@ -375,10 +467,25 @@ type myApp struct {
 	periodMax     int
 	nF            int
 	nFold         int
-	newFId        int
+	lifecycle     bool
+	coupling      firefly.Coupling
+
+	fieldSpecs   map[string]string // Parameter fields, by name.
+	fieldCont    bool              // Apply the period field at every step.
+	fieldShow    string            // Name of the field to show.
+	fieldOverlay *image.RGBA       // Rendered field to show.
+	showField    bool              // Show the field overlay.
+
+	scenario *firefly.Scenario       // Timeline of changes, restarted with the world.
+	runner   *firefly.ScenarioRunner // Runner applying the scenario to the current world.
+
+	replay     []*firefly.Frame // Frames of the recorded trace to replay.
+	replayI    int              // Index of the frame to show.
+	replayPlay bool             // Advance the replay.
 
 	decay         float64 // Decay rate of the brightness since the blink.
 	drawGrid      bool    // Draw the cell grid.
+	antialias     bool    // Draw the fireflies between the pixels.
 	doInteraction bool    // Do the interactions between fireflies.
 }
 
@@ -440,15 +547,19 @@ func (a *myApp) resetWorld() {
 	a.resetRead()
 
 	// create a new world
-	a.w = firefly.NewWorld(
-		a.wCellW, a.wCellH, float32(a.wCellSize),
+	a.w = firefly.NewWorld3D(
+		a.wCellW, a.wCellH, a.wCellD, float32(a.wCellSize),
 		1_000_000, a.clockTickLen,
 		a.nudgeAmount, a.nudgeRadius,
 		a.blinkCooldown,
 		a.periodMin, a.periodMax,
 	)
+	a.w.Bounded = a.wBounded
+	a.setupFields()
 	a.w.HatchFireflies(a.nF)
-	a.newFId = a.nF + 1
+	if a.scenario != nil {
+		a.runner = firefly.NewScenarioRunner(a.scenario)
+	}
 
 	// mark the request as done
 	a.s.resRequest = false
@@ -482,6 +593,74 @@ func (a *myApp) resetRead() {
 
 }
 
+// Load the parameter fields in the world, and render the overlay to show.
+func (a *myApp) setupFields() {
+	a.fieldOverlay = nil
+	fields := map[string]*firefly.Field{}
+	for name, spec := range a.fieldSpecs {
+		if spec == "" {
+			continue
+		}
+		fd, err := firefly.LoadFieldSpec(spec, a.w.SizeW, a.w.SizeH)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		fields[name] = fd
+	}
+	if err := a.w.SetPeriodField(fields["period"]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	a.w.PeriodContinuous = a.fieldCont
+	if fd, ok := fields["radius"]; ok {
+		a.w.SetRadiusField(fd)
+	}
+	a.w.SpeedField = fields["speed"]
+
+	fd, ok := fields[a.fieldShow]
+	if !ok {
+		return
+	}
+	// lighten the background where the field is high
+	a.fieldOverlay = image.NewRGBA(a.wSize)
+	for y := 0; y < a.wSize.Dy(); y++ {
+		for x := 0; x < a.wSize.Dx(); x++ {
+			col := uint8(10 + 40*fd.Normalized(float32(x), float32(y)))
+			a.fieldOverlay.SetRGBA(x, y, color.RGBA{col, col, col, 255})
+		}
+	}
+}
+
+// Load all the frames of a recorded trace, and size the world like the recorded one.
+func (a *myApp) loadReplay(path string) error {
+	traceFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer traceFile.Close()
+	tr, err := firefly.NewTraceReader(traceFile)
+	if err != nil {
+		return err
+	}
+	frames, err := tr.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("empty trace %s", path)
+	}
+
+	c := tr.Header.Config
+	a.wCellW = c.CellWNum
+	a.wCellH = c.CellHNum
+	a.wCellD = c.CellDNum
+	a.wCellSize = int(c.CellSize)
+	a.wSize = image.Rect(0, 0, a.wCellW*a.wCellSize, a.wCellH*a.wCellSize)
+	a.replay = frames
+	a.replayPlay = true
+	return nil
+}
+
 // Update the world with the new config params.
 //
 // Extract the data from the UI and update the world.
@@ -495,7 +674,12 @@ func (a *myApp) configRead(source string) {
 
 	// from checkbox
 	a.drawGrid = a.s.confDrawGrid.Checked
+	a.showField = a.s.miscField.Checked
 	a.doInteraction = a.s.confInteract.Checked
+	a.lifecycle = a.s.confLife.Checked
+	if c, err := firefly.ParseCoupling(a.s.confCoupling.Selected); err == nil {
+		a.coupling = c
+	}
 
 	// get data from entries
 	nF, nFerr := strconv.Atoi(a.s.confFireNum.Text)
@@ -536,7 +720,17 @@ func (a *myApp) configRead(source string) {
 // Apply the configuration to the world
 func (a *myApp) configApply(source string) {
 	a.w.NudgeAmount = a.nudgeAmount
-	a.w.NudgeRadius = a.nudgeRadius
+	a.w.SetNudgeRadius(a.nudgeRadius)
+	a.w.Coupling = a.coupling
+
+	// the emergence balances the deaths around the requested number of fireflies
+	if a.lifecycle {
+		lifespanMin, lifespanMax := 20_000_000, 40_000_000
+		rate := float64(a.nF) * 2_000_000 / float64(lifespanMin+lifespanMax)
+		a.w.Lifecycle = firefly.NewLifecycle(rate, lifespanMin, lifespanMax)
+	} else {
+		a.w.Lifecycle = nil
+	}
 
 	// add/remove fireflies
 	if a.nFold != a.nF {
@@ -545,45 +739,31 @@ func (a *myApp) configApply(source string) {
 	a.nFold = a.nF
 }
 
+// Add/remove fireflies to match the requested number.
+//
+// The current population is used, as births and deaths might have changed it.
 func (a *myApp) changeFireflyNum() {
-	fmt.Printf("a.nFold, a.nF = %+v %+v\n", a.nFold, a.nF)
-
-	totCNum := a.wCellW * a.wCellH
-
-	// remove fireflies
-	i := 0
-	for a.nFold > a.nF {
-		cId := i % totCNum
-		cX := cId % a.wCellW
-		cY := cId / a.wCellH
-		fId := getMapKey(a.w.Cells[cX][cY].Fireflies)
-		// fmt.Printf("i, cId, cX, cY, fId = %+v %+v %+v %+v %+v\n", i, cId, cX, cY, fId)
-		i++
-		if fId == -1 {
-			continue
-		}
-		f := a.w.Cells[cX][cY].Fireflies[fId]
-		a.w.Cells[cX][cY].Leave(f)
-		a.nFold--
-	}
-	for a.nFold < a.nF {
-		x := rand.Float32() * a.w.SizeW
-		y := rand.Float32() * a.w.SizeH
-		o := int16(rand.Float64() * 360)
-		p := firefly.RandRangeInt(a.w.PeriodMin, a.w.PeriodMax)
-		firefly.NewFirefly(x, y, o, a.newFId, p, a.w)
-		a.newFId++
-		a.nFold++
+	pop := a.w.Population()
+	fmt.Printf("pop, a.nF = %+v %+v\n", pop, a.nF)
+
+	if pop > a.nF {
+		a.w.RemoveFireflies(pop - a.nF)
+	} else {
+		a.w.AddFireflies(a.nF - pop)
 	}
 }
 
 func (a *myApp) runApp() {
 	rand.Seed(time.Now().UnixNano())
 	a.buildUI()
-	a.resetWorld()
-	a.s.initSidebar()
-	a.resetWorld()
-	go a.animate()
+	if a.replay != nil {
+		go a.animateReplay()
+	} else {
+		a.resetWorld()
+		a.s.initSidebar()
+		a.resetWorld()
+		go a.animate()
+	}
 	a.mainWin.Resize(fyne.NewSize(1200, 900))
 	a.mainWin.Show()
 	a.fyneApp.Run()
@@ -601,15 +781,26 @@ func (a *myApp) animate() {
 		} else if a.s.confRequest {
 			a.configWorld("animate")
 		}
+		// apply the scenario between the steps
+		if a.runner != nil {
+			applied, err := a.runner.Apply(a.w)
+			if err != nil {
+				fmt.Printf("scenario error = %+v\n", err)
+				a.runner = nil
+			}
+			for _, act := range applied {
+				fmt.Printf("applied action = %+v\n", act)
+			}
+		}
 		// t1 := time.Now()
-		a.renderWorld()
+		a.renderWorld(a.w.Frame())
 		// t2 := time.Now()
 		// a.w.DoStep <- 'M'
-		a.w.Move()
+		a.w.Step()
 		// t3 := time.Now()
-		a.w.ClockTick()
+		a.s.confPopLab.SetText(fmt.Sprintf("Population: %d", a.w.Population()))
 		// t4 := time.Now()
-		// fmt.Printf("render %+v move %+v tick %+v\n",
+		// fmt.Printf("render %+v step %+v label %+v\n",
 		// 	t2.Sub(t1),
 		// 	t3.Sub(t2),
 		// 	t4.Sub(t3),
@@ -617,6 +808,22 @@ func (a *myApp) animate() {
 	}
 }
 
+// Show the frames of the recorded trace.
+func (a *myApp) animateReplay() {
+	tickRender := time.NewTicker(time.Second / 25)
+
+	for range tickRender.C {
+		a.drawGrid = a.s.confDrawGrid.Checked
+		i := a.replayI
+		a.renderWorld(a.replay[i])
+		a.s.repLab.SetText(fmt.Sprintf("%d: %.2f s", i, float64(a.replay[i].Clock)/1e6))
+		if a.replayPlay && i < len(a.replay)-1 {
+			a.replayI = i + 1
+			a.s.repSlider.SetValue(float64(a.replayI))
+		}
+	}
+}
+
 func (a *myApp) typedKey(ev *fyne.KeyEvent) {
 	fmt.Printf("typedKey  = %+v %T\n", ev, ev)
 	switch ev.Name {
@@ -632,8 +839,8 @@ func (a *myApp) typedKey(ev *fyne.KeyEvent) {
 //  RENDERING
 // --------------------------------------------------------------------------------
 
-// Render the World as an image, and update the canvas.
-func (a *myApp) renderWorld() {
+// Render a Frame of the World as an image, and update the canvas.
+func (a *myApp) renderWorld(fr *firefly.Frame) {
 	img := image.NewRGBA(a.wSize)
 
 	draw.Draw(
@@ -642,11 +849,22 @@ func (a *myApp) renderWorld() {
 		image.Point{0, 0},
 		draw.Src,
 	)
+	if a.showField && a.fieldOverlay != nil {
+		draw.Draw(img, img.Bounds(), a.fieldOverlay, image.Point{0, 0}, draw.Src)
+	}
+
+	// group the fireflies by cell
+	cells := make([][]firefly.FireflyState, a.wCellW*a.wCellH)
+	for _, s := range fr.Fireflies {
+		cx := int(s.X) / a.wCellSize
+		cy := int(s.Y) / a.wCellSize
+		cells[cx*a.wCellH+cy] = append(cells[cx*a.wCellH+cy], s)
+	}
 
-	for i := 0; i < a.w.CellWNum; i++ {
-		for ii := 0; ii < a.w.CellHNum; ii++ {
+	for i := 0; i < a.wCellW; i++ {
+		for ii := 0; ii < a.wCellH; ii++ {
 			a.wCellWG.Add(1)
-			go a.renderCell(a.w.Cells[i][ii], img)
+			go a.renderCell(i, ii, cells, fr.Clock, img)
 		}
 	}
 	a.wCellWG.Wait()
@@ -656,14 +874,18 @@ func (a *myApp) renderWorld() {
 }
 
 // Render the cell.
-func (a *myApp) renderCell(c *firefly.Cell, m *image.RGBA) {
+//
+// Each goroutine writes only the pixels of its own cell, and draws also the part
+// of the fireflies of the cells before it that spills over its border.
+func (a *myApp) renderCell(cx, cy int, cells [][]firefly.FireflyState, clock int, m *image.RGBA) {
+	left := cx * a.wCellSize
+	bottom := cy * a.wCellSize
+	tile := image.Rect(left, bottom, left+a.wCellSize, bottom+a.wCellSize)
 
 	// checkerboard pattern
 	if a.drawGrid {
-		left := c.Cx * a.wCellSize
-		bottom := c.Cy * a.wCellSize
 		col := uint8(20)
-		if c.Cx%2 == c.Cy%2 {
+		if cx%2 == cy%2 {
 			col = 30
 		}
 		for i := 0; i < a.wCellSize; i++ {
@@ -673,15 +895,57 @@ func (a *myApp) renderCell(c *firefly.Cell, m *image.RGBA) {
 		}
 	}
 
+	// the fireflies are at most 2 px wide, right and down from their position
+	reach := 1 + 2/a.wCellSize
+	fireflies := []firefly.FireflyState{}
+	for nx := cx - reach; nx <= cx; nx++ {
+		for ny := cy - reach; ny <= cy; ny++ {
+			if nx < 0 || ny < 0 {
+				continue
+			}
+			fireflies = append(fireflies, cells[nx*a.wCellH+ny]...)
+		}
+	}
+	set := func(x, y int, c color.RGBA) {
+		if image.Pt(x, y).In(tile) {
+			m.SetRGBA(x, y, c)
+		}
+	}
+
+	// project a 3D world along the depth, drawing the far fireflies first
+	if a.wCellD > 0 {
+		sort.Slice(fireflies, func(i, j int) bool { return fireflies[i].Z < fireflies[j].Z })
+	}
+
 	minBr := 30.0
 	fCol := color.RGBA{10, 10, uint8(minBr), 255}
-	for _, f := range c.Fireflies {
-		since := a.w.Clock - (f.NextBlink - f.Period)
+	for _, f := range fireflies {
+		since := clock - f.LastBlink
 		br := brightness(since, a.decay)
+		// far fireflies are dimmer, near ones are drawn bigger
+		near := false
+		if a.wCellD > 0 {
+			depth := float64(f.Z) / float64(a.wCellD*a.wCellSize)
+			br *= 0.35 + 0.65*depth
+			near = depth >= 0.5
+		}
 		brightMax := uint8((255-minBr)*br + minBr)
 		fCol.R = brightMax
 		fCol.G = brightMax
-		m.Set(int(f.X), int(f.Y), fCol)
+		if a.antialias {
+			size := 1
+			if near {
+				size = 2
+			}
+			SplatSquare(m, tile, f.X, f.Y, size, fCol)
+			continue
+		}
+		set(int(f.X), int(f.Y), fCol)
+		if near {
+			set(int(f.X)+1, int(f.Y), fCol)
+			set(int(f.X), int(f.Y)+1, fCol)
+			set(int(f.X)+1, int(f.Y)+1, fCol)
+		}
 	}
 
 	a.wCellWG.Done()
@@ -692,6 +956,42 @@ func (a *myApp) renderCell(c *firefly.Cell, m *image.RGBA) {
 // --------------------------------------------------------------------------------
 
 func main() {
+	scenarioPath := flag.String("scenario", "", "JSON scenario to apply to the world.")
+	fieldPeriod := flag.String("fperiod", "", "Field multiplying the period, as 'image.png|gradx|grady|radial,lo,hi'.")
+	fieldRadius := flag.String("fradius", "", "Field multiplying the nudge radius, as 'image.png|gradx|grady|radial,lo,hi'.")
+	fieldSpeed := flag.String("fspeed", "", "Field multiplying the speed, as 'image.png|gradx|grady|radial,lo,hi'.")
+	fieldContinuous := flag.Bool("fcont", false, "Apply the period field at every step, not only when hatching.")
+	fieldShow := flag.String("fshow", "period", "Field to show as overlay: period, radius or speed.")
+	replayPath := flag.String("replay", "", "Replay a recorded trace instead of simulating.")
+	cellD := flag.Int("cd", 0, "Depth of the world in cells, 0 for a flat world.")
+	bounded := flag.Bool("bounded", false, "Bounce the fireflies off the walls instead of wrapping around.")
+	antialias := flag.Bool("aa", false, "Draw the fireflies between the pixels, so that they glide smoothly.")
+	flag.Parse()
+
 	theApp := newApp()
+	theApp.fieldSpecs = map[string]string{
+		"period": *fieldPeriod,
+		"radius": *fieldRadius,
+		"speed":  *fieldSpeed,
+	}
+	theApp.fieldCont = *fieldContinuous
+	theApp.fieldShow = *fieldShow
+	theApp.wCellD = *cellD
+	theApp.wBounded = *bounded
+	theApp.antialias = *antialias
+	if *scenarioPath != "" {
+		s, err := firefly.LoadScenario(*scenarioPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		theApp.scenario = s
+	}
+	if *replayPath != "" {
+		if err := theApp.loadReplay(*replayPath); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
 	theApp.runApp()
 }
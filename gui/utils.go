@@ -1,6 +1,10 @@
 package main
 
-import "github.com/Pitrified/go-firefly"
+import (
+	"image"
+	"image/color"
+	"math"
+)
 
 // MaxFloat32 returns the maximum value between the float32 parameters.
 func MaxFloat32(a, b float32) float32 {
@@ -11,12 +15,45 @@ func MaxFloat32(a, b float32) float32 {
 	}
 }
 
-// Get an arbitrary key from a map.
+// MinFloat32 returns the minimum value between the float32 parameters.
+func MinFloat32(a, b float32) float32 {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
+
+// SplatSquare draws a square of side size with its top left corner at x, y, between the pixels.
 //
-// https://stackoverflow.com/q/23482786/2237151
-func getMapKey(m map[int]*firefly.Firefly) int {
-	for k := range m {
-		return k
+// Each pixel is blended with the color by how much of it the square covers,
+// so that a square moving slowly glides instead of jumping from pixel to pixel.
+// Only the pixels in clip are drawn.
+func SplatSquare(m *image.RGBA, clip image.Rectangle, x, y float32, size int, c color.RGBA) {
+	clip = clip.Intersect(m.Bounds())
+	x0, y0 := int(math.Floor(float64(x))), int(math.Floor(float64(y)))
+	for j := 0; j <= size; j++ {
+		// overlap of the square with the row and the column of the pixel
+		cy := MinFloat32(float32(y0+j+1), y+float32(size)) - MaxFloat32(float32(y0+j), y)
+		for i := 0; i <= size; i++ {
+			cx := MinFloat32(float32(x0+i+1), x+float32(size)) - MaxFloat32(float32(x0+i), x)
+			p := image.Pt(x0+i, y0+j)
+			if cx <= 0 || cy <= 0 || !p.In(clip) {
+				continue
+			}
+			cov := cx * cy
+			d := m.RGBAAt(p.X, p.Y)
+			m.SetRGBA(p.X, p.Y, color.RGBA{
+				blendByte(d.R, c.R, cov),
+				blendByte(d.G, c.G, cov),
+				blendByte(d.B, c.B, cov),
+				255,
+			})
+		}
 	}
-	return -1
+}
+
+// blendByte mixes t of b into a.
+func blendByte(a, b uint8, t float32) uint8 {
+	return uint8(float32(a)*(1-t) + float32(b)*t + 0.5)
 }
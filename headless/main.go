@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Pitrified/go-firefly"
+)
+
+// Runs a World without rendering it, and prints the metrics as CSV on stdout.
+func main() {
+
+	// world params
+	cw := flag.Int("cw", 16, "Width of the world in cells.")
+	ch := flag.Int("ch", 9, "Height of the world in cells.")
+	cd := flag.Int("cd", 0, "Depth of the world in cells, 0 for a flat world.")
+	cellSize := flag.Int("cs", 80, "Size of each cell.")
+	bounded := flag.Bool("bounded", false, "Use walls at the borders instead of wrapping around.")
+	nudgeRadius := flag.Int("nr", 22, "Max distance between interacting fireflies.")
+	nudgeAmount := flag.Int("na", 20, "How much to nudge the deadlines, in ms.")
+	nF := flag.Int("nf", 1000, "Number of fireflies to simulate.")
+	seed := flag.Int64("seed", 0, "Seed of the random source, random if 0.")
+	deterministic := flag.Bool("det", false, "Blink in synchronous rounds, so that a seed always gives the same run.")
+	adaptive := flag.Int("adaptive", 0, "Split the cells with more than this many fireflies, 0 for the fixed grid.")
+	graphSpec := flag.String("graph", "", "Interaction graph instead of the swarm, as an edge list file or 'ring,n,k', 'smallworld,n,k,p', 'scalefree,n,m'.")
+
+	// run params
+	duration := flag.Float64("d", 60, "Simulated time to run, in seconds.")
+	every := flag.Int("every", 1, "Print the metrics every this many steps.")
+	scenarioPath := flag.String("scenario", "", "JSON scenario to apply during the run.")
+	recordPath := flag.String("record", "", "Record the trace of the run in this file.")
+	checkpointPath := flag.String("checkpoint", "", "Save checkpoints of the run in this file.")
+	checkpointEvery := flag.Int("cpe", 2400, "Save a checkpoint every this many steps.")
+	resume := flag.Bool("resume", false, "Resume the run from the checkpoint, if it exists.")
+
+	// ensemble params
+	replicas := flag.Int("replicas", 1, "Run this many worlds with consecutive seeds, and print their statistics.")
+	workers := flag.Int("workers", 0, "Worlds of the ensemble running at the same time, the number of CPUs if 0.")
+	seedsPath := flag.String("seeds", "", "Write the final metrics of each seed of the ensemble in this file, stderr if empty.")
+
+	// distributed params
+	hubAddr := flag.String("hub", "", "Coordinate a distributed run, listening for the nodes on this address.")
+	tiles := flag.String("tiles", "2x1", "Tiles of the distributed run, as 'WxH', one node for each.")
+	joinAddr := flag.String("join", "", "Run a node of the distributed run coordinated by the hub at this address.")
+
+	flag.Parse()
+
+	// a node gets all the parameters from the hub
+	if *joinAddr != "" {
+		n, err := firefly.DialNode(*joinAddr)
+		check(err)
+		fmt.Fprintf(os.Stderr, "node of tile %d\n", n.Tile)
+		check(n.Run())
+		return
+	}
+
+	if *hubAddr != "" {
+		var tw, th int
+		_, err := fmt.Sscanf(*tiles, "%dx%d", &tw, &th)
+		check(err)
+		w := firefly.NewWorld3D(
+			*cw, *ch, *cd, float32(*cellSize),
+			1_000_000, 25_000,
+			*nudgeAmount*1000, float32(*nudgeRadius),
+			500_000,
+			900_000, 1_100_000,
+		)
+		w.Bounded = *bounded
+		if *adaptive > 0 {
+			w.Adaptive = firefly.NewAdaptive(*adaptive, w.NudgeRadius)
+		}
+		if *seed != 0 {
+			w.SetSeed(*seed)
+		}
+		c := w.Config()
+		w.Close()
+		if *graphSpec != "" {
+			check(fmt.Errorf("the graph mode cannot be distributed"))
+		}
+
+		h, err := firefly.ListenHub(*hubAddr, c, tw, th, *nF, int(*duration*1_000_000)/c.ClockTickLen)
+		check(err)
+		h.Every = *every
+		fmt.Fprintf(os.Stderr, "waiting for %d nodes on %v\n", tw*th, h.Addr())
+		fmt.Println("clock,population,blinking,order")
+		h.Sample = func(clock, population, blinking int, order float64) {
+			fmt.Printf("%d,%d,%d,%.4f\n", clock, population, blinking, order)
+		}
+		_, err = h.Run()
+		check(err)
+		return
+	}
+
+	if *replicas > 1 {
+		w := firefly.NewWorld3D(
+			*cw, *ch, *cd, float32(*cellSize),
+			1_000_000, 25_000,
+			*nudgeAmount*1000, float32(*nudgeRadius),
+			500_000,
+			900_000, 1_100_000,
+		)
+		w.Bounded = *bounded
+		w.Deterministic = *deterministic
+		if *adaptive > 0 {
+			w.Adaptive = firefly.NewAdaptive(*adaptive, w.NudgeRadius)
+		}
+		if *seed != 0 {
+			w.SetSeed(*seed)
+		}
+		c := w.Config()
+		w.Close()
+
+		e := firefly.NewEnsemble(c, *replicas, c.Seed, *nF, int(*duration*1_000_000)/c.ClockTickLen)
+		e.Every = *every
+		e.Workers = *workers
+		if *graphSpec != "" {
+			// each world builds its graph with its own seed
+			_, err := firefly.ParseGraphSpec(*graphSpec, firefly.NewRand(c.Seed))
+			check(err)
+			e.Fireflies = 0
+			e.Setup = func(w *firefly.World) {
+				g, _ := firefly.ParseGraphSpec(*graphSpec, firefly.NewRand(w.Seed))
+				w.SetGraph(g)
+			}
+		}
+		if *scenarioPath != "" {
+			s, err := firefly.LoadScenario(*scenarioPath)
+			check(err)
+			e.Scenario = s
+		}
+		e.Progress = func(seed int64) {
+			fmt.Fprintf(os.Stderr, "done seed %d\n", seed)
+		}
+		res, err := e.Run()
+		check(err)
+		check(res.WriteCSV(os.Stdout))
+
+		seedsOut := os.Stderr
+		if *seedsPath != "" {
+			seedsOut, err = os.Create(*seedsPath)
+			check(err)
+			defer seedsOut.Close()
+		}
+		check(res.WriteSeedsCSV(seedsOut))
+		return
+	}
+
+	var runner *firefly.ScenarioRunner
+	if *scenarioPath != "" {
+		s, err := firefly.LoadScenario(*scenarioPath)
+		check(err)
+		runner = firefly.NewScenarioRunner(s)
+	}
+
+	// restore the world from the checkpoint, or start a new one
+	var w *firefly.World
+	stepStart := 0
+	if *resume && *checkpointPath != "" {
+		cp, err := firefly.LoadCheckpoint(*checkpointPath)
+		if !os.IsNotExist(err) {
+			check(err)
+			// the trace cannot continue from the step of the checkpoint, and a new one would miss the start
+			if *recordPath != "" {
+				check(fmt.Errorf("cannot record the trace of a resumed run"))
+			}
+			w, err = firefly.RestoreWorld(cp)
+			check(err)
+			stepStart = cp.Step
+			if runner != nil {
+				runner.Next = cp.ScenarioNext
+			}
+			fmt.Fprintf(os.Stderr, "resume from step %d clock %d\n", stepStart, w.Clock)
+		}
+	}
+	if w == nil {
+		w = firefly.NewWorld3D(
+			*cw, *ch, *cd, float32(*cellSize),
+			1_000_000, 25_000,
+			*nudgeAmount*1000, float32(*nudgeRadius),
+			500_000,
+			900_000, 1_100_000,
+		)
+		w.Bounded = *bounded
+		w.Deterministic = *deterministic
+		if *seed != 0 {
+			w.SetSeed(*seed)
+		}
+		if *graphSpec != "" {
+			g, err := firefly.ParseGraphSpec(*graphSpec, firefly.NewRand(w.Seed))
+			check(err)
+			w.SetGraph(g)
+		} else {
+			w.HatchFireflies(*nF)
+		}
+		if *adaptive > 0 {
+			w.SetAdaptive(firefly.NewAdaptive(*adaptive, w.NudgeRadius))
+		}
+	}
+
+	// trace of the run, recorded at every step
+	var recorder *firefly.TraceWriter
+	if *recordPath != "" {
+		traceFile, err := os.Create(*recordPath)
+		check(err)
+		defer traceFile.Close()
+		recorder, err = firefly.NewTraceWriter(traceFile, w.Config(), 250)
+		check(err)
+		check(recorder.WriteFrame(w))
+	}
+
+	fmt.Println("clock,population,blinking,order")
+	steps := int(*duration*1_000_000) / w.ClockTickLen
+	for step := stepStart; step < steps; step++ {
+
+		// apply the scenario between the steps
+		if runner != nil {
+			applied, err := runner.Apply(w)
+			check(err)
+			for _, a := range applied {
+				fmt.Fprintf(os.Stderr, "applied %+v\n", a)
+			}
+		}
+
+		w.Step()
+		if recorder != nil {
+			check(recorder.WriteFrame(w))
+		}
+
+		if step%*every == 0 {
+			fmt.Printf("%d,%d,%d,%.4f\n",
+				w.Clock, w.Population(), w.Blinking(), w.OrderParameter())
+		}
+
+		// save the state to resume from the next step
+		if *checkpointPath != "" && (step+1)%*checkpointEvery == 0 {
+			cp := w.Checkpoint()
+			cp.Step = step + 1
+			if runner != nil {
+				cp.ScenarioNext = runner.Next
+			}
+			check(firefly.SaveCheckpoint(*checkpointPath, cp))
+		}
+	}
+
+	if recorder != nil {
+		check(recorder.Flush())
+	}
+}
+
+func check(e error) {
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "Error:", e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,130 @@
+package firefly
+
+// Lifecycle describes the birth and death dynamics of the swarm.
+type Lifecycle struct {
+	Emergence   []EmergencePoint // Emergence rate over the simulated time.
+	LifespanMin int              // Minimum lifespan of a firefly (us), 0 for immortal fireflies.
+	LifespanMax int              // Maximum lifespan of a firefly (us).
+	Regions     []Region         // Regions where the fireflies emerge, the whole world if empty.
+
+	emergeAcc float64 // Fraction of a firefly still waiting to emerge.
+}
+
+// EmergencePoint sets the emergence rate at a virtual time.
+//
+// The rate is interpolated linearly between the points,
+// and kept constant before the first and after the last one.
+type EmergencePoint struct {
+	Clock int     // Virtual time (us).
+	Rate  float64 // Fireflies emerging per simulated second.
+}
+
+// Region is a rectangular area of the world.
+type Region struct {
+	X, Y float32 // Bottom left corner of the region.
+	W, H float32 // Size of the region.
+}
+
+// NewLifecycle creates a Lifecycle with a constant emergence rate.
+func NewLifecycle(rate float64, lifespanMin, lifespanMax int) *Lifecycle {
+	l := &Lifecycle{}
+	l.Emergence = []EmergencePoint{{0, rate}}
+	l.LifespanMin = lifespanMin
+	l.LifespanMax = lifespanMax
+	return l
+}
+
+// Copy returns a deep copy of the Lifecycle, nil if l is nil.
+func (l *Lifecycle) Copy() *Lifecycle {
+	if l == nil {
+		return nil
+	}
+	c := *l
+	c.Emergence = append([]EmergencePoint(nil), l.Emergence...)
+	c.Regions = append([]Region(nil), l.Regions...)
+	return &c
+}
+
+// RateAt returns the emergence rate at the requested virtual time.
+func (l *Lifecycle) RateAt(clock int) float64 {
+	e := l.Emergence
+	if len(e) == 0 {
+		return 0
+	}
+	if clock <= e[0].Clock {
+		return e[0].Rate
+	}
+	for i := 1; i < len(e); i++ {
+		if clock < e[i].Clock {
+			t := float64(clock-e[i-1].Clock) / float64(e[i].Clock-e[i-1].Clock)
+			return e[i-1].Rate + t*(e[i].Rate-e[i-1].Rate)
+		}
+	}
+	return e[len(e)-1].Rate
+}
+
+// Number of fireflies emerging in a tick of length tickLen ending at clock.
+func (l *Lifecycle) emerging(clock, tickLen int) int {
+	l.emergeAcc += l.RateAt(clock) * float64(tickLen) / 1_000_000
+	n := int(l.emergeAcc)
+	l.emergeAcc -= float64(n)
+	return n
+}
+
+// Virtual time of death of a firefly born now, 0 if it never dies.
+func (l *Lifecycle) deathTime(w *World) int {
+	if l.LifespanMin <= 0 {
+		return 0
+	}
+	lMax := l.LifespanMax
+	if lMax < l.LifespanMin {
+		lMax = l.LifespanMin
+	}
+	return w.Clock + w.rng.RangeInt(l.LifespanMin, lMax)
+}
+
+// Random position inside the emergence regions, picked proportionally to their area.
+func (l *Lifecycle) spawnPos(w *World) (float32, float32) {
+	if len(l.Regions) == 0 {
+		return w.rng.Float32() * w.SizeW, w.rng.Float32() * w.SizeH
+	}
+	tot := float32(0)
+	for _, r := range l.Regions {
+		tot += r.W * r.H
+	}
+	pick := w.rng.Float32() * tot
+	r := l.Regions[len(l.Regions)-1]
+	for _, rr := range l.Regions {
+		if pick < rr.W*rr.H {
+			r = rr
+			break
+		}
+		pick -= rr.W * rr.H
+	}
+	return r.X + w.rng.Float32()*r.W, r.Y + w.rng.Float32()*r.H
+}
+
+// Age removes the dead fireflies and lets the new ones emerge.
+//
+// Does nothing if the World has no Lifecycle.
+func (w *World) Age() {
+	if w.Lifecycle == nil {
+		return
+	}
+
+	// remove the fireflies that reached the end of their life
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			if f.Death > 0 && f.Death <= w.Clock {
+				c.Leave(f)
+			}
+		}
+	}
+
+	// new fireflies emerge with a random phase
+	n := w.Lifecycle.emerging(w.Clock, w.ClockTickLen)
+	for i := 0; i < n; i++ {
+		x, y := w.Lifecycle.spawnPos(w)
+		w.spawnFirefly(x, y)
+	}
+}
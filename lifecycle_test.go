@@ -0,0 +1,82 @@
+package firefly
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The emergence rate is interpolated between the points.
+func TestRateAt(t *testing.T) {
+	l := &Lifecycle{Emergence: []EmergencePoint{
+		{1_000_000, 10},
+		{3_000_000, 30},
+	}}
+	cases := []struct {
+		clock int
+		want  float64
+	}{
+		{0, 10},
+		{1_000_000, 10},
+		{2_000_000, 20},
+		{3_000_000, 30},
+		{9_000_000, 30},
+	}
+	for _, c := range cases {
+		got := l.RateAt(c.clock)
+		assert.InDelta(t, c.want, got, 1e-9, fmt.Sprintf("Failed case %+v, got %+v", c, got))
+	}
+}
+
+// New fireflies emerge at the requested rate, inside the regions.
+func TestAgeEmerge(t *testing.T) {
+	w := NewWorld(10, 10, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	w.Lifecycle = NewLifecycle(100, 0, 0)
+	w.Lifecycle.Regions = []Region{{200, 300, 50, 50}}
+
+	// one simulated second
+	for i := 0; i < 40; i++ {
+		w.Clock += w.ClockTickLen
+		w.Age()
+	}
+	assert.Equal(t, 100, w.Population(), "100 fireflies should have emerged.")
+
+	for _, f := range w.Cells[2][3].Fireflies {
+		assert.True(t, f.X >= 200 && f.X <= 250 && f.Y >= 300 && f.Y <= 350,
+			fmt.Sprintf("Firefly %v outside of the region.", f))
+	}
+	assert.Equal(t, 100, len(w.Cells[2][3].Fireflies), "All fireflies should be in the region.")
+}
+
+// Fireflies are removed when they reach the end of their life.
+func TestAgeDeath(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	w.Lifecycle = NewLifecycle(0, 100_000, 100_000)
+
+	f := NewFirefly(150, 150, 0, 0, 1_000_000, w)
+	assert.Equal(t, w.Clock+100_000, f.Death, "The firefly should die after its lifespan.")
+
+	w.Clock += 50_000
+	w.Age()
+	assert.Equal(t, 1, w.Population(), "The firefly should still be alive.")
+	w.Clock += 50_000
+	w.Age()
+	assert.Equal(t, 0, w.Population(), "The firefly should be dead.")
+}
+
+// The population can be changed between steps.
+func TestAddRemoveFireflies(t *testing.T) {
+	w := NewWorld(4, 4, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	w.HatchFireflies(10)
+	w.AddFireflies(15)
+	assert.Equal(t, 25, w.Population())
+	w.RemoveFireflies(20)
+	assert.Equal(t, 5, w.Population())
+	w.RemoveFireflies(20)
+	assert.Equal(t, 0, w.Population())
+
+	// ids keep growing after the hatched ones
+	f := w.spawnFirefly(10, 10)
+	assert.Equal(t, 25, f.Id)
+}
@@ -0,0 +1,50 @@
+package firefly
+
+import "math"
+
+// Phase returns the phase of the firefly in [0, 1): the fraction of the period since the last blink.
+func (f *Firefly) Phase() float64 {
+	ph := float64(f.w.Clock-f.LastBlink) / float64(f.Period)
+	return ph - math.Floor(ph)
+}
+
+// OrderParameter measures the synchrony of the swarm, pacemakers excluded.
+//
+// It is the Kuramoto order parameter: 1 when all the phases are the same,
+// close to 0 when they are spread out.
+func (w *World) OrderParameter() float64 {
+	re, im, n := w.phaseSums()
+	if n == 0 {
+		return 0
+	}
+	return math.Hypot(re, im) / float64(n)
+}
+
+// Sum of the phases of the fireflies on the unit circle, pacemakers excluded.
+func (w *World) phaseSums() (re, im float64, n int) {
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			if f.Pacemaker != nil {
+				continue
+			}
+			th := 2 * math.Pi * f.Phase()
+			re += math.Cos(th)
+			im += math.Sin(th)
+			n++
+		}
+	}
+	return re, im, n
+}
+
+// Blinking returns the number of fireflies that blinked in the last tick, pacemakers excluded.
+func (w *World) Blinking() int {
+	tot := 0
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			if f.Pacemaker == nil && f.LastBlink > w.Clock-w.ClockTickLen {
+				tot++
+			}
+		}
+	}
+	return tot
+}
@@ -0,0 +1,27 @@
+package firefly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The order parameter is 1 in sync, 0 with opposite phases.
+func TestOrderParameter(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	assert.Equal(t, 0.0, w.OrderParameter(), "An empty world has no order.")
+
+	f := NewFirefly(50, 50, 0, 0, 1_000_000, w)
+	g := NewFirefly(250, 250, 0, 1, 1_000_000, w)
+	f.LastBlink = w.Clock - 100_000
+	g.LastBlink = w.Clock - 100_000
+	assert.InDelta(t, 1, w.OrderParameter(), 1e-9, "Same phases are in sync.")
+	assert.InDelta(t, 0.1, f.Phase(), 1e-9)
+
+	g.LastBlink = w.Clock - 600_000
+	assert.InDelta(t, 0, w.OrderParameter(), 1e-9, "Opposite phases cancel out.")
+
+	// only f blinked in the last tick
+	f.LastBlink = w.Clock - 1
+	assert.Equal(t, 1, w.Blinking())
+}
@@ -0,0 +1,154 @@
+package firefly
+
+import "sort"
+
+// Largest deadline, used when a pacemaker has no more flashes scheduled.
+const maxDeadline = int(^uint(0) >> 1)
+
+// Pacemaker is a light that flashes on its own schedule, and is never nudged.
+//
+// It is carried by a Firefly that never moves,
+// so that its flashes enter the blinkQueues like any other blink.
+type Pacemaker struct {
+	Schedule []int // Virtual times of the flashes (us), the Period of the firefly is used if empty.
+	next     int   // Index of the next flash in the schedule.
+}
+
+// Entrainment describes how far the flashes of a pacemaker spread in the swarm.
+type Entrainment struct {
+	Clock     int     // Virtual time of the measure (us).
+	Id        int     // Id of the pacemaker.
+	Entrained int     // Fireflies that blinked with the last flash of the pacemaker.
+	Total     int     // Fireflies in the world.
+	Radius    float32 // Distance from the pacemaker up to which most fireflies are entrained.
+}
+
+// AddPacemaker places a light flashing with a fixed period, starting at virtual time start.
+//
+// Does not need the World to be listening: it can be used between steps.
+func (w *World) AddPacemaker(x, y float32, period, start int) *Firefly {
+	f := w.newPacemaker(x, y, period, &Pacemaker{})
+	f.SetNextBlink(start)
+	return f
+}
+
+// AddStimulus places a light flashing at the scheduled virtual times.
+//
+// Does not need the World to be listening: it can be used between steps.
+func (w *World) AddStimulus(x, y float32, schedule []int) *Firefly {
+	s := append([]int(nil), schedule...)
+	sort.Ints(s)
+	// the period is only used to keep the brightness dark before the first flash
+	period := w.PeriodMax
+	if len(s) > 1 {
+		period = s[1] - s[0]
+	}
+	f := w.newPacemaker(x, y, period, &Pacemaker{Schedule: s})
+	if len(s) > 0 {
+		f.SetNextBlink(s[0])
+	} else {
+		f.SetNextBlink(maxDeadline)
+		f.LastBlink = w.Clock - period
+	}
+	return f
+}
+
+// Pacemakers returns the pacemakers in the world.
+func (w *World) Pacemakers() []*Firefly {
+	return w.pacemakers
+}
+
+// Create a firefly carrying the pacemaker, and put it in its cell.
+//
+// In a 3D world the pacemaker is placed at half the depth.
+func (w *World) newPacemaker(x, y float32, period int, p *Pacemaker) *Firefly {
+	f := newFirefly(x, y, w.sizeHalfD, 0, w.nextID, period, w)
+	f.Period = period
+	f.Pacemaker = p
+	f.nudgeable = false
+	f.Death = 0
+	w.ChangeCell(&ChangeCellReq{f, nil, f.c})
+	w.pacemakers = append(w.pacemakers, f)
+	return f
+}
+
+// Check if the pacemaker carried by f flashes with the current clock.
+//
+// Return true if it flashed.
+func (p *Pacemaker) flash(f *Firefly) bool {
+	if f.NextBlink > f.w.Clock {
+		return false
+	}
+	f.LastBlink = f.NextBlink
+
+	// fixed period: skip the flashes missed, if the tick is longer than the period
+	if len(p.Schedule) == 0 {
+		for f.NextBlink <= f.w.Clock {
+			f.NextBlink += f.Period
+		}
+		return true
+	}
+
+	// scripted: move to the first flash in the future
+	for p.next < len(p.Schedule) && p.Schedule[p.next] <= f.w.Clock {
+		p.next++
+	}
+	if p.next < len(p.Schedule) {
+		f.NextBlink = p.Schedule[p.next]
+	} else {
+		f.NextBlink = maxDeadline
+	}
+	return true
+}
+
+// Entrainment measures how far the pacemaker p entrained the swarm.
+//
+// A firefly is entrained if it blinked within window (us) of the last flash of the pacemaker.
+// The fireflies are grouped in rings of width ring around the pacemaker:
+// the radius is the outer edge of the last ring such that
+// at least half of the fireflies in it, and in all the rings inside it, are entrained.
+func (w *World) Entrainment(p *Firefly, window int, ring float32) Entrainment {
+	e := Entrainment{Clock: w.Clock, Id: p.Id}
+
+	// count the entrained fireflies in each ring:
+	// the furthest firefly is half the world away around the torus, or across it within the walls
+	maxDist := w.sizeHalfW + w.sizeHalfH + w.sizeHalfD
+	if w.Bounded {
+		maxDist = w.SizeW + w.SizeH + w.SizeD
+	}
+	ringNum := int(maxDist/ring) + 1
+	inRing := make([]int, ringNum)
+	entRing := make([]int, ringNum)
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			if f.Pacemaker != nil {
+				continue
+			}
+			e.Total++
+			r := int(w.ManhattanDist(p, f) / ring)
+			if r >= ringNum {
+				// rounding of the distance
+				r = ringNum - 1
+			}
+			inRing[r]++
+			dt := f.LastBlink - p.LastBlink
+			if dt >= -window && dt <= window {
+				e.Entrained++
+				entRing[r]++
+			}
+		}
+	}
+
+	// find the extent of the entrained region
+	for r := 0; r < ringNum; r++ {
+		if inRing[r] == 0 {
+			continue
+		}
+		if 2*entRing[r] < inRing[r] {
+			break
+		}
+		e.Radius = float32(r+1) * ring
+	}
+
+	return e
+}
@@ -0,0 +1,116 @@
+package firefly
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A pacemaker flashes with its fixed period.
+func TestPacemakerPeriod(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	p := w.AddPacemaker(150, 150, 100_000, w.Clock+50_000)
+
+	flashes := 0
+	for i := 0; i < 40; i++ {
+		w.Clock += w.ClockTickLen
+		if p.Pacemaker.flash(p) {
+			flashes++
+		}
+	}
+	assert.Equal(t, 10, flashes, "The pacemaker should flash every 100 ms.")
+	assert.Equal(t, 0, w.Population(), "Pacemakers are not part of the population.")
+}
+
+// A stimulus flashes on its schedule, then stops.
+func TestStimulusSchedule(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	p := w.AddStimulus(150, 150, []int{1_100_000, 1_055_000, 1_060_000})
+
+	var got []int
+	for i := 0; i < 20; i++ {
+		w.Clock += w.ClockTickLen
+		if p.Pacemaker.flash(p) {
+			got = append(got, p.LastBlink)
+		}
+	}
+	// the two close flashes fall in the same tick
+	assert.Equal(t, []int{1_055_000, 1_100_000}, got)
+	assert.Equal(t, maxDeadline, p.NextBlink, "No more flashes should be scheduled.")
+}
+
+// A pacemaker nudges its neighbors, but is never nudged.
+func TestPacemakerBlink(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+
+	p := w.AddPacemaker(150, 150, 1_000_000, w.Clock-1)
+	oldPNext := p.NextBlink
+
+	// f blinks when nudged by the pacemaker, and nudges it back
+	f := NewFirefly(151, 151, 0, 1, 1_000_000, w)
+	f.SetNextBlink(w.Clock + 1)
+
+	w.wgClockTick.Add(1)
+	go p.c.Blink()
+	w.wgClockTick.Wait()
+
+	assert.Equal(t, false, f.nudgeable, "The firefly should have blinked.")
+	assert.Equal(t, oldPNext+p.Period, p.NextBlink, "The pacemaker should not have been nudged.")
+
+	// pacemakers do not move
+	x, y := p.X, p.Y
+	assert.Nil(t, p.Move())
+	assert.Equal(t, x, p.X)
+	assert.Equal(t, y, p.Y)
+}
+
+// The entrained region is measured in rings around the pacemaker.
+func TestEntrainment(t *testing.T) {
+	w := NewWorld(10, 10, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	p := w.AddPacemaker(500, 500, 1_000_000, w.Clock)
+	p.LastBlink = w.Clock
+
+	// close fireflies in phase, far ones out of phase
+	for i, d := range []float32{5, 15, 25, 35, 45, 55} {
+		f := NewFirefly(500+d, 500, 0, 10+i, 1_000_000, w)
+		f.LastBlink = w.Clock - 10_000
+		if d > 30 {
+			f.LastBlink = w.Clock - 400_000
+		}
+	}
+
+	e := w.Entrainment(p, 25_000, 10)
+	assert.Equal(t, p.Id, e.Id)
+	assert.Equal(t, 3, e.Entrained)
+	assert.Equal(t, 6, e.Total)
+	assert.InDelta(t, 30, e.Radius, 1e-6)
+}
+
+// The rings reach the furthest corner of bounded and 3D worlds.
+func TestEntrainmentFar(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cd      int
+		bounded bool
+		x, y, z float32
+	}{
+		{"bounded", 0, true, 999, 999, 0},
+		{"3D", 10, false, 500, 500, 500},
+		{"bounded 3D", 10, true, 999, 999, 999},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewWorld3D(10, 10, tc.cd, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_100_000)
+			w.Bounded = tc.bounded
+			p := w.AddPacemaker(0, 0, 1_000_000, w.Clock)
+			p.LastBlink = w.Clock
+			p.Z = 0
+			f := NewFirefly3D(tc.x, tc.y, tc.z, 0, 10, 1_000_000, w)
+			f.LastBlink = w.Clock
+
+			e := w.Entrainment(p, 25_000, 25)
+			assert.Equal(t, 1, e.Total)
+			assert.Equal(t, 1, e.Entrained)
+			assert.Greater(t, e.Radius, w.ManhattanDist(p, f))
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package firefly
+
+import (
+	"fmt"
+	"math"
+)
+
+// Perception is the model of how the strength of a nudge falls with the distance.
+//
+// All the models are cut off at the NudgeRadius of the World.
+type Perception int
+
+const (
+	PerceptionStep          Perception = iota // Full nudge inside the radius.
+	PerceptionLinear                          // Falls linearly to zero at the radius.
+	PerceptionInverseSquare                   // Falls as 1 / (1 + (d/scale)^2).
+	PerceptionGaussian                        // Falls as exp(-d^2 / (2 scale^2)).
+)
+
+// Names of the perception models, as used by ParsePerception.
+var perceptionNames = map[Perception]string{
+	PerceptionStep:          "step",
+	PerceptionLinear:        "linear",
+	PerceptionInverseSquare: "invsq",
+	PerceptionGaussian:      "gauss",
+}
+
+// ParsePerception returns the Perception with the requested name.
+func ParsePerception(name string) (Perception, error) {
+	for p, n := range perceptionNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return PerceptionStep, fmt.Errorf("unknown perception model %q", name)
+}
+
+// String implements fmt.Stringer.
+func (p Perception) String() string {
+	if n, ok := perceptionNames[p]; ok {
+		return n
+	}
+	return fmt.Sprintf("Perception(%d)", int(p))
+}
+
+// Strength of a nudge from a firefly at distance d, in [0, 1], with radius r.
+func (w *World) perceive(d, r float32) float64 {
+	if d >= r {
+		return 0
+	}
+	scale := w.PerceptionScale
+	if scale <= 0 {
+		scale = r / 2
+	}
+	switch w.Perception {
+	case PerceptionLinear:
+		return float64(1 - d/r)
+	case PerceptionInverseSquare:
+		r := float64(d / scale)
+		return 1 / (1 + r*r)
+	case PerceptionGaussian:
+		r := float64(d / scale)
+		return math.Exp(-r * r / 2)
+	}
+	return 1
+}
+
+// Check if firefly f sees the current flash of the other firefly.
+//
+// The draw only depends on the seed, on the two fireflies and on the flash,
+// so it does not matter in which order the cells process the blinks.
+func (w *World) detects(f, fOther *Firefly) bool {
+	if w.DetectionProb >= 1 {
+		return true
+	}
+	return HashUnit(w.Seed, f.Id, fOther.Id, fOther.LastBlink) < w.DetectionProb
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (p Perception) MarshalText() ([]byte, error) {
+	if _, ok := perceptionNames[p]; !ok {
+		return nil, fmt.Errorf("unknown perception model %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *Perception) UnmarshalText(text []byte) error {
+	pp, err := ParsePerception(string(text))
+	*p = pp
+	return err
+}
@@ -0,0 +1,84 @@
+package firefly
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The strength of the nudge falls with the distance.
+func TestPerceive(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 40, 500_000, 900_000, 1_1000_000)
+
+	cases := []struct {
+		p    Perception
+		d    float32
+		want float64
+	}{
+		{PerceptionStep, 0, 1},
+		{PerceptionStep, 39, 1},
+		{PerceptionStep, 40, 0},
+		{PerceptionLinear, 0, 1},
+		{PerceptionLinear, 10, 0.75},
+		{PerceptionLinear, 40, 0},
+		{PerceptionInverseSquare, 0, 1},
+		{PerceptionInverseSquare, 20, 0.5},
+		{PerceptionInverseSquare, 50, 0},
+		{PerceptionGaussian, 0, 1},
+		{PerceptionGaussian, 20, math.Exp(-0.5)},
+		{PerceptionGaussian, 40, 0},
+	}
+	for _, c := range cases {
+		w.Perception = c.p
+		got := w.perceive(c.d, w.NudgeRadius)
+		assert.InDelta(t, c.want, got, 1e-6, fmt.Sprintf("Failed case %+v, got %+v", c, got))
+	}
+}
+
+// A distant firefly nudges less with a falloff.
+func TestNudgeLinear(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 40_000, 40, 500_000, 900_000, 1_1000_000)
+	w.Perception = PerceptionLinear
+
+	f := NewFirefly(150, 150, 0, 0, 1_000_000, w)
+	f.SetNextBlink(w.Clock + 500_000)
+	g := NewFirefly(160, 160, 0, 1, 1_000_000, w)
+
+	old := f.NextBlink
+	f.Nudge(g)
+	assert.Equal(t, 20_000, old-f.NextBlink, "At half the radius the nudge should be halved.")
+}
+
+// The detection probability drops a share of the flashes.
+func TestDetectionProb(t *testing.T) {
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	w.SetSeed(7)
+	w.DetectionProb = 0.3
+
+	f := NewFirefly(150, 150, 0, 0, 1_000_000, w)
+	g := NewFirefly(151, 151, 0, 1, 1_000_000, w)
+	seen := 0
+	n := 10000
+	for i := 0; i < n; i++ {
+		g.LastBlink = i
+		if w.detects(f, g) {
+			seen++
+		}
+		// the same flash is always seen in the same way
+		assert.Equal(t, w.detects(f, g), w.detects(f, g))
+	}
+	assert.InDelta(t, 0.3, float64(seen)/float64(n), 0.02, "Wrong share of detected flashes.")
+}
+
+// The perception models can be parsed from their names.
+func TestParsePerception(t *testing.T) {
+	for p := PerceptionStep; p <= PerceptionGaussian; p++ {
+		got, err := ParsePerception(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, got)
+	}
+	_, err := ParsePerception("nope")
+	assert.Error(t, err)
+}
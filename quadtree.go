@@ -0,0 +1,209 @@
+package firefly
+
+// Adaptive splits the dense cells and merges the sparse ones as the swarm moves.
+//
+// Each cell of the grid is the root of a quadtree: a cell with too many fireflies
+// is split in four quadrants, each with its own goroutine, so that a cluster does not
+// do all the nudges on a single core. In a 3D world the cells are split along
+// the width and the height, and the quadrants keep the depth of the cell.
+type Adaptive struct {
+	MaxLoad int     // Split a cell with more fireflies than this.
+	MinLoad int     // Merge four sibling cells with at most this many fireflies in total.
+	MinSize float32 // Do not split a cell if the quadrants would be smaller than this.
+}
+
+// Copy returns a copy of the Adaptive, nil if a is nil.
+func (a *Adaptive) Copy() *Adaptive {
+	if a == nil {
+		return nil
+	}
+	c := *a
+	return &c
+}
+
+// NewAdaptive creates an Adaptive decomposition splitting the cells with more than maxLoad fireflies.
+//
+// The quadrants are merged back when they hold half of maxLoad,
+// and are never smaller than the nudge radius.
+func NewAdaptive(maxLoad int, nudgeRadius float32) *Adaptive {
+	a := &Adaptive{}
+	a.MaxLoad = maxLoad
+	a.MinLoad = maxLoad / 2
+	a.MinSize = nudgeRadius
+	return a
+}
+
+// SetAdaptive enables the adaptive decomposition of the cells, nil to go back to the fixed grid.
+//
+// Must be called between steps.
+func (w *World) SetAdaptive(a *Adaptive) {
+	w.Adaptive = a
+	w.Rebalance()
+}
+
+// Rebalance splits the dense cells and merges the sparse ones, according to the Adaptive settings.
+//
+// Without Adaptive settings, all the cells are merged back to the fixed grid.
+// Called after each move, must be called between steps.
+func (w *World) Rebalance() {
+	for _, layer := range w.Layers {
+		for _, column := range layer {
+			for _, c := range column {
+				w.rebalanceCell(c)
+			}
+		}
+	}
+	w.collectLeaves()
+}
+
+// Split or merge the cell and its quadrants, from the leaves up.
+func (w *World) rebalanceCell(c *Cell) {
+	a := w.Adaptive
+
+	if c.children == nil {
+		if a != nil && len(c.Fireflies) > a.MaxLoad && (c.right-c.left)/2 >= a.MinSize {
+			c.split()
+			for _, cc := range c.children {
+				w.rebalanceCell(cc)
+			}
+		}
+		return
+	}
+
+	// merge the quadrants if they are all leaves and together they are sparse
+	load := 0
+	leaves := true
+	for _, cc := range c.children {
+		w.rebalanceCell(cc)
+		if cc.children != nil {
+			leaves = false
+		}
+		load += len(cc.Fireflies)
+	}
+	if leaves && (a == nil || load <= a.MinLoad) {
+		c.merge()
+	}
+}
+
+// Split the cell in four quadrants, and move the fireflies in them.
+func (c *Cell) split() {
+	midX := (c.left + c.right) / 2
+	midY := (c.bottom + c.top) / 2
+	c.children = []*Cell{
+		newSubCell(c, c.left, midX, c.bottom, midY),
+		newSubCell(c, midX, c.right, c.bottom, midY),
+		newSubCell(c, c.left, midX, midY, c.top),
+		newSubCell(c, midX, c.right, midY, c.top),
+	}
+	for _, f := range c.Fireflies {
+		nc := c.childAt(f.X, f.Y)
+		nc.Enter(f)
+		f.c = nc
+	}
+	c.Fireflies = make(map[int]*Firefly)
+}
+
+// Merge the quadrants back in the cell, and stop their goroutines.
+func (c *Cell) merge() {
+	for _, cc := range c.children {
+		for _, f := range cc.Fireflies {
+			c.Enter(f)
+			f.c = c
+		}
+		close(cc.quit)
+	}
+	c.children = nil
+}
+
+// Find the quadrant containing the position.
+func (c *Cell) childAt(x, y float32) *Cell {
+	i := 0
+	if x >= c.children[0].right {
+		i++
+	}
+	if y >= c.children[0].top {
+		i += 2
+	}
+	return c.children[i]
+}
+
+// Find the leaf of the quadtree containing the position.
+func (c *Cell) leafAt(x, y float32) *Cell {
+	for c.children != nil {
+		c = c.childAt(x, y)
+	}
+	return c
+}
+
+// Collect the leaves of all the quadtrees, the cells doing the work.
+func (w *World) collectLeaves() {
+	w.allCells = w.allCells[:0]
+	for _, layer := range w.Layers {
+		for _, column := range layer {
+			for _, c := range column {
+				w.allCells = c.appendLeaves(w.allCells)
+			}
+		}
+	}
+}
+
+// Append the leaves of the cell to the list.
+func (c *Cell) appendLeaves(leaves []*Cell) []*Cell {
+	if c.children == nil {
+		return append(leaves, c)
+	}
+	for _, cc := range c.children {
+		leaves = cc.appendLeaves(leaves)
+	}
+	return leaves
+}
+
+// Cell of the fixed grid this cell is part of.
+func (c *Cell) root() *Cell {
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c
+}
+
+// Call fn on the leaves of the cell close enough to the Firefly,
+// skipping the leaf where the firefly blinked.
+//
+// A leaf is close if it is within the border distance along each axis,
+// the same rule that selects the neighbors in the fixed grid.
+func (c *Cell) nearLeaves(f *Firefly, n *Cell, fn func(nc *Cell)) {
+	w := c.w
+	if w.axisDist(f.X, n.left, n.right, w.SizeW) >= w.borderDist ||
+		w.axisDist(f.Y, n.bottom, n.top, w.SizeH) >= w.borderDist ||
+		w.CellDNum > 0 && w.axisDist(f.Z, n.back, n.front, w.SizeD) >= w.borderDist {
+		return
+	}
+	if n.children == nil {
+		if n != c {
+			fn(n)
+		}
+		return
+	}
+	for _, cc := range n.children {
+		c.nearLeaves(f, cc, fn)
+	}
+}
+
+// Distance of the coordinate from the interval [lo, hi), around the torus if the world is not bounded.
+func (w *World) axisDist(v, lo, hi, size float32) float32 {
+	if v >= lo && v < hi {
+		return 0
+	}
+	// one of the two is negative, the side the coordinate is not on
+	below, above := lo-v, v-hi
+	if w.Bounded {
+		return MaxFloat32(below, above)
+	}
+	if below < 0 {
+		below += size
+	}
+	if above < 0 {
+		above += size
+	}
+	return MinFloat32(below, above)
+}
@@ -0,0 +1,163 @@
+package firefly
+
+import (
+	"math"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Hatch n fireflies in a disc around (x, y).
+func hatchCluster(w *World, n int, x, y, r float64) {
+	rng := NewRand(1)
+	for i := 0; i < n; i++ {
+		a := 2 * math.Pi * rng.Float64()
+		d := r * math.Sqrt(rng.Float64())
+		p := rng.RangeInt(w.PeriodMin, w.PeriodMax)
+		NewFirefly(float32(x+d*math.Cos(a)), float32(y+d*math.Sin(a)), int16(rng.Intn(360)), i, p, w)
+	}
+}
+
+// Dense cells are split in quadrants, and merged back when the swarm thins out.
+func TestAdaptiveSplitMerge(t *testing.T) {
+	w := NewWorld(4, 4, 80, 1_000_000, 25_000, 20_000, 10, 500_000, 900_000, 1_100_000)
+	hatchCluster(w, 60, 40, 40, 30)
+	w.SetAdaptive(&Adaptive{MaxLoad: 10, MinLoad: 5, MinSize: 10})
+
+	root := w.Cells[0][0]
+	assert.NotNil(t, root.children)
+	assert.Empty(t, root.Fireflies)
+	assert.Greater(t, len(w.allCells), 16+3)
+	assert.Equal(t, 60, w.Population())
+	for _, c := range w.allCells {
+		assert.LessOrEqual(t, len(c.Fireflies), 10, "The leaves are split down to the max load.")
+		for _, f := range c.Fireflies {
+			assert.Equal(t, c, f.c)
+			assert.Equal(t, c, w.cellAt(f.X, f.Y, f.Z))
+			assert.Equal(t, root, c.root())
+		}
+	}
+
+	// the fireflies move between the leaves
+	for i := 0; i < 20; i++ {
+		w.Step()
+	}
+	assert.Equal(t, 60, w.Population())
+
+	// without Adaptive the grid is restored
+	w.SetAdaptive(nil)
+	assert.Len(t, w.allCells, 16)
+	assert.Equal(t, 60, w.Population())
+
+	// with few fireflies left all the quadrants are merged
+	w.SetAdaptive(&Adaptive{MaxLoad: 10, MinLoad: 5, MinSize: 10})
+	assert.Greater(t, len(w.allCells), 16)
+	w.RemoveFireflies(57)
+	w.Rebalance()
+	assert.Len(t, w.allCells, 16)
+	assert.Nil(t, root.children)
+}
+
+// All the quadrants are rebalanced, also the ones after a quadrant that stays split.
+func TestAdaptiveRebalanceAll(t *testing.T) {
+	w := NewWorld(4, 4, 80, 1_000_000, 25_000, 20_000, 10, 500_000, 900_000, 1_100_000)
+	hatchCluster(w, 60, 20, 20, 15)
+	w.SetAdaptive(&Adaptive{MaxLoad: 10, MinLoad: 5, MinSize: 5})
+	root := w.Cells[0][0]
+	assert.NotNil(t, root.children[0].children)
+	assert.Nil(t, root.children[3].children)
+
+	// a dense cluster in the last quadrant
+	for i := 0; i < 30; i++ {
+		NewFirefly(float32(45+i%6*5), float32(45+i/6*5), 0, 100+i, 1_000_000, w)
+	}
+	assert.Len(t, root.children[3].Fireflies, 30)
+	w.Rebalance()
+	assert.NotNil(t, root.children[0].children)
+	assert.NotNil(t, root.children[3].children)
+	for _, c := range w.allCells {
+		assert.LessOrEqual(t, len(c.Fireflies), 10)
+	}
+	assert.Equal(t, 90, w.Population())
+}
+
+// A blink near a border reaches the leaves of the neighbors close to the firefly.
+func TestAdaptiveBlinkNeighbors(t *testing.T) {
+	w := NewWorld(3, 3, 80, 1_000_000, 25_000, 20_000, 22, 500_000, 900_000, 1_100_000)
+	w.Adaptive = &Adaptive{MaxLoad: 1000, MinSize: 10}
+	w.Cells[1][1].split()
+	w.Cells[0][0].split()
+	w.collectLeaves()
+
+	// near the right border of the cell (0,1), and close to its bottom
+	f := NewFirefly(78, 85, 0, 0, 1_000_000, w)
+	f.c.blinkNeighbors(f)
+
+	queued := func(c *Cell) int { return len(c.blinkQueue) }
+	// only the bottom left quadrant of (1,1) is close
+	assert.Equal(t, 1, queued(w.Cells[1][1].children[0]))
+	assert.Equal(t, 0, queued(w.Cells[1][1].children[1]))
+	assert.Equal(t, 0, queued(w.Cells[1][1].children[2]))
+	assert.Equal(t, 0, queued(w.Cells[1][1].children[3]))
+	// only the top right quadrant of the diagonal (0,0) is close
+	assert.Equal(t, 0, queued(w.Cells[0][0].children[0]))
+	assert.Equal(t, 0, queued(w.Cells[0][0].children[1]))
+	assert.Equal(t, 0, queued(w.Cells[0][0].children[2]))
+	assert.Equal(t, 1, queued(w.Cells[0][0].children[3]))
+	// the plain neighbors as in the grid
+	assert.Equal(t, 1, queued(w.Cells[1][0]))
+	assert.Equal(t, 0, queued(w.Cells[0][1]))
+	assert.Equal(t, 0, queued(w.Cells[2][1]))
+
+	// the quadrants of the same cell are neighbors too, also around the torus
+	g := NewFirefly(1, 41, 0, 1, 1_000_000, w)
+	assert.Equal(t, w.Cells[0][0].children[2], g.c)
+	g.c.blinkNeighbors(g)
+	assert.Equal(t, 1, queued(w.Cells[0][0].children[0]))
+	assert.Equal(t, 0, queued(w.Cells[0][0].children[1]))
+	assert.Equal(t, 1, queued(w.Cells[2][0]))
+}
+
+// Without splits the adaptive world runs exactly like the fixed grid.
+func TestAdaptiveSameAsGrid(t *testing.T) {
+	run := func(a *Adaptive) *Frame {
+		w := NewWorld(4, 4, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+		defer w.Close()
+		w.SetSeed(7)
+		w.HatchFireflies(200)
+		w.SetAdaptive(a)
+		for i := 0; i < 200; i++ {
+			w.Step()
+		}
+		return w.Frame()
+	}
+	assert.Equal(t, run(nil), run(&Adaptive{MaxLoad: 1000}))
+}
+
+// Step a clustered swarm, rebuilding the world every few steps before it spreads out.
+func benchmarkClustered(b *testing.B, a *Adaptive) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		w := NewWorld(8, 8, 80, 1_000_000, 25_000, 20_000, 22, 500_000, 900_000, 1_100_000)
+		w.SetSeed(1)
+		hatchCluster(w, 3000, 320, 320, 60)
+		w.SetAdaptive(a)
+		// collect the previous worlds, their cells have large queues
+		runtime.GC()
+		b.StartTimer()
+		for s := 0; s < 20; s++ {
+			w.Step()
+		}
+		b.StopTimer()
+		w.Close()
+	}
+}
+
+func BenchmarkStepClusteredGrid(b *testing.B) {
+	benchmarkClustered(b, nil)
+}
+
+func BenchmarkStepClusteredAdaptive(b *testing.B) {
+	benchmarkClustered(b, NewAdaptive(64, 22))
+}
@@ -0,0 +1,259 @@
+package firefly
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Scenario is a timeline of actions to apply to a World at given virtual times.
+//
+// It is stored as JSON, for example:
+//
+//	{"actions": [
+//	  {"at": 30000000, "type": "set", "param": "NudgeRadius", "value": 30},
+//	  {"at": 60000000, "type": "hatch", "count": 1000},
+//	  {"at": 90000000, "type": "scramble"}
+//	]}
+type Scenario struct {
+	Actions []Action `json:"actions"`
+}
+
+// Action is a change applied to the World when the Clock reaches At.
+//
+// The types of action are:
+//
+//	set       Param to Value, or to Mode for Perception and Coupling
+//	hatch     Count new fireflies
+//	remove    Count fireflies
+//	scramble  the phases of all the fireflies
+//	pacemaker at X, Y flashing with period Value (us)
+//	stimulus  at X, Y flashing at the Schedule times (us)
+type Action struct {
+	At       int     `json:"at"`                 // Virtual time of the action (us).
+	Type     string  `json:"type"`               // Type of the action.
+	Param    string  `json:"param,omitempty"`    // Parameter to set.
+	Value    float64 `json:"value,omitempty"`    // Value of the parameter, or period of the pacemaker.
+	Mode     string  `json:"mode,omitempty"`     // Name of the Perception or Coupling to set.
+	Count    int     `json:"count,omitempty"`    // Fireflies to hatch or remove.
+	X        float32 `json:"x,omitempty"`        // Position of the pacemaker.
+	Y        float32 `json:"y,omitempty"`        // Position of the pacemaker.
+	Schedule []int   `json:"schedule,omitempty"` // Flashes of the stimulus (us).
+}
+
+// Parameters of the World that can be changed by a set action.
+var scenarioParams = map[string]func(w *World, a Action) error{
+	"NudgeRadius":     func(w *World, a Action) error { w.SetNudgeRadius(float32(a.Value)); return nil },
+	"NudgeAmount":     func(w *World, a Action) error { w.NudgeAmount = int(a.Value); return nil },
+	"BlinkCooldown":   func(w *World, a Action) error { w.BlinkCooldown = int(a.Value); return nil },
+	"ClockTickLen":    func(w *World, a Action) error { w.ClockTickLen = int(a.Value); return nil },
+	"PeriodMin":       func(w *World, a Action) error { w.PeriodMin = int(a.Value); return nil },
+	"PeriodMax":       func(w *World, a Action) error { w.PeriodMax = int(a.Value); return nil },
+	"DetectionProb":   func(w *World, a Action) error { w.DetectionProb = a.Value; return nil },
+	"PerceptionScale": func(w *World, a Action) error { w.PerceptionScale = float32(a.Value); return nil },
+	"Perception": func(w *World, a Action) error {
+		p, err := ParsePerception(a.Mode)
+		w.Perception = p
+		return err
+	},
+	"Coupling": func(w *World, a Action) error {
+		c, err := ParseCoupling(a.Mode)
+		w.Coupling = c
+		return err
+	},
+	"EmergenceRate": func(w *World, a Action) error {
+		if w.Lifecycle == nil {
+			w.Lifecycle = NewLifecycle(a.Value, 0, 0)
+		} else {
+			w.Lifecycle.Emergence = []EmergencePoint{{w.Clock, a.Value}}
+		}
+		return nil
+	},
+}
+
+// LoadScenario reads a Scenario from a JSON file.
+func LoadScenario(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadScenario(f)
+}
+
+// ReadScenario decodes and validates a Scenario in JSON.
+func ReadScenario(r io.Reader) (*Scenario, error) {
+	s := &Scenario{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("scenario: %v", err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate checks that all the actions can be applied.
+func (s *Scenario) Validate() error {
+	for i, a := range s.Actions {
+		err := error(nil)
+		switch a.Type {
+		case "set":
+			if _, ok := scenarioParams[a.Param]; !ok {
+				err = fmt.Errorf("unknown param %q", a.Param)
+			} else if a.Param == "Perception" {
+				_, err = ParsePerception(a.Mode)
+			} else if a.Param == "Coupling" {
+				_, err = ParseCoupling(a.Mode)
+			} else {
+				err = checkSetValue(a)
+			}
+		case "hatch", "remove":
+			if a.Count < 0 {
+				err = fmt.Errorf("negative count %d", a.Count)
+			}
+		case "scramble", "stimulus":
+		case "pacemaker":
+			if a.Value <= 0 {
+				err = fmt.Errorf("the pacemaker period must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown type %q", a.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("scenario: action %d at %d: %v", i, a.At, err)
+		}
+	}
+	return nil
+}
+
+// Check the value of a set action on its own.
+//
+// The params merged with the World, like PeriodMin not above PeriodMax, are checked when the action is applied.
+func checkSetValue(a Action) error {
+	switch a.Param {
+	case "ClockTickLen":
+		if a.Value < 1 {
+			return fmt.Errorf("the tick length must be positive, got %v", a.Value)
+		}
+	case "PeriodMin", "PeriodMax":
+		if a.Value < MinPeriod {
+			return fmt.Errorf("the %s must be at least %d, got %v", a.Param, MinPeriod, a.Value)
+		}
+	case "DetectionProb":
+		if a.Value < 0 || a.Value > 1 {
+			return fmt.Errorf("the detection probability must be in [0, 1], got %v", a.Value)
+		}
+	default:
+		if a.Value < 0 {
+			return fmt.Errorf("the %s cannot be negative, got %v", a.Param, a.Value)
+		}
+	}
+	return nil
+}
+
+// Change the Config as the set action changes the World.
+func (a Action) setConfig(c *Config) {
+	switch a.Param {
+	case "NudgeRadius":
+		c.NudgeRadius = float32(a.Value)
+	case "NudgeAmount":
+		c.NudgeAmount = int(a.Value)
+	case "BlinkCooldown":
+		c.BlinkCooldown = int(a.Value)
+	case "ClockTickLen":
+		c.ClockTickLen = int(a.Value)
+	case "PeriodMin":
+		c.PeriodMin = int(a.Value)
+	case "PeriodMax":
+		c.PeriodMax = int(a.Value)
+	case "DetectionProb":
+		c.DetectionProb = a.Value
+	case "PerceptionScale":
+		c.PerceptionScale = float32(a.Value)
+	}
+}
+
+// ScenarioRunner applies the actions of a Scenario between the steps of a World.
+type ScenarioRunner struct {
+	actions []Action // Actions sorted by time.
+	Next    int      // Index of the next action to apply, saved in a Checkpoint to resume.
+}
+
+// NewScenarioRunner creates a runner for the Scenario.
+func NewScenarioRunner(s *Scenario) *ScenarioRunner {
+	r := &ScenarioRunner{}
+	r.actions = append([]Action(nil), s.Actions...)
+	sort.SliceStable(r.actions, func(i, j int) bool {
+		return r.actions[i].At < r.actions[j].At
+	})
+	return r
+}
+
+// Apply performs all the actions due at the current Clock of the World.
+//
+// Must be called between steps. Return the actions applied.
+func (r *ScenarioRunner) Apply(w *World) ([]Action, error) {
+	applied := []Action{}
+	for r.Next < len(r.actions) && r.actions[r.Next].At <= w.Clock {
+		a := r.actions[r.Next]
+		r.Next++
+		if err := w.ApplyAction(a); err != nil {
+			return applied, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, nil
+}
+
+// Done is true when all the actions have been applied.
+func (r *ScenarioRunner) Done() bool {
+	return r.Next >= len(r.actions)
+}
+
+// ApplyAction performs a single action on the World, regardless of its time.
+//
+// Must be called between steps.
+func (w *World) ApplyAction(a Action) error {
+	// the fireflies of a graph are its nodes: a new one would have no edges, a removed one would leave its node empty
+	if w.Graph != nil {
+		switch a.Type {
+		case "hatch", "remove", "pacemaker", "stimulus":
+			return fmt.Errorf("%s needs the swarm, not a graph", a.Type)
+		}
+	}
+	switch a.Type {
+	case "set":
+		set, ok := scenarioParams[a.Param]
+		if !ok {
+			return fmt.Errorf("unknown param %q", a.Param)
+		}
+		if err := checkSetValue(a); err != nil {
+			return err
+		}
+		// the World must still be able to run with the merged params
+		c := w.Config()
+		a.setConfig(&c)
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("set %s to %v: %v", a.Param, a.Value, err)
+		}
+		return set(w, a)
+	case "hatch":
+		w.AddFireflies(a.Count)
+	case "remove":
+		w.RemoveFireflies(a.Count)
+	case "scramble":
+		w.ScramblePhases()
+	case "pacemaker":
+		w.AddPacemaker(a.X, a.Y, int(a.Value), w.Clock+int(a.Value))
+	case "stimulus":
+		w.AddStimulus(a.X, a.Y, a.Schedule)
+	default:
+		return fmt.Errorf("unknown type %q", a.Type)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package firefly
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The actions are applied when the clock reaches them.
+func TestScenarioRunner(t *testing.T) {
+	s, err := ReadScenario(strings.NewReader(`{"actions": [
+		{"at": 1100000, "type": "hatch", "count": 20},
+		{"at": 1050000, "type": "set", "param": "NudgeRadius", "value": 30},
+		{"at": 1050000, "type": "set", "param": "Coupling", "mode": "inh"},
+		{"at": 1200000, "type": "remove", "count": 5},
+		{"at": 1200000, "type": "scramble"},
+		{"at": 1200000, "type": "pacemaker", "x": 10, "y": 10, "value": 500000}
+	]}`))
+	assert.NoError(t, err)
+
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	r := NewScenarioRunner(s)
+
+	applied, err := r.Apply(w)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(applied), "Nothing is due yet.")
+
+	w.Clock = 1_050_000
+	applied, _ = r.Apply(w)
+	assert.Equal(t, 2, len(applied))
+	assert.InDelta(t, 30, w.NudgeRadius, 1e-6)
+	assert.InDelta(t, 15, w.borderDist, 1e-6)
+	assert.Equal(t, CouplingInhibitory, w.Coupling)
+
+	w.Clock = 1_300_000
+	applied, _ = r.Apply(w)
+	assert.Equal(t, 4, len(applied))
+	assert.Equal(t, 15, w.Population())
+	assert.Equal(t, 1, len(w.Pacemakers()))
+	assert.True(t, r.Done())
+}
+
+// Invalid scenarios are rejected when read.
+func TestScenarioInvalid(t *testing.T) {
+	cases := []string{
+		`{"actions": [{"at": 0, "type": "explode"}]}`,
+		`{"actions": [{"at": 0, "type": "set", "param": "Gravity", "value": 1}]}`,
+		`{"actions": [{"at": 0, "type": "set", "param": "Perception", "mode": "smell"}]}`,
+		`{"actions": [{"at": 0, "type": "pacemaker"}]}`,
+		`{"actions": [{"at": 0, "type": "hatch", "cuont": 3}]}`,
+		`{"actions": [{"at": 0, "type": "set", "param": "ClockTickLen", "value": 0}]}`,
+		`{"actions": [{"at": 0, "type": "set", "param": "NudgeRadius", "value": -5}]}`,
+		`{"actions": [{"at": 0, "type": "set", "param": "PeriodMax", "value": 999}]}`,
+		`{"actions": [{"at": 0, "type": "set", "param": "DetectionProb", "value": 1.5}]}`,
+		`{"actions": [`,
+	}
+	for _, c := range cases {
+		_, err := ReadScenario(strings.NewReader(c))
+		assert.Error(t, err, c)
+	}
+}
+
+// A set action that would leave the World unable to run is rejected when applied.
+func TestScenarioSetMerged(t *testing.T) {
+	s, err := ReadScenario(strings.NewReader(`{"actions": [
+		{"at": 0, "type": "set", "param": "PeriodMax", "value": 800000},
+		{"at": 0, "type": "hatch", "count": 10}
+	]}`))
+	assert.NoError(t, err)
+
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_100_000)
+	r := NewScenarioRunner(s)
+	applied, err := r.Apply(w)
+	assert.Error(t, err, "PeriodMax cannot go below PeriodMin.")
+	assert.Equal(t, 0, len(applied))
+	assert.Equal(t, 1_100_000, w.PeriodMax, "The World is not changed.")
+}
+
+// The same scenario on a world with the same seed makes the same fireflies.
+func TestScenarioReproducible(t *testing.T) {
+	s, err := ReadScenario(strings.NewReader(`{"actions": [
+		{"at": 0, "type": "hatch", "count": 200},
+		{"at": 0, "type": "remove", "count": 37},
+		{"at": 0, "type": "scramble"}
+	]}`))
+	assert.NoError(t, err)
+
+	frames := []*Frame{}
+	for i := 0; i < 2; i++ {
+		w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_100_000)
+		w.SetSeed(7)
+		_, err := NewScenarioRunner(s).Apply(w)
+		assert.NoError(t, err)
+		frames = append(frames, w.Frame())
+		w.Close()
+	}
+	assert.Equal(t, 163, len(frames[0].Fireflies))
+	assert.Equal(t, frames[0], frames[1])
+}
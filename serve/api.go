@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pitrified/go-firefly"
+)
+
+// Limits of the resources used by the sessions of the API.
+type limits struct {
+	Sessions  int           // Sessions running at the same time.
+	Cells     int           // Cells of each world, each one runs in its own goroutine.
+	Fireflies int           // Fireflies in each world.
+	Ticks     int           // Ticks per step request.
+	Idle      time.Duration // Sessions not used for this long are deleted.
+}
+
+// A session is a World driven by the API.
+type session struct {
+	mu       sync.Mutex // Lock to acquire before touching the world.
+	id       string
+	w        *firefly.World
+	lastUsed time.Time
+}
+
+// The api serves independent worlds as JSON sessions:
+//
+//	POST   /sessions                  create a world from {"Config", "Fireflies"} or {"Checkpoint"}
+//	GET    /sessions                  list the sessions with their metrics
+//	GET    /sessions/{id}             metrics of the world
+//	POST   /sessions/{id}/step        step {"Ticks"} times
+//	GET    /sessions/{id}/fireflies   positions and phases of the fireflies
+//	GET    /sessions/{id}/config      parameters of the world
+//	POST   /sessions/{id}/config      change the parameters, and the number of fireflies
+//	GET    /sessions/{id}/snapshot    checkpoint of the world
+//	DELETE /sessions/{id}             close the world
+type api struct {
+	mu       sync.Mutex // Lock to acquire before touching the sessions.
+	sessions map[string]*session
+	nextID   int
+	lim      limits
+}
+
+func newAPI(lim limits) *api {
+	a := &api{}
+	a.sessions = map[string]*session{}
+	a.lim = lim
+	return a
+}
+
+// Metrics of a session.
+type metrics struct {
+	Id         string
+	Clock      int     // Virtual time of the world (us).
+	Population int     // Fireflies in the world, pacemakers included.
+	Blinking   int     // Fireflies that blinked in the last tick.
+	Order      float64 // Kuramoto order parameter of the swarm.
+}
+
+func (s *session) metrics() metrics {
+	return metrics{
+		Id:         s.id,
+		Clock:      s.w.Clock,
+		Population: s.w.Population(),
+		Blinking:   s.w.Blinking(),
+		Order:      s.w.OrderParameter(),
+	}
+}
+
+// Request to create a session.
+type createReq struct {
+	Config     *firefly.Config     // Parameters of a new world.
+	Fireflies  int                 // Fireflies to hatch in the new world.
+	Checkpoint *firefly.Checkpoint // State of a world to restore, instead of a new one.
+}
+
+// Request to change the parameters of a session.
+type configReq struct {
+	Config    json.RawMessage // Parameters to change, the others are kept.
+	Fireflies *int            // Fireflies to reach by adding or removing them.
+}
+
+// Fireflies of a session.
+type firefliesResp struct {
+	Clock     int
+	Fireflies []fireflyResp
+}
+
+// Firefly state, with the phase.
+type fireflyResp struct {
+	firefly.FireflyState
+	Phase float64 // Fraction of the period since the last blink, in [0, 1).
+}
+
+// An apiError is sent to the client as {"error": msg} with the status code.
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func errorf(code int, format string, a ...interface{}) error {
+	return &apiError{code, fmt.Sprintf(format, a...)}
+}
+
+// Reply with the value as JSON, or with the error.
+func reply(rw http.ResponseWriter, code int, v interface{}, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		code = http.StatusBadRequest
+		if e, ok := err.(*apiError); ok {
+			code = e.code
+		}
+		v = map[string]string{"error": err.Error()}
+	}
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// Decode the JSON body of the request, refusing unknown fields.
+func decode(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 64<<20))
+	dec.DisallowUnknownFields()
+	// an empty body keeps the defaults
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		return errorf(http.StatusBadRequest, "invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// Route the requests on /sessions.
+func (a *api) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := r.Method + " " + parts[0]
+	if len(parts) == 2 {
+		route = r.Method + " {id}"
+	} else if len(parts) == 3 {
+		route = r.Method + " {id}/" + parts[2]
+	} else if len(parts) > 3 {
+		route = ""
+	}
+
+	code := http.StatusOK
+	var v interface{}
+	var err error
+	switch route {
+	case "POST sessions":
+		code = http.StatusCreated
+		v, err = a.create(r)
+	case "GET sessions":
+		v = a.list()
+	case "GET {id}":
+		v, err = a.with(parts[1], func(s *session) (interface{}, error) { return s.metrics(), nil })
+	case "DELETE {id}":
+		v, err = a.delete(parts[1])
+	case "POST {id}/step":
+		req := struct{ Ticks int }{1}
+		if err = decode(r, &req); err == nil {
+			v, err = a.with(parts[1], func(s *session) (interface{}, error) { return a.step(s, req.Ticks) })
+		}
+	case "GET {id}/fireflies":
+		v, err = a.with(parts[1], func(s *session) (interface{}, error) { return fireflies(s), nil })
+	case "GET {id}/config":
+		v, err = a.with(parts[1], func(s *session) (interface{}, error) { return s.w.Config(), nil })
+	case "POST {id}/config":
+		req := configReq{}
+		if err = decode(r, &req); err == nil {
+			v, err = a.with(parts[1], func(s *session) (interface{}, error) { return a.reconfigure(s, req) })
+		}
+	case "GET {id}/snapshot":
+		v, err = a.with(parts[1], func(s *session) (interface{}, error) { return s.w.Checkpoint(), nil })
+	default:
+		err = errorf(http.StatusNotFound, "no route for %s %s", r.Method, r.URL.Path)
+	}
+	reply(rw, code, v, err)
+}
+
+// Create a session, from a new world or from a checkpoint.
+func (a *api) create(r *http.Request) (interface{}, error) {
+	req := createReq{}
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	if (req.Config == nil) == (req.Checkpoint == nil) {
+		return nil, errorf(http.StatusBadRequest, "set either Config or Checkpoint")
+	}
+	c := req.Config
+	n := req.Fireflies
+	if req.Checkpoint != nil {
+		c = &req.Checkpoint.Config
+		n = len(req.Checkpoint.Fireflies)
+	}
+	if err := a.checkLimits(*c, n); err != nil {
+		return nil, err
+	}
+	if req.Checkpoint != nil {
+		if err := validateCheckpoint(req.Checkpoint); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.checkSessions(); err != nil {
+		return nil, err
+	}
+
+	// the world is built out of the lock, as it might take a while,
+	// and the session is added only once it is complete
+	s := &session{lastUsed: time.Now()}
+	if req.Checkpoint != nil {
+		w, err := firefly.RestoreWorld(req.Checkpoint)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "%v", err)
+		}
+		s.w = w
+	} else {
+		s.w = firefly.NewWorldFromConfig(*c)
+		s.w.HatchFireflies(n)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// another session might have been created meanwhile
+	if err := a.checkSessionsLocked(); err != nil {
+		s.w.Close()
+		return nil, err
+	}
+	a.nextID++
+	s.id = strconv.Itoa(a.nextID)
+	a.sessions[s.id] = s
+	return s.metrics(), nil
+}
+
+// There is room for another session.
+func (a *api) checkSessions() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.checkSessionsLocked()
+}
+
+// Like checkSessions, with the lock of the api already acquired.
+func (a *api) checkSessionsLocked() error {
+	if len(a.sessions) >= a.lim.Sessions {
+		return errorf(http.StatusTooManyRequests, "too many sessions, the limit is %d", a.lim.Sessions)
+	}
+	return nil
+}
+
+// The checkpoint can be restored without panics.
+//
+// The Config of the checkpoint must be valid.
+func validateCheckpoint(cp *firefly.Checkpoint) error {
+	c := cp.Config
+	sizeW, sizeH := float32(c.CellWNum)*c.CellSize, float32(c.CellHNum)*c.CellSize
+	sizeD := float32(c.CellDNum) * c.CellSize
+	ids := map[int]bool{}
+	for _, f := range cp.Fireflies {
+		if f.Id < 0 || f.Id >= cp.NextID || ids[f.Id] {
+			return errorf(http.StatusBadRequest, "checkpoint: invalid or duplicate firefly id %d", f.Id)
+		}
+		ids[f.Id] = true
+		if f.Period <= 0 || !inSide(f.X, sizeW) || !inSide(f.Y, sizeH) || (c.CellDNum > 0 && !inSide(f.Z, sizeD)) {
+			return errorf(http.StatusBadRequest, "checkpoint: invalid state of firefly %d", f.Id)
+		}
+		if cp.Graph != nil && f.Id >= cp.Graph.N {
+			return errorf(http.StatusBadRequest, "checkpoint: firefly %d is not in the graph", f.Id)
+		}
+	}
+
+	// each node of the graph is a firefly, and the edges join the nodes
+	if g := cp.Graph; g != nil {
+		if g.N < 0 || len(g.Adj) != g.N || len(cp.Fireflies) != g.N {
+			return errorf(http.StatusBadRequest, "checkpoint: the graph of %d nodes has %d lists of neighbours and %d fireflies",
+				g.N, len(g.Adj), len(cp.Fireflies))
+		}
+		for i, adj := range g.Adj {
+			for _, n := range adj {
+				if n < 0 || n >= g.N {
+					return errorf(http.StatusBadRequest, "checkpoint: node %d has the neighbour %d out of the graph", i, n)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The coordinate is in [0, size), and not NaN.
+func inSide(v, size float32) bool {
+	return v >= 0 && v < size
+}
+
+// The world respects the limits of the sessions.
+func (a *api) checkLimits(c firefly.Config, n int) error {
+	if err := c.Validate(); err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	layers := c.CellDNum
+	if layers < 1 {
+		layers = 1
+	}
+	if cells := int64(c.CellWNum) * int64(c.CellHNum) * int64(layers); cells > int64(a.lim.Cells) {
+		return errorf(http.StatusBadRequest, "%d cells, the limit is %d", cells, a.lim.Cells)
+	}
+	if n < 0 || n > a.lim.Fireflies {
+		return errorf(http.StatusBadRequest, "%d fireflies, the limit is %d", n, a.lim.Fireflies)
+	}
+	return nil
+}
+
+// List the sessions, sorted by id.
+func (a *api) list() []metrics {
+	a.mu.Lock()
+	all := make([]*session, 0, len(a.sessions))
+	for _, s := range a.sessions {
+		all = append(all, s)
+	}
+	a.mu.Unlock()
+
+	ms := []metrics{}
+	for _, s := range all {
+		s.mu.Lock()
+		if s.w != nil {
+			ms = append(ms, s.metrics())
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		ni, _ := strconv.Atoi(ms[i].Id)
+		nj, _ := strconv.Atoi(ms[j].Id)
+		return ni < nj
+	})
+	return ms
+}
+
+// Run fn with the session locked.
+func (a *api) with(id string, fn func(s *session) (interface{}, error)) (interface{}, error) {
+	a.mu.Lock()
+	s, ok := a.sessions[id]
+	a.mu.Unlock()
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "no session %q", id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// deleted while waiting for the lock
+	if s.w == nil {
+		return nil, errorf(http.StatusNotFound, "no session %q", id)
+	}
+	s.lastUsed = time.Now()
+	return fn(s)
+}
+
+// Close the world of the session and forget it.
+func (a *api) delete(id string) (interface{}, error) {
+	a.mu.Lock()
+	s, ok := a.sessions[id]
+	delete(a.sessions, id)
+	a.mu.Unlock()
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "no session %q", id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil, errorf(http.StatusNotFound, "no session %q", id)
+	}
+	m := s.metrics()
+	s.w.Close()
+	s.w = nil
+	return m, nil
+}
+
+// Delete the sessions that were not used for a while.
+func (a *api) reap() {
+	for range time.Tick(a.lim.Idle / 10) {
+		a.reapIdle()
+	}
+}
+
+// Delete the sessions not used for longer than the idle limit.
+func (a *api) reapIdle() {
+	a.mu.Lock()
+	all := []*session{}
+	for _, s := range a.sessions {
+		all = append(all, s)
+	}
+	a.mu.Unlock()
+	for _, s := range all {
+		s.mu.Lock()
+		idle := s.w != nil && time.Since(s.lastUsed) > a.lim.Idle
+		s.mu.Unlock()
+		if idle {
+			a.delete(s.id)
+		}
+	}
+}
+
+// Step the world of the session.
+func (a *api) step(s *session, ticks int) (interface{}, error) {
+	if ticks < 0 || ticks > a.lim.Ticks {
+		return nil, errorf(http.StatusBadRequest, "%d ticks, the limit is %d per request", ticks, a.lim.Ticks)
+	}
+	for i := 0; i < ticks; i++ {
+		s.w.Step()
+		// the lifecycle might grow the swarm past the limit
+		if pop := s.w.Population(); pop > a.lim.Fireflies {
+			s.w.RemoveFireflies(pop - a.lim.Fireflies)
+		}
+	}
+	return s.metrics(), nil
+}
+
+// Positions and phases of the fireflies, sorted by id.
+func fireflies(s *session) firefliesResp {
+	fr := s.w.Frame()
+	res := firefliesResp{Clock: fr.Clock, Fireflies: make([]fireflyResp, len(fr.Fireflies))}
+	for i, f := range fr.Fireflies {
+		ph := float64(fr.Clock-f.LastBlink) / float64(f.Period)
+		res.Fireflies[i] = fireflyResp{f, ph - math.Floor(ph)}
+	}
+	return res
+}
+
+// Change the parameters of the world of the session.
+//
+// The Config in the request is merged over the current one:
+// the size of the world, the clock and the seed cannot change,
+// nor the number of fireflies of a graph.
+func (a *api) reconfigure(s *session, req configReq) (interface{}, error) {
+	old := s.w.Config()
+	c := firefly.Config{}
+	// a round trip copies the lifecycle, so that a bad request does not change it
+	data, _ := json.Marshal(old)
+	json.Unmarshal(data, &c)
+	if req.Config != nil {
+		if err := json.Unmarshal(req.Config, &c); err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid config: %v", err)
+		}
+	}
+	if c.CellWNum != old.CellWNum || c.CellHNum != old.CellHNum || c.CellDNum != old.CellDNum ||
+		c.CellSize != old.CellSize || c.Bounded != old.Bounded || c.Clock != old.Clock || c.Seed != old.Seed {
+		return nil, errorf(http.StatusBadRequest, "the size, clock and seed of a world cannot change, create a new session")
+	}
+	n := s.w.Population()
+	if req.Fireflies != nil {
+		n = *req.Fireflies
+	}
+	// the fireflies of a graph are its nodes
+	if s.w.Graph != nil && n != s.w.Population() {
+		return nil, errorf(http.StatusBadRequest, "the fireflies of a graph cannot change, create a new session")
+	}
+	if err := a.checkLimits(c, n); err != nil {
+		return nil, err
+	}
+
+	w := s.w
+	w.ClockTickLen = c.ClockTickLen
+	w.NudgeAmount = c.NudgeAmount
+	w.SetNudgeRadius(c.NudgeRadius)
+	w.BlinkCooldown = c.BlinkCooldown
+	w.PeriodMin = c.PeriodMin
+	w.PeriodMax = c.PeriodMax
+	w.Perception = c.Perception
+	w.PerceptionScale = c.PerceptionScale
+	w.DetectionProb = c.DetectionProb
+	w.Coupling = c.Coupling
+	w.Deterministic = c.Deterministic
+	// a new lifecycle would forget the fraction of firefly waiting to emerge
+	if string(mustJSON(c.Lifecycle)) != string(mustJSON(old.Lifecycle)) {
+		w.Lifecycle = c.Lifecycle
+	}
+	if string(mustJSON(c.Adaptive)) != string(mustJSON(old.Adaptive)) {
+		w.SetAdaptive(c.Adaptive)
+	}
+
+	if pop := w.Population(); pop > n {
+		w.RemoveFireflies(pop - n)
+	} else {
+		w.AddFireflies(n - pop)
+	}
+	return w.Config(), nil
+}
+
+// Encode the value as JSON, to compare the parameters.
+func mustJSON(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Pitrified/go-firefly"
+	"github.com/stretchr/testify/assert"
+)
+
+// Limits large enough for the tests.
+var testLimits = limits{Sessions: 2, Cells: 64, Fireflies: 500, Ticks: 100, Idle: time.Minute}
+
+// Config of a small world.
+func testConfig() firefly.Config {
+	w := firefly.NewWorld(4, 3, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	defer w.Close()
+	c := w.Config()
+	c.Seed = 7
+	return c
+}
+
+// Send the request to the api, decode the reply in v if not nil and return the status code.
+func do(t *testing.T, a *api, method, path string, body, v interface{}) int {
+	t.Helper()
+	data := []byte{}
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		assert.NoError(t, err)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewReader(data)))
+	if v != nil {
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(v), rec.Body.String())
+	}
+	return rec.Code
+}
+
+// A session is created, stepped and restored from its snapshot.
+func TestAPISession(t *testing.T) {
+	a := newAPI(testLimits)
+
+	m := metrics{}
+	assert.Equal(t, http.StatusCreated, do(t, a, "POST", "/sessions", createReq{Config: ptr(testConfig()), Fireflies: 40}, &m))
+	assert.Equal(t, "1", m.Id)
+	assert.Equal(t, 40, m.Population)
+
+	start := m.Clock
+	assert.Equal(t, http.StatusOK, do(t, a, "POST", "/sessions/1/step", map[string]int{"Ticks": 10}, &m))
+	assert.Equal(t, start+10*25_000, m.Clock)
+
+	fr := firefliesResp{}
+	assert.Equal(t, http.StatusOK, do(t, a, "GET", "/sessions/1/fireflies", nil, &fr))
+	assert.Len(t, fr.Fireflies, 40)
+	for _, f := range fr.Fireflies {
+		assert.True(t, f.Phase >= 0 && f.Phase < 1, "%+v", f)
+	}
+
+	// the snapshot restores the same world
+	cp := firefly.Checkpoint{}
+	assert.Equal(t, http.StatusOK, do(t, a, "GET", "/sessions/1/snapshot", nil, &cp))
+	assert.Equal(t, http.StatusCreated, do(t, a, "POST", "/sessions", createReq{Checkpoint: &cp}, &m))
+	assert.Equal(t, "2", m.Id)
+	restored := firefliesResp{}
+	assert.Equal(t, http.StatusOK, do(t, a, "GET", "/sessions/2/fireflies", nil, &restored))
+	assert.Equal(t, fr, restored)
+
+	list := []metrics{}
+	assert.Equal(t, http.StatusOK, do(t, a, "GET", "/sessions", nil, &list))
+	assert.Len(t, list, 2)
+
+	assert.Equal(t, http.StatusOK, do(t, a, "DELETE", "/sessions/1", nil, &m))
+	assert.Equal(t, http.StatusNotFound, do(t, a, "GET", "/sessions/1", nil, nil))
+	assert.Equal(t, http.StatusNotFound, do(t, a, "GET", "/nowhere/1/2/3", nil, nil))
+}
+
+// The requests past the limits are refused, and do not take a slot.
+func TestAPILimits(t *testing.T) {
+	a := newAPI(testLimits)
+
+	big := testConfig()
+	big.CellWNum = 100
+	short := testConfig()
+	short.PeriodMin, short.PeriodMax = 999, 999
+	for _, req := range []createReq{
+		{},
+		{Config: ptr(big), Fireflies: 10},
+		{Config: ptr(testConfig()), Fireflies: 1000},
+		{Config: ptr(testConfig()), Fireflies: -1},
+		{Config: ptr(short), Fireflies: 10},
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(t, a, "POST", "/sessions", req, nil), "%+v", req)
+	}
+	assert.Empty(t, a.sessions)
+
+	for i := 0; i < testLimits.Sessions; i++ {
+		assert.Equal(t, http.StatusCreated, do(t, a, "POST", "/sessions", createReq{Config: ptr(testConfig())}, nil))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, do(t, a, "POST", "/sessions", createReq{Config: ptr(testConfig())}, nil))
+
+	assert.Equal(t, http.StatusBadRequest, do(t, a, "POST", "/sessions/1/step", map[string]int{"Ticks": 1000}, nil))
+	assert.Equal(t, http.StatusBadRequest, do(t, a, "POST", "/sessions/1/config",
+		map[string]interface{}{"Config": map[string]int{"PeriodMin": 500}}, nil))
+	assert.Equal(t, http.StatusBadRequest, do(t, a, "POST", "/sessions/1/config",
+		map[string]interface{}{"Config": map[string]int{"CellWNum": 5}}, nil))
+
+	// the parameters change, and the fireflies follow the request
+	c := firefly.Config{}
+	assert.Equal(t, http.StatusOK, do(t, a, "POST", "/sessions/1/config",
+		map[string]interface{}{"Config": map[string]int{"NudgeAmount": 5000}, "Fireflies": 30}, &c))
+	assert.Equal(t, 5000, c.NudgeAmount)
+	m := metrics{}
+	assert.Equal(t, http.StatusOK, do(t, a, "GET", "/sessions/1", nil, &m))
+	assert.Equal(t, 30, m.Population)
+}
+
+// The checkpoints that would not restore are refused.
+func TestAPICheckpointInvalid(t *testing.T) {
+	w := firefly.NewWorldFromConfig(testConfig())
+	w.SetGraph(firefly.NewRingGraph(3, 1))
+	good := w.Checkpoint()
+	w.Close()
+
+	for name, change := range map[string]func(cp *firefly.Checkpoint){
+		"missing node":    func(cp *firefly.Checkpoint) { cp.Fireflies = cp.Fireflies[:2] },
+		"short adjacency": func(cp *firefly.Checkpoint) { cp.Graph = &firefly.Graph{N: 3, Adj: cp.Graph.Adj[:2]} },
+		"far neighbour":   func(cp *firefly.Checkpoint) { cp.Graph = &firefly.Graph{N: 3, Adj: [][]int{{1}, {2}, {7}}} },
+		"far firefly":     func(cp *firefly.Checkpoint) { cp.Fireflies[0].X = 3e38 },
+		"negative":        func(cp *firefly.Checkpoint) { cp.Fireflies[1].Y = -1 },
+		"duplicate id":    func(cp *firefly.Checkpoint) { cp.Fireflies[1].Id = cp.Fireflies[0].Id },
+		"no period":       func(cp *firefly.Checkpoint) { cp.Fireflies[2].Period = 0 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			a := newAPI(testLimits)
+			// a round trip gives a copy to change
+			cp := firefly.Checkpoint{}
+			data, _ := json.Marshal(good)
+			assert.NoError(t, json.Unmarshal(data, &cp))
+			change(&cp)
+			assert.Equal(t, http.StatusBadRequest, do(t, a, "POST", "/sessions", createReq{Checkpoint: &cp}, nil))
+			assert.Empty(t, a.sessions)
+		})
+	}
+
+	a := newAPI(testLimits)
+	assert.Equal(t, http.StatusCreated, do(t, a, "POST", "/sessions", createReq{Checkpoint: good}, nil))
+	assert.Equal(t, http.StatusOK, do(t, a, "POST", "/sessions/1/step", map[string]int{"Ticks": 5}, nil))
+
+	// the nodes of the graph stay, the other parameters change
+	assert.Equal(t, http.StatusBadRequest, do(t, a, "POST", "/sessions/1/config", map[string]int{"Fireflies": 2}, nil))
+	assert.Equal(t, http.StatusBadRequest, do(t, a, "POST", "/sessions/1/config", map[string]int{"Fireflies": 4}, nil))
+	assert.Equal(t, http.StatusOK, do(t, a, "POST", "/sessions/1/config",
+		map[string]interface{}{"Config": map[string]int{"NudgeAmount": 5000}, "Fireflies": 3}, nil))
+	m := metrics{}
+	assert.Equal(t, http.StatusOK, do(t, a, "GET", "/sessions/1", nil, &m))
+	assert.Equal(t, 3, m.Population)
+}
+
+// The sessions not used for a while are deleted, freeing their slot.
+func TestAPIReap(t *testing.T) {
+	a := newAPI(testLimits)
+	for i := 0; i < testLimits.Sessions; i++ {
+		assert.Equal(t, http.StatusCreated, do(t, a, "POST", "/sessions", createReq{Config: ptr(testConfig())}, nil))
+	}
+	a.sessions["1"].lastUsed = time.Now().Add(-2 * testLimits.Idle)
+	a.reapIdle()
+
+	assert.Equal(t, http.StatusNotFound, do(t, a, "GET", "/sessions/1", nil, nil))
+	assert.Equal(t, http.StatusOK, do(t, a, "GET", "/sessions/2", nil, nil))
+	assert.Equal(t, http.StatusCreated, do(t, a, "POST", "/sessions", createReq{Config: ptr(testConfig())}, nil))
+}
+
+func ptr(c firefly.Config) *firefly.Config {
+	return &c
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Pitrified/go-firefly"
+)
+
+//go:embed viewer.html
+var viewerHTML []byte
+
+// Parameters of the world, as set from the viewer.
+//
+// The first group can change while the world runs, the second needs a reset.
+type params struct {
+	Fireflies   int    // Number of fireflies requested.
+	NudgeAmount int    // How much to nudge the deadlines, in ms.
+	NudgeRadius int    // Max distance between interacting fireflies, in pixels.
+	Interact    bool   // Do the interactions between fireflies.
+	Lifecycle   bool   // Birth and death of the fireflies.
+	Coupling    string // Coupling mode: exc, inh or reset.
+
+	CellsW    int // Width of the world in cells.
+	CellsH    int // Height of the world in cells.
+	CellSize  int // Size of each cell in pixels.
+	PeriodMin int // Minimum period of the fireflies, in ms.
+	PeriodMax int // Maximum period of the fireflies, in ms.
+}
+
+// Check that the parameters make a valid world.
+func (p params) validate() error {
+	switch {
+	case p.Fireflies < 0 || p.Fireflies > 200_000:
+		return fmt.Errorf("fireflies must be in [0, 200000], got %d", p.Fireflies)
+	case p.NudgeAmount < 0:
+		return fmt.Errorf("nudge amount cannot be negative, got %d", p.NudgeAmount)
+	case p.NudgeRadius < 0:
+		return fmt.Errorf("nudge radius cannot be negative, got %d", p.NudgeRadius)
+	case p.CellsW < 1 || p.CellsH < 1 || p.CellSize < 1:
+		return fmt.Errorf("the world needs at least a cell, got %dx%d cells of %d px", p.CellsW, p.CellsH, p.CellSize)
+	case p.CellsW*p.CellSize > math.MaxUint16 || p.CellsH*p.CellSize > math.MaxUint16:
+		return fmt.Errorf("the world can be at most %d px wide", math.MaxUint16)
+	case p.PeriodMin < 1 || p.PeriodMax < p.PeriodMin:
+		return fmt.Errorf("invalid period range [%d, %d]", p.PeriodMin, p.PeriodMax)
+	}
+	_, err := firefly.ParseCoupling(p.Coupling)
+	return err
+}
+
+// Server runs a World and streams its frames to the viewers.
+type server struct {
+	mu      sync.Mutex // Lock to acquire before touching the world or the params.
+	w       *firefly.World
+	p       params  // Parameters of the running world.
+	next    *params // Parameters requested, applied between the steps.
+	reset   bool    // The next parameters need a new world.
+	seed    int64   // Seed of the worlds, random if 0.
+	decay   float64 // Decay rate of the brightness since the blink.
+	fps     int     // Steps per second.
+	clients map[chan []byte]bool
+	cMu     sync.Mutex // Lock to acquire before touching the clients.
+}
+
+func newServer(p params, seed int64) *server {
+	s := &server{}
+	s.p = p
+	s.seed = seed
+	s.decay = 1.0 / 600_000.0
+	s.fps = 25
+	s.clients = map[chan []byte]bool{}
+	s.resetWorld()
+	return s
+}
+
+// Create a new world with the current params.
+func (s *server) resetWorld() {
+	if s.w != nil {
+		s.w.Close()
+	}
+	p := s.p
+	s.w = firefly.NewWorld(
+		p.CellsW, p.CellsH, float32(p.CellSize),
+		1_000_000, 25_000,
+		p.NudgeAmount*1000, float32(p.NudgeRadius),
+		500_000,
+		p.PeriodMin*1000, p.PeriodMax*1000,
+	)
+	if s.seed != 0 {
+		s.w.SetSeed(s.seed)
+	}
+	s.w.HatchFireflies(p.Fireflies)
+	s.configWorld()
+}
+
+// Apply the params that do not need a reset to the world.
+func (s *server) configWorld() {
+	p := s.p
+	s.w.NudgeAmount = p.NudgeAmount * 1000
+	// to stop the interaction set the radius to 0
+	if p.Interact {
+		s.w.SetNudgeRadius(float32(p.NudgeRadius))
+	} else {
+		s.w.SetNudgeRadius(0)
+	}
+	s.w.Coupling, _ = firefly.ParseCoupling(p.Coupling)
+
+	// the emergence balances the deaths around the requested number of fireflies
+	if p.Lifecycle {
+		lifespanMin, lifespanMax := 20_000_000, 40_000_000
+		rate := float64(p.Fireflies) * 2_000_000 / float64(lifespanMin+lifespanMax)
+		s.w.Lifecycle = firefly.NewLifecycle(rate, lifespanMin, lifespanMax)
+	} else {
+		s.w.Lifecycle = nil
+	}
+
+	// add/remove fireflies, the current population might have changed with the lifecycle
+	pop := s.w.Population()
+	if pop > p.Fireflies {
+		s.w.RemoveFireflies(pop - p.Fireflies)
+	} else {
+		s.w.AddFireflies(p.Fireflies - pop)
+	}
+}
+
+// Step the world at a fixed rate, and send the frames to the viewers.
+func (s *server) run() {
+	tick := time.NewTicker(time.Second / time.Duration(s.fps))
+	for range tick.C {
+		s.mu.Lock()
+		if s.next != nil {
+			s.p = *s.next
+			if s.reset {
+				s.resetWorld()
+			} else {
+				s.configWorld()
+			}
+			s.next = nil
+			s.reset = false
+			s.broadcast(s.paramsEvent())
+		}
+		s.w.Step()
+		msg := s.frameEvent()
+		s.mu.Unlock()
+		s.broadcast(msg)
+	}
+}
+
+// Encode the state of the world as a frame event.
+//
+// The fireflies are packed in 5 bytes each: x and y as uint16 and the brightness as uint8,
+// little endian and in base64.
+func (s *server) frameEvent() []byte {
+	fr := s.w.Frame()
+	data := make([]byte, 5*len(fr.Fireflies))
+	for i, f := range fr.Fireflies {
+		since := fr.Clock - f.LastBlink
+		br := 0.0
+		if since >= 0 {
+			br = math.Exp(-float64(since) * s.decay)
+		}
+		binary.LittleEndian.PutUint16(data[5*i:], uint16(f.X))
+		binary.LittleEndian.PutUint16(data[5*i+2:], uint16(f.Y))
+		data[5*i+4] = uint8(math.Round(br * 255))
+	}
+	return sseEvent("frame", map[string]interface{}{
+		"clock":      fr.Clock,
+		"width":      s.w.SizeW,
+		"height":     s.w.SizeH,
+		"cellSize":   s.w.CellSize,
+		"population": s.w.Population(),
+		"order":      s.w.OrderParameter(),
+		"data":       base64.StdEncoding.EncodeToString(data),
+	})
+}
+
+// Encode the current params as an event.
+func (s *server) paramsEvent() []byte {
+	return sseEvent("params", s.p)
+}
+
+// Format a Server-Sent Event with a JSON payload.
+func sseEvent(name string, v interface{}) []byte {
+	payload, _ := json.Marshal(v)
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, payload))
+}
+
+// Send the event to all the viewers, dropping it for the ones lagging behind.
+func (s *server) broadcast(msg []byte) {
+	s.cMu.Lock()
+	defer s.cMu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// Serve the embedded viewer.
+func (s *server) handleViewer(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Write(viewerHTML)
+}
+
+// Stream the params and the frames as Server-Sent Events.
+func (s *server) handleEvents(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+
+	ch := make(chan []byte, 4)
+	s.cMu.Lock()
+	s.clients[ch] = true
+	s.cMu.Unlock()
+	defer func() {
+		s.cMu.Lock()
+		delete(s.clients, ch)
+		s.cMu.Unlock()
+	}()
+
+	s.mu.Lock()
+	rw.Write(s.paramsEvent())
+	s.mu.Unlock()
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			if _, err := rw.Write(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Change the params of the world, reset it if requested.
+//
+// The body is the JSON of all the params, the change is applied before the next step.
+func (s *server) handleParams(reset bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		s.mu.Lock()
+		p := s.p
+		s.mu.Unlock()
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.next = &p
+		s.reset = s.reset || reset
+		s.mu.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(p)
+	}
+}
+
+// Serves a live World to the browsers, with an embedded viewer,
+// and independent worlds to the scripts through a JSON API.
+func main() {
+	addr := flag.String("addr", ":8080", "Address to serve the viewer on.")
+	cw := flag.Int("cw", 4, "Width of the world in cells.")
+	ch := flag.Int("ch", 4, "Height of the world in cells.")
+	cellSize := flag.Int("cs", 100, "Size of each cell.")
+	nF := flag.Int("nf", 2000, "Number of fireflies to simulate.")
+	seed := flag.Int64("seed", 0, "Seed of the random source, random if 0.")
+	lim := limits{}
+	flag.IntVar(&lim.Sessions, "max-sessions", 8, "Sessions of the API running at the same time.")
+	flag.IntVar(&lim.Cells, "max-cells", 1024, "Cells of the world of each session.")
+	flag.IntVar(&lim.Fireflies, "max-fireflies", 200_000, "Fireflies in the world of each session.")
+	flag.IntVar(&lim.Ticks, "max-ticks", 100_000, "Ticks per step request of the API.")
+	flag.DurationVar(&lim.Idle, "idle", 30*time.Minute, "Delete the sessions of the API not used for this long.")
+	flag.Parse()
+
+	p := params{
+		Fireflies:   *nF,
+		NudgeAmount: 20,
+		NudgeRadius: 12,
+		Interact:    true,
+		Coupling:    firefly.CouplingExcitatory.String(),
+		CellsW:      *cw,
+		CellsH:      *ch,
+		CellSize:    *cellSize,
+		PeriodMin:   900,
+		PeriodMax:   1100,
+	}
+	if err := p.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if lim.Sessions < 0 || lim.Cells < 1 || lim.Fireflies < 0 || lim.Ticks < 0 || lim.Idle <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: invalid limits of the sessions")
+		os.Exit(1)
+	}
+
+	s := newServer(p, *seed)
+	go s.run()
+
+	http.HandleFunc("/", s.handleViewer)
+	http.HandleFunc("/events", s.handleEvents)
+	http.HandleFunc("/config", s.handleParams(false))
+	http.HandleFunc("/reset", s.handleParams(true))
+
+	a := newAPI(lim)
+	go a.reap()
+	http.Handle("/sessions", a)
+	http.Handle("/sessions/", a)
+	fmt.Printf("serving on %s\n", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
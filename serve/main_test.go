@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Pitrified/go-firefly"
+	"github.com/stretchr/testify/assert"
+)
+
+// Params of the default world of the viewer.
+func testParams() params {
+	return params{
+		Fireflies:   100,
+		NudgeAmount: 20,
+		NudgeRadius: 12,
+		Interact:    true,
+		Coupling:    "exc",
+		CellsW:      4,
+		CellsH:      4,
+		CellSize:    100,
+		PeriodMin:   900,
+		PeriodMax:   1100,
+	}
+}
+
+// The params are checked against the bounds of the world and of the frames.
+func TestParamsValidate(t *testing.T) {
+	assert.NoError(t, testParams().validate())
+
+	for _, tc := range []struct {
+		name  string
+		edit  func(p *params)
+		valid bool
+	}{
+		{"no fireflies", func(p *params) { p.Fireflies = 0 }, true},
+		{"most fireflies", func(p *params) { p.Fireflies = 200_000 }, true},
+		{"too many fireflies", func(p *params) { p.Fireflies = 200_001 }, false},
+		{"negative fireflies", func(p *params) { p.Fireflies = -1 }, false},
+		{"negative nudge", func(p *params) { p.NudgeAmount = -1 }, false},
+		{"negative radius", func(p *params) { p.NudgeRadius = -1 }, false},
+		{"no cells", func(p *params) { p.CellsW = 0 }, false},
+		{"empty cells", func(p *params) { p.CellSize = 0 }, false},
+		// the positions are sent as uint16
+		{"widest world", func(p *params) { p.CellsW, p.CellSize = 5, 13107 }, true},
+		{"too wide", func(p *params) { p.CellsW, p.CellSize = 5, 13108 }, false},
+		{"too high", func(p *params) { p.CellsH = 1000 }, false},
+		{"shortest period", func(p *params) { p.PeriodMin, p.PeriodMax = 1, 1 }, true},
+		{"no period", func(p *params) { p.PeriodMin = 0 }, false},
+		{"inverted periods", func(p *params) { p.PeriodMin, p.PeriodMax = 1100, 900 }, false},
+		{"reset coupling", func(p *params) { p.Coupling = "reset" }, true},
+		{"unknown coupling", func(p *params) { p.Coupling = "magnetic" }, false},
+	} {
+		p := testParams()
+		tc.edit(&p)
+		if tc.valid {
+			assert.NoError(t, p.validate(), tc.name)
+		} else {
+			assert.Error(t, p.validate(), tc.name)
+		}
+	}
+}
+
+// The fireflies are packed in 5 bytes: x and y as little endian uint16, then the brightness.
+func TestFrameEvent(t *testing.T) {
+	w := firefly.NewWorld(8, 6, 100, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	defer w.Close()
+	// blinking now, a decay time ago, and not yet
+	firefly.NewFirefly(10.7, 20.2, 0, 0, 1_000_000, w).SetNextBlink(w.Clock + 1_000_000)
+	firefly.NewFirefly(700.2, 300.9, 0, 1, 1_000_000, w).SetNextBlink(w.Clock + 400_000)
+	firefly.NewFirefly(0, 599.5, 0, 2, 1_000_000, w).SetNextBlink(w.Clock + 2_000_000)
+
+	s := &server{w: w, decay: 1.0 / 600_000.0}
+	msg := string(s.frameEvent())
+	assert.True(t, strings.HasPrefix(msg, "event: frame\ndata: "), msg)
+	assert.True(t, strings.HasSuffix(msg, "\n\n"), msg)
+
+	ev := struct {
+		Clock      int
+		Width      float32
+		Population int
+		Data       string
+	}{}
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(msg, "event: frame\ndata: ")), &ev))
+	assert.Equal(t, w.Clock, ev.Clock)
+	assert.Equal(t, float32(800), ev.Width)
+	assert.Equal(t, 3, ev.Population)
+
+	data, err := base64.StdEncoding.DecodeString(ev.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		10, 0, 20, 0, 255,
+		0xbc, 0x02, 0x2c, 0x01, 94, // 700, 300 and 255/e
+		0, 0, 0x57, 0x02, 0,
+	}, data)
+}
@@ -0,0 +1,331 @@
+package firefly
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Magic bytes at the start of a trace, followed by the version.
+const (
+	traceMagic   = "FFTR"
+	traceVersion = 1
+)
+
+// Kinds of frame in a trace.
+const (
+	traceKeyFrame   = 'K' // Fields encoded from zero, the trace can be read from here.
+	traceDeltaFrame = 'D' // Fields encoded as difference from the previous frame.
+)
+
+// Number of quantization steps for the positions, along each side of the world.
+const traceQuantum = 1 << 16
+
+// Limits of a trace, so that a corrupted one cannot allocate huge buffers.
+const (
+	traceMaxHeader    = 1 << 20 // Length of the JSON header.
+	traceMaxFireflies = 1 << 24 // Fireflies in a frame.
+	tracePrealloc     = 1 << 12 // Fireflies allocated before reading them.
+)
+
+// TraceHeader is stored at the start of a trace.
+type TraceHeader struct {
+	Config   Config // Parameters of the recorded World.
+	KeyEvery int    // A key frame is written every this many frames.
+}
+
+// TraceWriter records the frames of a World in a compact binary trace.
+//
+// The positions are quantized to 1/65536 of the world size,
+// and every field is written as a varint difference from the previous frame,
+// so that the fireflies that barely moved take a few bytes each.
+//
+// The trace starts with the magic "FFTR", a version byte and the TraceHeader
+// as a length prefixed JSON.
+// Each frame is a kind byte ('K' or 'D'), the clock, the number of fireflies,
+// and for each firefly sorted by id:
+// id, x, y, orientation, period and last blink,
+// followed by z and pitch in a 3D world.
+type TraceWriter struct {
+	bw     *bufio.Writer
+	header TraceHeader
+	prev   map[int]traceEntry // Quantized state in the previous frame.
+	frames int                // Frames written.
+	buf    []byte             // Scratch space for the varints.
+}
+
+// TraceReader decodes the frames of a trace.
+type TraceReader struct {
+	Header TraceHeader // Header of the trace.
+
+	br   *bufio.Reader
+	prev map[int]traceEntry // Quantized state in the previous frame.
+}
+
+// Quantized state of a firefly.
+type traceEntry struct {
+	qx, qy    int64
+	qz        int64
+	o         int64
+	p         int64
+	period    int64
+	lastBlink int64
+}
+
+// NewTraceWriter writes the header of a trace for a World with the Config.
+//
+// A key frame is written every keyEvery frames, if keyEvery <= 0 only the first one is.
+func NewTraceWriter(w io.Writer, c Config, keyEvery int) (*TraceWriter, error) {
+	tw := &TraceWriter{}
+	tw.bw = bufio.NewWriter(w)
+	tw.header = TraceHeader{Config: c, KeyEvery: keyEvery}
+	tw.buf = make([]byte, binary.MaxVarintLen64)
+
+	head, err := json.Marshal(tw.header)
+	if err != nil {
+		return nil, err
+	}
+	tw.bw.WriteString(traceMagic)
+	tw.bw.WriteByte(traceVersion)
+	tw.putUvarint(uint64(len(head)))
+	if _, err := tw.bw.Write(head); err != nil {
+		return nil, err
+	}
+	return tw, nil
+}
+
+// WriteFrame appends the current state of the World to the trace.
+//
+// Must be called between steps.
+func (tw *TraceWriter) WriteFrame(w *World) error {
+	return tw.Write(w.Frame())
+}
+
+// Write appends the frame to the trace.
+func (tw *TraceWriter) Write(fr *Frame) error {
+	c := tw.header.Config
+	key := tw.frames == 0 || (tw.header.KeyEvery > 0 && tw.frames%tw.header.KeyEvery == 0)
+	if key {
+		tw.bw.WriteByte(traceKeyFrame)
+		tw.prev = map[int]traceEntry{}
+	} else {
+		tw.bw.WriteByte(traceDeltaFrame)
+	}
+	tw.putVarint(int64(fr.Clock))
+	tw.putUvarint(uint64(len(fr.Fireflies)))
+
+	curr := make(map[int]traceEntry, len(fr.Fireflies))
+	prevId := 0
+	for _, s := range fr.Fireflies {
+		e := traceEntry{
+			qx:        quantize(s.X, c.CellSize*float32(c.CellWNum)),
+			qy:        quantize(s.Y, c.CellSize*float32(c.CellHNum)),
+			qz:        quantize(s.Z, c.CellSize*float32(c.CellDNum)),
+			o:         int64(s.O),
+			p:         int64(s.P),
+			period:    int64(s.Period),
+			lastBlink: int64(s.LastBlink),
+		}
+		p := tw.prev[s.Id]
+		tw.putVarint(int64(s.Id - prevId))
+		tw.putVarint(wrapDelta(e.qx - p.qx))
+		tw.putVarint(wrapDelta(e.qy - p.qy))
+		tw.putVarint(e.o - p.o)
+		tw.putVarint(e.period - p.period)
+		tw.putVarint(e.lastBlink - p.lastBlink)
+		if c.CellDNum > 0 {
+			tw.putVarint(wrapDelta(e.qz - p.qz))
+			tw.putVarint(e.p - p.p)
+		}
+		curr[s.Id] = e
+		prevId = s.Id
+	}
+	tw.prev = curr
+	tw.frames++
+
+	// the errors of the bufio.Writer are sticky, check the last one
+	_, err := tw.bw.Write(nil)
+	return err
+}
+
+// Flush writes the buffered data to the underlying writer.
+func (tw *TraceWriter) Flush() error {
+	return tw.bw.Flush()
+}
+
+func (tw *TraceWriter) putVarint(v int64) {
+	n := binary.PutVarint(tw.buf, v)
+	tw.bw.Write(tw.buf[:n])
+}
+
+func (tw *TraceWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(tw.buf, v)
+	tw.bw.Write(tw.buf[:n])
+}
+
+// NewTraceReader reads the header of a trace.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	tr := &TraceReader{}
+	tr.br = bufio.NewReader(r)
+
+	magic := make([]byte, len(traceMagic)+1)
+	if _, err := io.ReadFull(tr.br, magic); err != nil {
+		return nil, fmt.Errorf("trace: %v", err)
+	}
+	if string(magic[:len(traceMagic)]) != traceMagic {
+		return nil, errors.New("trace: not a firefly trace")
+	}
+	if magic[len(traceMagic)] != traceVersion {
+		return nil, fmt.Errorf("trace: unsupported version %d", magic[len(traceMagic)])
+	}
+	n, err := binary.ReadUvarint(tr.br)
+	if err != nil {
+		return nil, fmt.Errorf("trace: %v", err)
+	}
+	if n > traceMaxHeader {
+		return nil, fmt.Errorf("trace: header of %d bytes is too long", n)
+	}
+	head := make([]byte, n)
+	if _, err := io.ReadFull(tr.br, head); err != nil {
+		return nil, fmt.Errorf("trace: %v", err)
+	}
+	if err := json.Unmarshal(head, &tr.Header); err != nil {
+		return nil, fmt.Errorf("trace: %v", err)
+	}
+	return tr, nil
+}
+
+// Next decodes the next frame, io.EOF is returned at the end of the trace.
+func (tr *TraceReader) Next() (*Frame, error) {
+	kind, err := tr.br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case traceKeyFrame:
+		tr.prev = map[int]traceEntry{}
+	case traceDeltaFrame:
+		if tr.prev == nil {
+			return nil, errors.New("trace: delta frame before the first key frame")
+		}
+	default:
+		return nil, fmt.Errorf("trace: unknown frame kind %q", kind)
+	}
+
+	// any error from now on means a truncated or corrupted frame
+	fail := func(err error) (*Frame, error) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("trace: %v", err)
+	}
+
+	c := tr.Header.Config
+	sizeW := c.CellSize * float32(c.CellWNum)
+	sizeH := c.CellSize * float32(c.CellHNum)
+	sizeD := c.CellSize * float32(c.CellDNum)
+	clock, err := binary.ReadVarint(tr.br)
+	if err != nil {
+		return fail(err)
+	}
+	num, err := binary.ReadUvarint(tr.br)
+	if err != nil {
+		return fail(err)
+	}
+	if num > traceMaxFireflies {
+		return fail(fmt.Errorf("frame of %d fireflies is too large", num))
+	}
+
+	// the slice grows as the fireflies are read, the count might be corrupted
+	prealloc := num
+	if prealloc > tracePrealloc {
+		prealloc = tracePrealloc
+	}
+	fr := &Frame{Clock: int(clock), Fireflies: make([]FireflyState, 0, prealloc)}
+	curr := make(map[int]traceEntry, prealloc)
+	id := 0
+	vals := make([]int64, 6)
+	if c.CellDNum > 0 {
+		vals = make([]int64, 8)
+	}
+	for i := uint64(0); i < num; i++ {
+		for v := range vals {
+			if vals[v], err = binary.ReadVarint(tr.br); err != nil {
+				return fail(err)
+			}
+		}
+		id += int(vals[0])
+		p := tr.prev[id]
+		e := traceEntry{
+			qx:        (p.qx + vals[1]) & (traceQuantum - 1),
+			qy:        (p.qy + vals[2]) & (traceQuantum - 1),
+			o:         p.o + vals[3],
+			period:    p.period + vals[4],
+			lastBlink: p.lastBlink + vals[5],
+		}
+		if c.CellDNum > 0 {
+			e.qz = (p.qz + vals[6]) & (traceQuantum - 1)
+			e.p = p.p + vals[7]
+		}
+		curr[id] = e
+		fr.Fireflies = append(fr.Fireflies, FireflyState{
+			Id:        id,
+			X:         float32(e.qx) * sizeW / traceQuantum,
+			Y:         float32(e.qy) * sizeH / traceQuantum,
+			Z:         float32(e.qz) * sizeD / traceQuantum,
+			O:         int16(e.o),
+			P:         int16(e.p),
+			Period:    int(e.period),
+			LastBlink: int(e.lastBlink),
+		})
+	}
+	tr.prev = curr
+	return fr, nil
+}
+
+// ReadAll decodes all the remaining frames.
+func (tr *TraceReader) ReadAll() ([]*Frame, error) {
+	frames := []*Frame{}
+	for {
+		fr, err := tr.Next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, fr)
+	}
+}
+
+// Quantize a position in [0, size] to [0, traceQuantum).
+//
+// The positions are clamped, not wrapped: a firefly on the far wall of a bounded world stays there.
+func quantize(v, size float32) int64 {
+	if size == 0 {
+		return 0
+	}
+	q := int64(math.Round(float64(v) / float64(size) * traceQuantum))
+	if q < 0 {
+		return 0
+	}
+	if q > traceQuantum-1 {
+		return traceQuantum - 1
+	}
+	return q
+}
+
+// Pick the shortest way around the quantized torus.
+func wrapDelta(d int64) int64 {
+	if d >= traceQuantum/2 {
+		return d - traceQuantum
+	}
+	if d < -traceQuantum/2 {
+		return d + traceQuantum
+	}
+	return d
+}
@@ -0,0 +1,110 @@
+package firefly
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The frames read back match the recorded ones, up to the quantization.
+func TestTraceRoundTrip(t *testing.T) {
+	w := NewWorld(4, 4, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	w.SetSeed(11)
+	w.HatchFireflies(200)
+
+	buf := &bytes.Buffer{}
+	tw, err := NewTraceWriter(buf, w.Config(), 4)
+	assert.NoError(t, err)
+
+	recorded := []*Frame{}
+	for i := 0; i < 10; i++ {
+		fr := w.Frame()
+		recorded = append(recorded, fr)
+		assert.NoError(t, tw.Write(fr))
+		w.Step()
+	}
+	assert.NoError(t, tw.Flush())
+
+	// the delta frames are compact
+	perFirefly := float64(buf.Len()) / float64(10*200)
+	assert.Less(t, perFirefly, 12.0, "The trace should take few bytes per firefly.")
+
+	tr, err := NewTraceReader(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, w.Config().Seed, tr.Header.Config.Seed)
+	assert.Equal(t, 4, tr.Header.KeyEvery)
+
+	frames, err := tr.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, len(recorded), len(frames))
+	for i, fr := range frames {
+		assert.Equal(t, recorded[i].Clock, fr.Clock)
+		assert.Equal(t, len(recorded[i].Fireflies), len(fr.Fireflies))
+		for ii, s := range fr.Fireflies {
+			r := recorded[i].Fireflies[ii]
+			assert.Equal(t, r.Id, s.Id)
+			// the positions wrap around the world
+			dx := AbsFloat32(r.X - s.X)
+			dy := AbsFloat32(r.Y - s.Y)
+			assert.True(t, dx < 0.01 || w.SizeW-dx < 0.01, "Wrong X %v %v", r.X, s.X)
+			assert.True(t, dy < 0.01 || w.SizeH-dy < 0.01, "Wrong Y %v %v", r.Y, s.Y)
+			assert.Equal(t, r.O, s.O)
+			assert.Equal(t, r.Period, s.Period)
+			assert.Equal(t, r.LastBlink, s.LastBlink)
+		}
+	}
+
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+// Invalid or truncated traces are reported.
+func TestTraceInvalid(t *testing.T) {
+	_, err := NewTraceReader(strings.NewReader("NOPE1"))
+	assert.Error(t, err)
+
+	w := NewWorld(3, 3, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
+	w.HatchFireflies(10)
+	buf := &bytes.Buffer{}
+	tw, _ := NewTraceWriter(buf, w.Config(), 0)
+	tw.WriteFrame(w)
+	tw.Flush()
+
+	tr, err := NewTraceReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	assert.NoError(t, err)
+	_, err = tr.Next()
+	assert.Error(t, err)
+	assert.NotEqual(t, io.EOF, err)
+
+	// a corrupted count of fireflies is rejected before allocating
+	bad := &bytes.Buffer{}
+	tw, _ = NewTraceWriter(bad, w.Config(), 0)
+	tw.Flush()
+	bad.WriteByte(traceKeyFrame)
+	bad.Write([]byte{0})                                                    // clock
+	bad.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}) // fireflies
+	tr, err = NewTraceReader(bad)
+	assert.NoError(t, err)
+	_, err = tr.Next()
+	assert.Error(t, err)
+}
+
+// The fireflies on the far wall of a bounded world are replayed there, not on the opposite wall.
+func TestTraceBoundedWall(t *testing.T) {
+	w := NewWorld(2, 2, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_100_000)
+	w.Bounded = true
+	fr := &Frame{Fireflies: []FireflyState{{Id: 0, X: w.SizeW, Y: w.SizeH}}}
+	buf := &bytes.Buffer{}
+	tw, _ := NewTraceWriter(buf, w.Config(), 0)
+	assert.NoError(t, tw.Write(fr))
+	tw.Flush()
+
+	tr, _ := NewTraceReader(buf)
+	got, err := tr.Next()
+	assert.NoError(t, err)
+	assert.InDelta(t, w.SizeW, got.Fireflies[0].X, 0.01)
+	assert.InDelta(t, w.SizeH, got.Fireflies[0].Y, 0.01)
+}
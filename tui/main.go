@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Pitrified/go-firefly"
+)
+
+// Glyphs packing many pixels in a character.
+const (
+	glyphBraille = "braille" // 2x4 dots per character, lit by the fireflies.
+	glyphHalf    = "half"    // 1x2 pixels per character, as the two colours of an upper half block.
+)
+
+// Terminal renders a World on a character grid with ANSI colours.
+type Terminal struct {
+	w         *firefly.World
+	glyph     string  // Glyphs used to draw the pixels.
+	trueColor bool    // Use 24 bit colours instead of the 256 colour palette.
+	decay     float64 // Decay rate of the brightness since the blink.
+	cols      int     // Size of the grid in characters, the status line excluded.
+	rows      int
+	paused    bool
+	out       bytes.Buffer // Frame being drawn, written at once to avoid flickering.
+}
+
+// Size of a character in pixels.
+func (t *Terminal) charSize() (int, int) {
+	if t.glyph == glyphBraille {
+		return 2, 4
+	}
+	return 1, 2
+}
+
+// Bits of the braille dots, indexed by [x][y] in the character.
+var brailleDots = [2][4]rune{{0x01, 0x02, 0x04, 0x40}, {0x08, 0x10, 0x20, 0x80}}
+
+// Draw the world and the status line.
+func (t *Terminal) render() []byte {
+	cw, ch := t.charSize()
+	pw, ph := t.cols*cw, t.rows*ch
+
+	// the pixels are square, keep the aspect ratio of the world
+	scale := math.Min(float64(pw)/float64(t.w.SizeW), float64(ph)/float64(t.w.SizeH))
+
+	// downsample the cells on the pixels, keeping the brightest firefly,
+	// -1 for the pixels without fireflies
+	px := make([]float64, pw*ph)
+	for i := range px {
+		px[i] = -1
+	}
+	for x := range t.w.Cells {
+		for y := range t.w.Cells[x] {
+			for _, f := range t.w.Cells[x][y].Fireflies {
+				ix := int(float64(f.X) * scale)
+				iy := int(float64(f.Y) * scale)
+				if ix < 0 || ix >= pw || iy < 0 || iy >= ph {
+					continue
+				}
+				br := brightness(t.w.Clock-f.LastBlink, t.decay)
+				if br > px[iy*pw+ix] {
+					px[iy*pw+ix] = br
+				}
+			}
+		}
+	}
+
+	t.out.Reset()
+	t.out.WriteString("\x1b[H")
+	for r := 0; r < t.rows; r++ {
+		for c := 0; c < t.cols; c++ {
+			if t.glyph == glyphBraille {
+				dots, max := rune(0), -1.0
+				for dx := 0; dx < 2; dx++ {
+					for dy := 0; dy < 4; dy++ {
+						br := px[(r*4+dy)*pw+c*2+dx]
+						if br >= 0 {
+							dots |= brailleDots[dx][dy]
+						}
+						max = math.Max(max, br)
+					}
+				}
+				if dots == 0 {
+					t.out.WriteString("\x1b[0m ")
+					continue
+				}
+				t.out.WriteString(t.color(38, max))
+				t.out.WriteRune(0x2800 + dots)
+			} else {
+				t.out.WriteString(t.color(38, px[(r*2)*pw+c]))
+				t.out.WriteString(t.color(48, px[(r*2+1)*pw+c]))
+				t.out.WriteRune('▀')
+			}
+		}
+		t.out.WriteString("\x1b[0m\r\n")
+	}
+
+	// status line
+	state := ""
+	if t.paused {
+		state = " [paused]"
+	}
+	status := fmt.Sprintf("t = %.2f s  fireflies %d  order %.3f  radius %.0f%s  |  space pause, s step, +/- radius, q quit",
+		float64(t.w.Clock)/1e6, t.w.Population(), t.w.OrderParameter(), t.w.NudgeRadius, state,
+	)
+	if len(status) > t.cols {
+		status = status[:t.cols]
+	}
+	t.out.WriteString(status)
+	t.out.WriteString("\x1b[K")
+	return t.out.Bytes()
+}
+
+// ANSI escape to set the foreground (38) or background (48) colour of a pixel.
+//
+// The fireflies go from dim to bright yellow as in the GUI, the empty pixels are black.
+func (t *Terminal) color(layer int, br float64) string {
+	r, g, b := 0, 0, 0
+	if br >= 0 {
+		minBr := 30.0
+		r = int((255-minBr)*br + minBr)
+		g, b = r, int(minBr)
+	}
+	if t.trueColor {
+		return fmt.Sprintf("\x1b[%d;2;%d;%d;%dm", layer, r, g, b)
+	}
+	// 6x6x6 colour cube of the 256 colour palette
+	q := func(v int) int { return (v*5 + 127) / 255 }
+	return fmt.Sprintf("\x1b[%d;5;%dm", layer, 16+36*q(r)+6*q(g)+q(b))
+}
+
+// Brightness of a firefly that blinked since us ago.
+func brightness(since int, decay float64) float64 {
+	if since < 0 {
+		return 0
+	}
+	return math.Exp(-float64(since) * decay)
+}
+
+// Run stty on the terminal, returning its output.
+func stty(tty *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Size of the terminal, in characters.
+func termSize(tty *os.File) (int, int, error) {
+	out, err := stty(tty, "size")
+	if err != nil {
+		return 0, 0, err
+	}
+	var rows, cols int
+	_, err = fmt.Sscanf(out, "%d %d", &rows, &cols)
+	return cols, rows, err
+}
+
+// Read the keys pressed on the terminal.
+func readKeys(tty *os.File, keys chan<- byte) {
+	buf := make([]byte, 16)
+	for {
+		n, err := tty.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		for _, k := range buf[:n] {
+			keys <- k
+		}
+	}
+}
+
+// Renders a live World in the terminal, to watch a run over SSH.
+func main() {
+	cw := flag.Int("cw", 8, "Width of the world in cells.")
+	ch := flag.Int("ch", 4, "Height of the world in cells.")
+	cellSize := flag.Int("cs", 80, "Size of each cell.")
+	nudgeRadius := flag.Int("nr", 22, "Max distance between interacting fireflies.")
+	nudgeAmount := flag.Int("na", 20, "How much to nudge the deadlines, in ms.")
+	nF := flag.Int("nf", 1000, "Number of fireflies to simulate.")
+	seed := flag.Int64("seed", 0, "Seed of the random source, random if 0.")
+	glyph := flag.String("glyph", glyphBraille, "Glyphs to draw with: braille or half.")
+	trueColor := flag.Bool("truecolor", false, "Use 24 bit colours instead of the 256 colour palette.")
+	fps := flag.Int("fps", 40, "Steps drawn per second, 40 is real time.")
+	flag.Parse()
+
+	if *glyph != glyphBraille && *glyph != glyphHalf {
+		check(fmt.Errorf("unknown glyph %q", *glyph))
+	}
+	if *fps < 1 {
+		check(fmt.Errorf("the fps must be positive"))
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	check(err)
+	defer tty.Close()
+
+	w := firefly.NewWorld(
+		*cw, *ch, float32(*cellSize),
+		1_000_000, 25_000,
+		*nudgeAmount*1000, float32(*nudgeRadius),
+		500_000,
+		900_000, 1_100_000,
+	)
+	defer w.Close()
+	if *seed != 0 {
+		w.SetSeed(*seed)
+	}
+	w.HatchFireflies(*nF)
+
+	t := &Terminal{}
+	t.w = w
+	t.glyph = *glyph
+	t.trueColor = *trueColor
+	t.decay = 1.0 / 600_000.0
+
+	// raw mode to read single keys, restored on exit
+	saved, err := stty(tty, "-g")
+	check(err)
+	_, err = stty(tty, "raw", "-echo")
+	check(err)
+	restore := func() {
+		stty(tty, saved)
+		// show the cursor, leave the alternate screen
+		tty.WriteString("\x1b[0m\x1b[?25h\x1b[?1049l")
+	}
+	defer restore()
+	tty.WriteString("\x1b[?1049h\x1b[?25l\x1b[2J")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	keys := make(chan byte)
+	go readKeys(tty, keys)
+
+	tick := time.NewTicker(time.Second / time.Duration(*fps))
+	defer tick.Stop()
+	for frame := 0; ; frame++ {
+		// the terminal might have been resized
+		if frame%*fps == 0 {
+			cols, rows, err := termSize(tty)
+			if err != nil || cols < 1 || rows < 2 {
+				cols, rows = 80, 24
+			}
+			if cols != t.cols || rows-1 != t.rows {
+				tty.WriteString("\x1b[2J")
+			}
+			t.cols, t.rows = cols, rows-1
+		}
+
+		step := !t.paused
+		select {
+		case <-sig:
+			return
+		case k, ok := <-keys:
+			switch {
+			// q, ctrl-c or a closed terminal
+			case !ok || k == 'q' || k == 3:
+				return
+			case k == ' ':
+				t.paused = !t.paused
+			case k == 's' && t.paused:
+				w.Step()
+			case k == '+':
+				w.SetNudgeRadius(w.NudgeRadius + 1)
+			case k == '-' && w.NudgeRadius >= 1:
+				w.SetNudgeRadius(w.NudgeRadius - 1)
+			}
+			step = false
+		case <-tick.C:
+		}
+
+		if step {
+			w.Step()
+		}
+		tty.Write(t.render())
+	}
+}
+
+func check(e error) {
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "Error:", e)
+		os.Exit(1)
+	}
+}
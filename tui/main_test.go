@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Pitrified/go-firefly"
+	"github.com/stretchr/testify/assert"
+)
+
+// A terminal on a world of 8x8 with the fireflies at the positions, all blinking now.
+func testTerminal(t *testing.T, glyph string, cols, rows int, pos ...[2]float32) *Terminal {
+	w := firefly.NewWorld(1, 1, 8, 1_000_000, 25_000, 20_000, 2, 500_000, 900_000, 1_100_000)
+	t.Cleanup(w.Close)
+	for i, p := range pos {
+		firefly.NewFirefly(p[0], p[1], 0, i, 1_000_000, w).SetNextBlink(w.Clock + 1_000_000)
+	}
+	return &Terminal{w: w, glyph: glyph, decay: 1.0 / 600_000.0, cols: cols, rows: rows}
+}
+
+// Lines of the grid drawn, the status line excluded.
+func renderLines(term *Terminal) []string {
+	lines := strings.Split(string(term.render()), "\r\n")
+	lines[0] = strings.TrimPrefix(lines[0], "\x1b[H")
+	return lines[:len(lines)-1]
+}
+
+// Each firefly lights its dot of the braille character, the empty characters are blank.
+func TestRenderBraille(t *testing.T) {
+	// 4x8 dots, the world is scaled by 0.5
+	term := testTerminal(t, glyphBraille, 2, 2, [2]float32{0, 0}, [2]float32{2, 6}, [2]float32{7, 7})
+	bright := term.color(38, 1)
+	assert.Equal(t, []string{
+		bright + "⢁" + bright + "⢀" + "\x1b[0m",
+		"\x1b[0m \x1b[0m \x1b[0m",
+	}, renderLines(term))
+}
+
+// Each character is an upper half block, with the top pixel as foreground and the bottom one as background.
+func TestRenderHalf(t *testing.T) {
+	// 4x4 pixels, the world is scaled by 0.5
+	term := testTerminal(t, glyphHalf, 4, 2, [2]float32{0, 0}, [2]float32{6, 7})
+	bright, empty := term.color(38, 1), term.color(38, -1)
+	bBright, bEmpty := term.color(48, 1), term.color(48, -1)
+	blank := empty + bEmpty + "▀"
+	assert.Equal(t, []string{
+		bright + bEmpty + "▀" + blank + blank + blank + "\x1b[0m",
+		blank + blank + blank + empty + bBright + "▀" + "\x1b[0m",
+	}, renderLines(term))
+}
+
+// The brightness goes from dim to bright yellow, on the colour cube or in 24 bit.
+func TestColor(t *testing.T) {
+	term := &Terminal{}
+	for _, tc := range []struct {
+		br   float64
+		want string
+	}{
+		{-1, "\x1b[38;5;16m"},   // black
+		{0, "\x1b[38;5;59m"},    // 30, 30, 30
+		{0.5, "\x1b[38;5;143m"}, // 142, 142, 30
+		{1, "\x1b[38;5;227m"},   // 255, 255, 30
+	} {
+		assert.Equal(t, tc.want, term.color(38, tc.br), "%v", tc.br)
+	}
+	assert.Equal(t, "\x1b[48;5;227m", term.color(48, 1))
+
+	term.trueColor = true
+	assert.Equal(t, "\x1b[38;2;0;0;0m", term.color(38, -1))
+	assert.Equal(t, "\x1b[48;2;142;142;30m", term.color(48, 0.5))
+	assert.Equal(t, "\x1b[38;2;255;255;30m", term.color(38, 1))
+}
@@ -50,6 +50,17 @@ func RandRangeInt(min, max int) int {
 	return rand.Intn(max+1-min) + min
 }
 
+// Reflect a coordinate that went beyond the walls at 0 and size.
+func reflectCoord(v, size float32) float32 {
+	if v < 0 {
+		return -v
+	}
+	if v >= size {
+		return 2*size - v
+	}
+	return v
+}
+
 // Absolute value for float32
 func AbsFloat32(a float32) float32 {
 	if a < 0 {
@@ -57,3 +68,76 @@ func AbsFloat32(a float32) float32 {
 	}
 	return a
 }
+
+// Minimum of two float32
+func MinFloat32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Maximum of two float32
+func MaxFloat32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Rand is a small splitmix64 random source.
+//
+// The whole state is a single exported word, so it can be saved and restored.
+type Rand struct {
+	State uint64 // Current state of the generator.
+}
+
+// NewRand creates a new random source from a seed.
+func NewRand(seed int64) *Rand {
+	return &Rand{State: uint64(seed)}
+}
+
+// Uint64 returns a pseudo-random 64-bit value.
+func (r *Rand) Uint64() uint64 {
+	r.State += 0x9E3779B97F4A7C15
+	return mix64(r.State)
+}
+
+// Float64 returns a pseudo-random number in [0, 1).
+func (r *Rand) Float64() float64 {
+	return float64(r.Uint64()>>11) / (1 << 53)
+}
+
+// Float32 returns a pseudo-random number in [0, 1).
+func (r *Rand) Float32() float32 {
+	return float32(r.Uint64()>>40) / (1 << 24)
+}
+
+// Intn returns a pseudo-random int in [0, n).
+func (r *Rand) Intn(n int) int {
+	return int(r.Uint64() % uint64(n))
+}
+
+// RangeInt returns an int in the requested range, including extremes.
+func (r *Rand) RangeInt(min, max int) int {
+	return r.Intn(max+1-min) + min
+}
+
+// Finalizer of splitmix64, scrambles the bits of z.
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// HashUnit returns a number in [0, 1) that only depends on the seed and the keys.
+//
+// Unlike Rand it has no state: it can be used concurrently,
+// and the result does not depend on the order of the calls.
+func HashUnit(seed int64, keys ...int) float64 {
+	z := mix64(uint64(seed))
+	for _, k := range keys {
+		z = mix64(z ^ (uint64(k) + 0x9E3779B97F4A7C15))
+	}
+	return float64(z>>11) / (1 << 53)
+}
@@ -95,3 +95,35 @@ func TestAbsFloat32(t *testing.T) {
 		assert.InDelta(t, got, c.want, 1e-6, fmt.Sprintf("Failed case %+v, got %+v", c, got))
 	}
 }
+
+// The random source is reproducible and in range.
+func TestRand(t *testing.T) {
+	r1 := NewRand(42)
+	r2 := NewRand(42)
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, r1.Uint64(), r2.Uint64(), "Same seed should give the same sequence.")
+		f := r1.Float64()
+		assert.True(t, f >= 0 && f < 1, fmt.Sprintf("Float64 out of range: %v", f))
+		g := r1.Float32()
+		assert.True(t, g >= 0 && g < 1, fmt.Sprintf("Float32 out of range: %v", g))
+		n := r1.RangeInt(-3, 3)
+		assert.True(t, n >= -3 && n <= 3, fmt.Sprintf("RangeInt out of range: %v", n))
+		r2.Float64()
+		r2.Float32()
+		r2.RangeInt(-3, 3)
+	}
+}
+
+// The hashed values are stable and spread in [0, 1).
+func TestHashUnit(t *testing.T) {
+	assert.Equal(t, HashUnit(1, 2, 3), HashUnit(1, 2, 3))
+	assert.NotEqual(t, HashUnit(1, 2, 3), HashUnit(1, 3, 2))
+	assert.NotEqual(t, HashUnit(1, 2, 3), HashUnit(2, 2, 3))
+	sum := 0.0
+	for i := 0; i < 10000; i++ {
+		h := HashUnit(5, i)
+		assert.True(t, h >= 0 && h < 1, fmt.Sprintf("HashUnit out of range: %v", h))
+		sum += h
+	}
+	assert.InDelta(t, 0.5, sum/10000, 0.02)
+}
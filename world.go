@@ -2,30 +2,62 @@ package firefly
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
 	"sync"
 )
 
 // World represents the whole environment.
+//
+// The world is flat if CellDNum is 0, a volume of cubic cells otherwise.
 type World struct {
-	Cells     [][]*Cell // Cells in the world.
-	CellWNum  int       // Width of the world in cells.
-	CellHNum  int       // Height of the world in cells.
-	CellSize  float32   // Size of the cells in pixels.
-	SizeW     float32   // Width of the world in pixels.
-	SizeH     float32   // Height of the world in pixels.
-	sizeHalfW float32   // Half the width of the world in pixels.
-	sizeHalfH float32   // Half the height of the world in pixels.
-
-	Clock         int            // Internal time of the simulation, in us.
-	ClockTickLen  int            // Update per tick.
-	wgClockTick   sync.WaitGroup // WG to sync the blinking.
-	NudgeAmount   int            // How much to nudge the firefly deadlines.
-	NudgeRadius   float32        // Max distance between communicating fireflies.
-	borderDist    float32        // Distance from a border to require a blinkQueue to the neighbor.
-	BlinkCooldown int            // Cooldown after blinking while the Firefly is not nudgeable.
-	PeriodMin     int            // Minimum length of the fireflies' period.
-	PeriodMax     int            // Maximum length of the fireflies' period.
+	Cells     [][]*Cell   // Cells in the world, the first layer of a 3D world.
+	Layers    [][][]*Cell // Cells in each layer of depth, a single one for a flat world.
+	allCells  []*Cell     // All the cells doing the work, layer by layer: the leaves with Adaptive.
+	CellWNum  int         // Width of the world in cells.
+	CellHNum  int         // Height of the world in cells.
+	CellDNum  int         // Depth of the world in cells, 0 for a flat world.
+	CellSize  float32     // Size of the cells in pixels.
+	SizeW     float32     // Width of the world in pixels.
+	SizeH     float32     // Height of the world in pixels.
+	SizeD     float32     // Depth of the world in pixels.
+	sizeHalfW float32     // Half the width of the world in pixels.
+	sizeHalfH float32     // Half the height of the world in pixels.
+	sizeHalfD float32     // Half the depth of the world in pixels.
+	Bounded   bool        // The borders are walls, instead of wrapping around the torus.
+
+	Clock           int            // Internal time of the simulation, in us.
+	ClockTickLen    int            // Update per tick.
+	wgClockTick     sync.WaitGroup // WG to sync the blinking.
+	NudgeAmount     int            // How much to nudge the firefly deadlines.
+	NudgeRadius     float32        // Max distance between communicating fireflies.
+	Perception      Perception     // How the nudge strength falls with the distance.
+	PerceptionScale float32        // Distance scale of the falloff, half the NudgeRadius if 0.
+	DetectionProb   float64        // Probability that a firefly sees each flash.
+	Coupling        Coupling       // How a seen flash changes the deadlines.
+	borderDist      float32        // Distance from a border to require a blinkQueue to the neighbor.
+	BlinkCooldown   int            // Cooldown after blinking while the Firefly is not nudgeable.
+	PeriodMin       int            // Minimum length of the fireflies' period.
+	PeriodMax       int            // Maximum length of the fireflies' period.
+
+	Seed      int64      // Seed of the random source of the world.
+	rng       *Rand      // Random source for the world level decisions.
+	Lifecycle *Lifecycle // Birth and death dynamics, nil for a fixed population.
+	nextID    int        // Id of the next firefly created by the world.
+
+	pacemakers []*Firefly // Pacemakers placed in the world.
+
+	PeriodField      *Field // Multiplies the period of the fireflies, nil for none.
+	PeriodContinuous bool   // Apply the PeriodField at every step, not only when hatching.
+	RadiusField      *Field // Multiplies the NudgeRadius, set it with SetRadiusField.
+	SpeedField       *Field // Multiplies the speed of the fireflies, nil for none.
+
+	Adaptive      *Adaptive // Splits the dense cells and merges the sparse ones, nil for the fixed grid.
+	Deterministic bool      // Blink in synchronous rounds, so that a seed always gives the same run.
+
+	Graph *Graph     // Interaction topology in graph mode, nil for the spatial swarm.
+	nodes []*Firefly // Fireflies of the graph, by node.
 
 	chChangeCell     chan *ChangeCellReq   // A firefly needs to enter/leave the cell.
 	chChangeCellDone chan bool             // The cell change is done.
@@ -34,9 +66,10 @@ type World struct {
 	DoStep   chan byte      // Channel to request a step of the env.
 	DoneStep chan bool      // Channel to signal the end of a step of the env.
 	wgMove   sync.WaitGroup // WG to sync the fireflies movement.
+	quit     chan struct{}  // Closed to stop the goroutines of the world.
 }
 
-// NewWorld creates a new World.
+// NewWorld creates a new flat World.
 func NewWorld(
 	cw, ch int,
 	cellSize float32,
@@ -46,6 +79,27 @@ func NewWorld(
 	blinkCooldown int,
 	periodMin, periodMax int,
 ) *World {
+	return NewWorld3D(
+		cw, ch, 0,
+		cellSize,
+		clockStart, clockTickLen,
+		nudgeAmount,
+		nudgeRadius,
+		blinkCooldown,
+		periodMin, periodMax,
+	)
+}
+
+// NewWorld3D creates a new World with cd layers of cubic cells, flat if cd is 0.
+func NewWorld3D(
+	cw, ch, cd int,
+	cellSize float32,
+	clockStart, clockTickLen int,
+	nudgeAmount int,
+	nudgeRadius float32,
+	blinkCooldown int,
+	periodMin, periodMax int,
+) *World {
 
 	cacheCosSin()
 
@@ -55,10 +109,13 @@ func NewWorld(
 	w.CellSize = cellSize
 	w.CellWNum = cw
 	w.CellHNum = ch
+	w.CellDNum = cd
 	w.SizeW = float32(cw) * cellSize
 	w.SizeH = float32(ch) * cellSize
+	w.SizeD = float32(cd) * cellSize
 	w.sizeHalfW = w.SizeW / 2
 	w.sizeHalfH = w.SizeH / 2
+	w.sizeHalfD = w.SizeD / 2
 
 	// nudging params
 	w.Clock = clockStart
@@ -66,6 +123,8 @@ func NewWorld(
 	w.NudgeAmount = nudgeAmount
 	w.NudgeRadius = nudgeRadius
 	w.borderDist = w.NudgeRadius / 2
+	w.Perception = PerceptionStep
+	w.DetectionProb = 1
 	w.BlinkCooldown = blinkCooldown
 	w.PeriodMin = periodMin
 	w.PeriodMax = periodMax
@@ -80,22 +139,35 @@ func NewWorld(
 	// w.NudgeRadius = 100
 	// w.BlinkCooldown = 500_000 // 200 ms
 
+	// random source, use SetSeed for a reproducible world
+	w.SetSeed(rand.Int63())
+
 	// channels
 	w.chChangeCell = make(chan *ChangeCellReq, 100)
 	w.chChangeCellDone = make(chan bool)
 	w.chChangeCells = make(chan []*ChangeCellReq)
 	w.DoStep = make(chan byte)
 	w.DoneStep = make(chan bool)
+	w.quit = make(chan struct{})
 
-	// create the cells
-	c := make([][]*Cell, cw)
-	for i := 0; i < cw; i++ {
-		c[i] = make([]*Cell, ch)
-		for ii := 0; ii < ch; ii++ {
-			c[i][ii] = NewCell(w, i, ii)
+	// create the cells, a flat world has a single layer
+	layers := cd
+	if layers < 1 {
+		layers = 1
+	}
+	w.Layers = make([][][]*Cell, layers)
+	for iii := 0; iii < layers; iii++ {
+		c := make([][]*Cell, cw)
+		for i := 0; i < cw; i++ {
+			c[i] = make([]*Cell, ch)
+			for ii := 0; ii < ch; ii++ {
+				c[i][ii] = newCell(w, i, ii, iii)
+				w.allCells = append(w.allCells, c[i][ii])
+			}
 		}
+		w.Layers[iii] = c
 	}
-	w.Cells = c
+	w.Cells = w.Layers[0]
 
 	// start listening
 	go w.Listen()
@@ -109,17 +181,139 @@ func (w *World) HatchFireflies(n int) {
 }
 
 // HatchFireflies creates a swarm of fireflies, with IDs starting from idStart.
+//
+// If a Lifecycle is set, the fireflies get a random age,
+// so that the swarm does not die all at once.
+// In graph mode the fireflies are the nodes, hatched by SetGraph, and none is created.
 func (w *World) HatchFirefliesFromID(n, idStart int) {
+	if w.Graph != nil {
+		return
+	}
 	for i := idStart; i < n+idStart; i++ {
 		// random pos/ori/period
-		x := rand.Float32() * w.SizeW
-		y := rand.Float32() * w.SizeH
-		o := int16(rand.Float64() * 360)
-		p := RandRangeInt(w.PeriodMin, w.PeriodMax)
-		NewFirefly(x, y, o, i, p, w)
+		x := w.rng.Float32() * w.SizeW
+		y := w.rng.Float32() * w.SizeH
+		z := w.randomDepth()
+		o := int16(w.rng.Float64() * 360)
+		p := w.rng.RangeInt(w.PeriodMin, w.PeriodMax)
+		f := NewFirefly3D(x, y, z, o, i, p, w)
+		if f.Death > 0 {
+			f.Death = w.Clock + w.rng.RangeInt(0, f.Death-w.Clock)
+		}
+	}
+}
+
+// SetSeed resets the random source of the world.
+func (w *World) SetSeed(seed int64) {
+	w.Seed = seed
+	w.rng = NewRand(seed)
+}
+
+// SetNudgeRadius changes the radius of interaction,
+// and the distance from the borders at which the blinks are sent to the neighbors.
+func (w *World) SetNudgeRadius(r float32) {
+	w.NudgeRadius = r
+	w.borderDist = w.NudgeRadius / 2
+	if w.RadiusField != nil && w.RadiusField.Max > 1 {
+		w.borderDist *= w.RadiusField.Max
+	}
+}
+
+// BorderDist returns the distance from the borders of a cell
+// within which the blinks are also sent to the neighboring cells.
+func (w *World) BorderDist() float32 {
+	return w.borderDist
+}
+
+// ScramblePhases moves the next blink of all the fireflies to a random time within their period.
+//
+// The pacemakers keep their schedule.
+func (w *World) ScramblePhases() {
+	for _, f := range w.sortedFireflies() {
+		if f.Pacemaker == nil {
+			f.SetNextBlink(w.Clock + w.rng.RangeInt(1000, f.Period))
+		}
+	}
+}
+
+// Fireflies of the world sorted by id.
+//
+// The maps of the cells have no order: the random source is drawn in this one, to reproduce a run from its seed.
+func (w *World) sortedFireflies() []*Firefly {
+	fireflies := []*Firefly{}
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			fireflies = append(fireflies, f)
+		}
+	}
+	sort.Slice(fireflies, func(i, j int) bool { return fireflies[i].Id < fireflies[j].Id })
+	return fireflies
+}
+
+// Population returns the number of fireflies in the world, pacemakers excluded.
+func (w *World) Population() int {
+	tot := 0
+	for _, c := range w.allCells {
+		tot += len(c.Fireflies)
+	}
+	return tot - len(w.pacemakers)
+}
+
+// AddFireflies creates n fireflies in random positions, with random phases.
+//
+// In graph mode the fireflies are the nodes, and none is added.
+//
+// Does not need the World to be listening: it can be used between steps.
+func (w *World) AddFireflies(n int) {
+	if w.Graph != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		x := w.rng.Float32() * w.SizeW
+		y := w.rng.Float32() * w.SizeH
+		w.spawnFirefly(x, y)
+	}
+}
+
+// RemoveFireflies removes n fireflies, taking from each cell in turn the one with the lowest id.
+//
+// The pacemakers are never removed.
+// In graph mode the fireflies are the nodes, and none is removed.
+//
+// Does not need the World to be listening: it can be used between steps.
+func (w *World) RemoveFireflies(n int) {
+	if w.Graph != nil {
+		return
+	}
+	for n > 0 && w.Population() > 0 {
+		for _, c := range w.allCells {
+			if n == 0 {
+				break
+			}
+			var first *Firefly
+			for _, f := range c.Fireflies {
+				if f.Pacemaker == nil && (first == nil || f.Id < first.Id) {
+					first = f
+				}
+			}
+			if first != nil {
+				c.Leave(first)
+				n--
+			}
+		}
 	}
 }
 
+// Create a firefly with random depth, orientation, period and phase, and put it in its cell.
+func (w *World) spawnFirefly(x, y float32) *Firefly {
+	z := w.randomDepth()
+	o := int16(w.rng.Float64() * 360)
+	p := w.rng.RangeInt(w.PeriodMin, w.PeriodMax)
+	f := newFirefly(x, y, z, o, w.nextID, p, w)
+	w.ChangeCell(&ChangeCellReq{f, nil, f.c})
+	return f
+}
+
 // Listen to all the channels to react.
 func (w *World) Listen() {
 	for {
@@ -134,25 +328,42 @@ func (w *World) Listen() {
 		case <-w.DoStep:
 			w.Step()
 			w.DoneStep <- true
+
+		// the world is closed
+		case <-w.quit:
+			return
 		}
 	}
 }
 
-// Perform a step of the simulation: move the fireflies and advance the clock.
+// Close stops the goroutines of the world and of its cells.
+//
+// Must be called between steps, the World can not be used after.
+func (w *World) Close() {
+	close(w.quit)
+}
+
+// Perform a step of the simulation: move the fireflies, advance the clock
+// and update the population.
+//
+// In graph mode the fireflies do not move nor age.
 func (w *World) Step() {
+	if w.Graph != nil {
+		w.ClockTick()
+		return
+	}
 	w.Move()
 	w.ClockTick()
+	w.Age()
 }
 
 // Perform a movement of the fireflies.
 func (w *World) Move() {
 
 	// move all the fireflies
-	for i := 0; i < w.CellWNum; i++ {
-		for ii := 0; ii < w.CellHNum; ii++ {
-			w.wgMove.Add(1)
-			w.Cells[i][ii].chMove <- 'M'
-		}
+	for _, c := range w.allCells {
+		w.wgMove.Add(1)
+		c.chMove <- 'M'
 	}
 
 	// wait for the wg to be done
@@ -161,43 +372,49 @@ func (w *World) Move() {
 	w.wgMove.Wait()
 
 	// perform all the cell change
-	for i := 0; i < w.CellWNum; i++ {
-		for ii := 0; ii < w.CellHNum; ii++ {
-			reqs := <-w.chChangeCells
-			for _, r := range reqs {
-				w.ChangeCell(r)
-			}
+	for range w.allCells {
+		reqs := <-w.chChangeCells
+		for _, r := range reqs {
+			w.ChangeCell(r)
 		}
 	}
 
+	// follow the swarm with the cells
+	if w.Adaptive != nil {
+		w.Rebalance()
+	}
 }
 
 // Perform a clock tick and blink the fireflies.
 func (w *World) ClockTick() {
 	w.Clock += w.ClockTickLen
 
+	// the blinks follow the edges of the graph, not the cells
+	if w.Graph != nil {
+		w.graphBlink()
+		return
+	}
+	if w.Deterministic {
+		w.syncBlink(nil)
+		return
+	}
+
 	// reset all the cells to working
-	for i := 0; i < w.CellWNum; i++ {
-		for ii := 0; ii < w.CellHNum; ii++ {
-			w.Cells[i][ii].idle = false
-		}
+	for _, c := range w.allCells {
+		c.idle = false
 	}
 
 	// blink the fireflies in each cell
 	// wait for all the cells to be done simultaneously
-	for i := 0; i < w.CellWNum; i++ {
-		for ii := 0; ii < w.CellHNum; ii++ {
-			w.wgClockTick.Add(1)
-			w.Cells[i][ii].chBlink <- 'B'
-		}
+	for _, c := range w.allCells {
+		w.wgClockTick.Add(1)
+		c.chBlink <- 'B'
 	}
 	w.wgClockTick.Wait()
 
 	// send a signal to all cells to quit blinking
-	for i := 0; i < w.CellWNum; i++ {
-		for ii := 0; ii < w.CellHNum; ii++ {
-			w.Cells[i][ii].blinkDone <- true
-		}
+	for _, c := range w.allCells {
+		c.blinkDone <- true
 	}
 }
 
@@ -255,10 +472,36 @@ func (w *World) SendBlinkTo(f *Firefly, c *Cell, dir byte) {
 	}
 
 	// find the neighboring cell on the toro
-	ncx, ncy := f.w.MoveWrapCell(f.c.Cx, f.c.Cy, dx, dy)
-	nc := w.Cells[ncx][ncy]
+	if nc := w.neighborCell(f.c, dx, dy, 0); nc != nil {
+		w.sendBlink(f, nc)
+	}
+}
+
+// Find the neighbor of the cell at offset (dx, dy, dz).
+//
+// Return nil if the neighbor is beyond the walls of a bounded world.
+func (w *World) neighborCell(c *Cell, dx, dy, dz int) *Cell {
+	cx, cy, cz := c.Cx+dx, c.Cy+dy, c.Cz+dz
+	layers := len(w.Layers)
+	if w.Bounded {
+		if cx < 0 || cx >= w.CellWNum || cy < 0 || cy >= w.CellHNum || cz < 0 || cz >= layers {
+			return nil
+		}
+		return w.Layers[cz][cx][cy]
+	}
+	cx, cy = w.MoveWrapCell(c.Cx, c.Cy, dx, dy)
+	cz = (cz%layers + layers) % layers
+	return w.Layers[cz][cx][cy]
+}
+
+// Find the cell containing a valid position, the leaf of the quadtree with Adaptive.
+func (w *World) cellAt(x, y, z float32) *Cell {
+	return w.Layers[int(z/w.CellSize)][int(x/w.CellSize)][int(y/w.CellSize)].leafAt(x, y)
+}
 
-	// check if ncx,ncy was idling
+// Send a blink to the blinkQueue of the cell.
+func (w *World) sendBlink(f *Firefly, nc *Cell) {
+	// check if the cell was idling
 	// if so, set idle to false and Add(1) on the WaitGroup counter
 	nc.idleLock.Lock()
 	nc.blinkQueue <- f
@@ -270,37 +513,66 @@ func (w *World) SendBlinkTo(f *Firefly, c *Cell, dir byte) {
 }
 
 // Compute the Manhattan distance on a torus between two fireflies.
+//
+// In a bounded world the distance does not wrap around.
 func (w *World) ManhattanDist(f, g *Firefly) float32 {
 
 	// if the two are further apart than the SizeHalf
 	// the shorter distance is by going around the toro
 	ax := AbsFloat32(f.X - g.X)
-	if ax > w.sizeHalfW {
+	if ax > w.sizeHalfW && !w.Bounded {
 		ax = w.SizeW - ax
 	}
 	ay := AbsFloat32(f.Y - g.Y)
-	if ay > w.sizeHalfH {
+	if ay > w.sizeHalfH && !w.Bounded {
 		ay = w.SizeH - ay
 	}
+	az := AbsFloat32(f.Z - g.Z)
+	if az > w.sizeHalfD && !w.Bounded {
+		az = w.SizeD - az
+	}
 
-	return ax + ay
+	return ax + ay + az
 }
 
 // Ensure that the coordinates provided are a valid world position.
-func (w *World) validatePos(x, y float32) (float32, float32) {
-	for x < 0 {
-		x += w.SizeW
+//
+// The position wraps around the torus, or is clamped to the walls of a bounded world.
+func (w *World) validatePos(x, y, z float32) (float32, float32, float32) {
+	x = w.validateCoord(x, w.SizeW)
+	y = w.validateCoord(y, w.SizeH)
+	if w.CellDNum == 0 {
+		return x, y, 0
 	}
-	for x >= w.SizeW {
-		x -= w.SizeW
+	return x, y, w.validateCoord(z, w.SizeD)
+}
+
+// Ensure that the coordinate is in [0, size).
+func (w *World) validateCoord(v, size float32) float32 {
+	if w.Bounded {
+		if v < 0 {
+			return 0
+		}
+		if v >= size {
+			return math.Nextafter32(size, 0)
+		}
+		return v
 	}
-	for y < 0 {
-		y += w.SizeH
+	for v < 0 {
+		v += size
 	}
-	for y >= w.SizeH {
-		y -= w.SizeH
+	for v >= size {
+		v -= size
 	}
-	return x, y
+	return v
+}
+
+// Random depth for a new firefly, 0 in a flat world.
+func (w *World) randomDepth() float32 {
+	if w.CellDNum == 0 {
+		return 0
+	}
+	return w.rng.Float32() * w.SizeD
 }
 
 // String implements fmt.Stringer.
@@ -310,13 +582,9 @@ func (w *World) String() string {
 		w.CellSize,
 		w.SizeW, w.SizeH,
 	)
-	for i := 0; i < w.CellWNum; i++ {
-		for ii := 0; ii < w.CellHNum; ii++ {
-			// Add the state of the cell to the World repr.
-			s += fmt.Sprintf("\nC: %v",
-				w.Cells[i][ii],
-			)
-		}
+	for _, c := range w.allCells {
+		// Add the state of the cell to the World repr.
+		s += fmt.Sprintf("\nC: %v", c)
 	}
 	return s
 }
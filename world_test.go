@@ -112,7 +112,7 @@ func TestValidatePos(t *testing.T) {
 	}
 	for _, c := range cases {
 		f := NewFirefly(c.x, c.y, 0, 0, 1000000, w)
-		gotX, gotY := w.validatePos(f.X, f.Y)
+		gotX, gotY, _ := w.validatePos(f.X, f.Y, 0)
 		assert.InDelta(t, gotX, c.nx, 1e-6, fmt.Sprintf("Failed case %+v, got %+v", c, gotX))
 		assert.InDelta(t, gotY, c.ny, 1e-6, fmt.Sprintf("Failed case %+v, got %+v", c, gotY))
 	}
@@ -215,5 +215,60 @@ func TestManhattanDist(t *testing.T) {
 // Check that the fields/verbs used when printing are valid.
 func TestStringWorld(t *testing.T) {
 	w := NewWorld(10, 10, 100, 1_000_000, 25_000, 50_000, 50, 500_000, 900_000, 1_1000_000)
-	w.String()
+	_ = w.String()
+}
+
+// The fireflies of a 3D world fill the volume, and stay in the right cubic cell.
+func TestWorld3D(t *testing.T) {
+	w := NewWorld3D(3, 3, 3, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	w.SetSeed(4)
+	assert.Len(t, w.Layers, 3)
+	assert.Len(t, w.allCells, 27)
+	assert.Equal(t, w.Layers[0], w.Cells)
+	w.HatchFireflies(300)
+
+	for i := 0; i < 200; i++ {
+		w.Step()
+	}
+	assert.Equal(t, 300, w.Population())
+	deep := 0
+	for _, c := range w.allCells {
+		for _, f := range c.Fireflies {
+			assert.GreaterOrEqual(t, f.Z, c.back)
+			assert.LessOrEqual(t, f.Z, c.front)
+			assert.GreaterOrEqual(t, f.X, c.left)
+			assert.LessOrEqual(t, f.X, c.right)
+			assert.LessOrEqual(t, f.P, int16(90))
+			assert.GreaterOrEqual(t, f.P, int16(-90))
+			if c.Cz == 2 {
+				deep++
+			}
+		}
+	}
+	assert.Greater(t, deep, 50)
+
+	// the distance wraps around the depth too
+	f := &Firefly{X: 10, Y: 10, Z: 5}
+	g := &Firefly{X: 12, Y: 10, Z: 145}
+	assert.InDelta(t, 12, w.ManhattanDist(f, g), 1e-4)
+	w.Bounded = true
+	assert.InDelta(t, 142, w.ManhattanDist(f, g), 1e-4)
+}
+
+// In a bounded world the fireflies bounce off the walls.
+func TestBounded(t *testing.T) {
+	w := NewWorld3D(2, 2, 2, 50, 1_000_000, 25_000, 20_000, 20, 500_000, 900_000, 1_100_000)
+	w.Bounded = true
+	f := NewFirefly3D(99.9, 50, 99.9, 0, 0, 1_000_000, w)
+	f.P = 45
+	f.Move()
+	assert.Less(t, f.X, float32(100))
+	assert.Less(t, f.Z, float32(100))
+	assert.InDelta(t, 180, f.O, 1)
+	assert.InDelta(t, -45, f.P, 1)
+
+	// the position is clamped to the walls
+	x, _, z := w.validatePos(-3, 10, 120)
+	assert.Equal(t, float32(0), x)
+	assert.Less(t, z, float32(100))
 }